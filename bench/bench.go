@@ -0,0 +1,343 @@
+/*
+	Usage:
+	go run bench.go [-rounds n] [server ip:port] [reader ip:port] [writer ip:port]
+
+	Measures moving a whole 256 chunk file with the per-chunk protocol
+	against the batched one. A writer process, started by the benchmark,
+	rewrites the file before each round, so every read must fetch the
+	chunks from the writer:
+
+	write  per-chunk   256 sequential Writes, one WriteFile each
+	write  coalesced   256 concurrent Writes, coalesced into WriteChunks
+	read   per-chunk   256 sequential Reads without readahead, one ReadFile
+	                   and one RetrieveLatestChunk from the writer each
+	read   readahead   256 sequential Reads with an 8 chunk readahead window
+	read   prefetch    Prefetch(0, 255), then 256 sequential Reads
+	read   coalesced   256 concurrent Reads, coalesced into ReadChunks
+
+	Example:
+	go run server.go 127.0.0.1:3000
+	go run bench.go 127.0.0.1:3000 127.0.0.1:3020 127.0.0.1:3021
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../dfslib"
+)
+
+type Chunk = dfslib.Chunk
+
+const (
+	chunksPerFile = 256
+	benchFile     = "benchfile"
+)
+
+func main() {
+	rounds := flag.Int("rounds", 5, "rounds of each measurement")
+	writerMode := flag.Bool("writer", false, "run as the writer process; used by the benchmark itself")
+	flag.Parse()
+
+	if *writerMode {
+		if flag.NArg() != 3 {
+			exitOnError(fmt.Errorf("writer takes [server ip:port] [writer ip:port] [path]"))
+		}
+		runWriter(flag.Arg(0), flag.Arg(1), flag.Arg(2))
+		return
+	}
+
+	if flag.NArg() != 3 {
+		fmt.Fprintln(os.Stderr, "usage: go run bench.go [-rounds n] [server ip:port] [reader ip:port] [writer ip:port]")
+		os.Exit(2)
+	}
+	serverAddr, readerAddr, writerAddr := flag.Arg(0), flag.Arg(1), flag.Arg(2)
+
+	readerPath, err := ioutil.TempDir("", "dfsbench-reader")
+	exitOnError(err)
+	defer os.RemoveAll(readerPath)
+	writerPath, err := ioutil.TempDir("", "dfsbench-writer")
+	exitOnError(err)
+	defer os.RemoveAll(writerPath)
+
+	writer, err := startWriter(serverAddr, writerAddr, writerPath+"/")
+	exitOnError(err)
+	defer writer.stop()
+
+	dfs, err := dfslib.MountDFS(serverAddr, readerAddr, readerPath+"/")
+	exitOnError(err)
+	defer dfs.UMountDFS()
+
+	results := make(map[string][]time.Duration)
+	reads := []struct {
+		name string
+		read func() (time.Duration, error)
+	}{
+		{"per-chunk", func() (time.Duration, error) { return readFile(dfs, false, dfslib.WithReadahead(0)) }},
+		{"readahead", func() (time.Duration, error) { return readFile(dfs, false, dfslib.WithReadahead(8)) }},
+		{"prefetch", func() (time.Duration, error) { return readFile(dfs, true) }},
+		{"coalesced", func() (time.Duration, error) { return readFileConcurrently(dfs) }},
+	}
+
+	for i := 0; i < *rounds; i++ {
+		for j, r := range reads {
+			// Alternate how the writer rewrites the file, so both are measured
+			mode := "per-chunk"
+			if (i*len(reads)+j)%2 == 1 {
+				mode = "coalesced"
+			}
+			d, err := writer.write(mode)
+			exitOnError(err)
+			results["write "+mode] = append(results["write "+mode], d)
+
+			d, err = r.read()
+			exitOnError(err)
+			results["read  "+r.name] = append(results["read  "+r.name], d)
+		}
+	}
+
+	for _, name := range []string{"write per-chunk", "write coalesced",
+		"read  per-chunk", "read  readahead", "read  prefetch", "read  coalesced"} {
+		report(name, results[name])
+	}
+}
+
+/*
+ Purpose: Reads every chunk of the benchmark file in order
+ Params: dfs - the reader's mount; prefetch - whether to Prefetch the whole file first; opts - open options
+ Returns: The time taken, from opening the file until the last Read returns
+ Throws: Any dfslib error
+*/
+func readFile(dfs dfslib.DFS, prefetch bool, opts ...dfslib.OpenOption) (time.Duration, error) {
+	start := time.Now()
+	f, err := dfs.Open(benchFile, dfslib.READ, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if prefetch {
+		err = f.Prefetch(0, chunksPerFile-1)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var c Chunk
+	for i := 0; i < chunksPerFile; i++ {
+		err = f.Read(uint8(i), &c)
+		if err != nil {
+			return 0, err
+		}
+		err = checkChunk(i, &c)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
+
+/*
+ Purpose: Reads every chunk of the benchmark file at once, one goroutine per chunk
+ Params: dfs - the reader's mount
+ Returns: The time taken, from opening the file until the last Read returns
+ Throws: Any dfslib error
+*/
+func readFileConcurrently(dfs dfslib.DFS) (time.Duration, error) {
+	start := time.Now()
+	f, err := dfs.Open(benchFile, dfslib.READ, dfslib.WithReadahead(0))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	err = forEachChunk(func(i int) error {
+		var c Chunk
+		err := f.Read(uint8(i), &c)
+		if err != nil {
+			return err
+		}
+		return checkChunk(i, &c)
+	})
+	return time.Since(start), err
+}
+
+// forEachChunk calls fn for every chunk concurrently, returning the first error
+func forEachChunk(fn func(i int) error) error {
+	errs := make([]error, chunksPerFile)
+	var wg sync.WaitGroup
+	for i := 0; i < chunksPerFile; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func chunkContents(i int) Chunk {
+	var c Chunk
+	copy(c[:], fmt.Sprintf("benchmark chunk %d", i))
+	return c
+}
+
+func checkChunk(i int, c *Chunk) error {
+	if *c != chunkContents(i) {
+		return fmt.Errorf("chunk %d read back as %q", i, c[:])
+	}
+	return nil
+}
+
+func report(name string, ds []time.Duration) {
+	if len(ds) == 0 {
+		return
+	}
+
+	var total time.Duration
+	for _, d := range ds {
+		total += d
+	}
+	mean := total / time.Duration(len(ds))
+	fmt.Printf("%-15s  %3d chunks  %10v  %8.0f chunks/s\n", name, chunksPerFile, mean.Round(10*time.Microsecond),
+		float64(chunksPerFile)/mean.Seconds())
+}
+
+//==========================================
+// The writer process
+//==========================================
+
+type writerProcess struct {
+	cmd    *exec.Cmd
+	stdin  *bufio.Writer
+	stdout *bufio.Scanner
+}
+
+/*
+ Purpose: Starts this program as the writer, which must be a separate client
+ Params: serverAddr - the server; writerAddr, writerPath - the writer's address and cache
+ Returns: The running writer, once it has opened the file for writing
+ Throws: Any error starting it, or the error it reports
+*/
+func startWriter(serverAddr, writerAddr, writerPath string) (*writerProcess, error) {
+	cmd := exec.Command(os.Args[0], "-writer", serverAddr, writerAddr, writerPath)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &writerProcess{cmd: cmd, stdin: bufio.NewWriter(stdin), stdout: bufio.NewScanner(stdout)}
+	_, err = w.reply()
+	if err != nil {
+		w.stop()
+		return nil, err
+	}
+	return w, nil
+}
+
+// write asks the writer to rewrite every chunk, per-chunk or coalesced
+func (w *writerProcess) write(mode string) (time.Duration, error) {
+	fmt.Fprintln(w.stdin, mode)
+	err := w.stdin.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return w.reply()
+}
+
+// reply reads the writer's next line: "ok <nanoseconds>" or "error <message>"
+func (w *writerProcess) reply() (time.Duration, error) {
+	if !w.stdout.Scan() {
+		return 0, fmt.Errorf("writer exited")
+	}
+
+	line := w.stdout.Text()
+	if strings.HasPrefix(line, "error ") {
+		return 0, fmt.Errorf("writer: %s", strings.TrimPrefix(line, "error "))
+	}
+	ns, err := strconv.ParseInt(strings.TrimPrefix(line, "ok "), 10, 64)
+	return time.Duration(ns), err
+}
+
+func (w *writerProcess) stop() {
+	w.cmd.Process.Kill()
+	w.cmd.Wait()
+}
+
+/*
+ Purpose: Runs the writer: opens the benchmark file for writing, then rewrites
+          every chunk for each line read from stdin, replying on stdout
+ Params: serverAddr - the server; writerAddr, writerPath - this client's address and cache
+ Returns
+ Throws:
+*/
+func runWriter(serverAddr, writerAddr, writerPath string) {
+	dfs, err := dfslib.MountDFS(serverAddr, writerAddr, writerPath)
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	defer dfs.UMountDFS()
+
+	f, err := dfs.Open(benchFile, dfslib.WRITE)
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	defer f.Close()
+	fmt.Println("ok 0")
+
+	stdin := bufio.NewScanner(os.Stdin)
+	for stdin.Scan() {
+		start := time.Now()
+		if stdin.Text() == "coalesced" {
+			err = forEachChunk(func(i int) error {
+				c := chunkContents(i)
+				return f.Write(uint8(i), &c)
+			})
+		} else {
+			for i := 0; i < chunksPerFile && err == nil; i++ {
+				c := chunkContents(i)
+				err = f.Write(uint8(i), &c)
+			}
+		}
+
+		if err != nil {
+			fmt.Println("error", err)
+			return
+		}
+		fmt.Println("ok", int64(time.Since(start)))
+	}
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"../dfslib"
+	"../harness"
+)
+
+// The benchmarks share one cluster: a harness client rewrites benchFile
+// before each read, so every read fetches the chunks from it, and this
+// process mounts as the reader, or as the writer of writeFile
+const writeFile = "benchwrite"
+
+var (
+	setupOnce sync.Once
+	setupErr  error
+	cluster   *harness.Cluster
+	writer    *harness.File // benchFile, open for writing in the cluster's client
+	dfs       dfslib.DFS
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if dfs != nil {
+		dfs.UMountDFS()
+	}
+	if cluster != nil {
+		cluster.Close()
+	}
+	os.Exit(code)
+}
+
+// setup starts the cluster and mounts this process the first time a benchmark needs them
+func setup(b *testing.B) {
+	setupOnce.Do(func() {
+		cluster, setupErr = harness.NewCluster(1)
+		if setupErr != nil {
+			return
+		}
+		writer, setupErr = cluster.Clients[0].Open(benchFile, dfslib.WRITE)
+		if setupErr != nil {
+			return
+		}
+
+		var l net.Listener
+		l, setupErr = net.Listen("tcp", "127.0.0.1:0")
+		if setupErr != nil {
+			return
+		}
+		addr := l.Addr().String()
+		l.Close()
+
+		path := filepath.Join(cluster.Dir, "bench") + string(filepath.Separator)
+		setupErr = os.Mkdir(path, 0755)
+		if setupErr != nil {
+			return
+		}
+		dfs, setupErr = dfslib.MountDFS(cluster.Server.Addr, addr, path)
+	})
+	if setupErr != nil {
+		b.Fatal(setupErr)
+	}
+}
+
+// rewrite has the cluster's client write every chunk of benchFile again, outside the timer
+func rewrite(b *testing.B) {
+	b.StopTimer()
+	defer b.StartTimer()
+
+	err := forEachChunk(func(i int) error {
+		return writer.Write(uint8(i), chunkContents(i))
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchmarkRead(b *testing.B, read func() error) {
+	setup(b)
+	b.SetBytes(chunksPerFile * int64(len(Chunk{})))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rewrite(b)
+		err := read()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadPerChunk reads the file with one ReadFile per chunk
+func BenchmarkReadPerChunk(b *testing.B) {
+	benchmarkRead(b, func() error {
+		_, err := readFile(dfs, false, dfslib.WithReadahead(0))
+		return err
+	})
+}
+
+// BenchmarkReadReadahead reads the file in order with an 8 chunk readahead window
+func BenchmarkReadReadahead(b *testing.B) {
+	benchmarkRead(b, func() error {
+		_, err := readFile(dfs, false, dfslib.WithReadahead(8))
+		return err
+	})
+}
+
+// BenchmarkReadPrefetch fetches the whole file with one ReadChunks before reading it
+func BenchmarkReadPrefetch(b *testing.B) {
+	benchmarkRead(b, func() error {
+		_, err := readFile(dfs, true)
+		return err
+	})
+}
+
+// BenchmarkReadCoalesced reads every chunk at once, so the reads are batched into ReadChunks
+func BenchmarkReadCoalesced(b *testing.B) {
+	benchmarkRead(b, func() error {
+		_, err := readFileConcurrently(dfs)
+		return err
+	})
+}
+
+func benchmarkWrite(b *testing.B, write func(f dfslib.DFSFile) error) {
+	setup(b)
+	f, err := dfs.Open(writeFile, dfslib.WRITE)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	b.SetBytes(chunksPerFile * int64(len(Chunk{})))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = write(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWritePerChunk writes the file with one WriteFile per chunk
+func BenchmarkWritePerChunk(b *testing.B) {
+	benchmarkWrite(b, func(f dfslib.DFSFile) error {
+		for i := 0; i < chunksPerFile; i++ {
+			c := chunkContents(i)
+			err := f.Write(uint8(i), &c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BenchmarkWriteCoalesced writes every chunk at once, so the writes are batched into WriteChunks
+func BenchmarkWriteCoalesced(b *testing.B) {
+	benchmarkWrite(b, func(f dfslib.DFSFile) error {
+		return forEachChunk(func(i int) error {
+			c := chunkContents(i)
+			return f.Write(uint8(i), &c)
+		})
+	})
+}
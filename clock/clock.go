@@ -0,0 +1,36 @@
+// Package clock is the time source of the server's failure detector and
+// dfslib's heartbeats, so that tests can replace real time with a Fake
+// they advance by hand
+package clock
+
+import (
+	"time"
+)
+
+// A Clock tells the time and waits for it to pass. Implementations must
+// be safe for concurrent use.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the system clock, used unless another is configured
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (Real) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
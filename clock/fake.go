@@ -0,0 +1,122 @@
+package clock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Fake is a Clock whose time only moves when Advance is called, so a
+// test decides exactly when heartbeats are due and sessions expire
+type Fake struct {
+	lock     sync.Mutex
+	now      time.Time
+	sleepers []sleeper
+	changed  chan struct{} // closed, and replaced, whenever sleepers changes
+}
+
+// A sleeper is a call to Sleep or After waiting for the fake time to pass until
+type sleeper struct {
+	until time.Time
+	wake  chan time.Time
+}
+
+// NewFake returns a Fake reading start until advanced
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start, changed: make(chan struct{})}
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	wake := make(chan time.Time, 1)
+	if d <= 0 {
+		wake <- f.now
+		return wake
+	}
+	f.sleepers = append(f.sleepers, sleeper{until: f.now.Add(d), wake: wake})
+	f.notify()
+	return wake
+}
+
+/*
+ Purpose: Moves the time forward, waking every Sleep and After due by then, earliest first
+ Params: d - how far; negative durations are ignored
+ Returns
+ Throws:
+*/
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if d <= 0 {
+		return
+	}
+	f.now = f.now.Add(d)
+
+	sort.SliceStable(f.sleepers, func(i, j int) bool {
+		return f.sleepers[i].until.Before(f.sleepers[j].until)
+	})
+	due := 0
+	for due < len(f.sleepers) && !f.sleepers[due].until.After(f.now) {
+		f.sleepers[due].wake <- f.now
+		due++
+	}
+	if due > 0 {
+		f.sleepers = append([]sleeper(nil), f.sleepers[due:]...)
+		f.notify()
+	}
+}
+
+// Sleepers returns how many calls to Sleep and After are waiting now
+func (f *Fake) Sleepers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.sleepers)
+}
+
+/*
+ Purpose: Waits until at least n calls to Sleep and After are waiting, e.g. for
+          goroutines woken by Advance to finish their work and sleep again
+ Params: ctx - bounds the wait; n - the number of sleepers
+ Returns
+ Throws: ctx.Err() if ctx ends first
+*/
+func (f *Fake) WaitForSleepers(ctx context.Context, n int) error {
+	for {
+		f.lock.Lock()
+		count, changed := len(f.sleepers), f.changed
+		f.lock.Unlock()
+
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify wakes WaitForSleepers; callers must hold lock
+func (f *Fake) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
@@ -0,0 +1,99 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeStandsStill(t *testing.T) {
+	f := NewFake(start)
+	time.Sleep(10 * time.Millisecond)
+	if !f.Now().Equal(start) || f.Since(start) != 0 {
+		t.Fatalf("fake time moved to %v without Advance", f.Now())
+	}
+
+	f.Advance(time.Second)
+	f.Advance(-time.Hour)
+	if f.Since(start) != time.Second {
+		t.Fatalf("Since after advancing 1s: %v", f.Since(start))
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	f := NewFake(start)
+	if got := <-f.After(0); !got.Equal(start) {
+		t.Fatalf("After(0) fired at %v", got)
+	}
+
+	first, second := f.After(time.Second), f.After(2*time.Second)
+	if f.Sleepers() != 2 {
+		t.Fatalf("Sleepers: got %d, want 2", f.Sleepers())
+	}
+
+	f.Advance(1500 * time.Millisecond)
+	select {
+	case got := <-first:
+		if !got.Equal(start.Add(1500 * time.Millisecond)) {
+			t.Errorf("first fired at %v", got)
+		}
+	default:
+		t.Fatal("After(1s) not fired by advancing 1.5s")
+	}
+	select {
+	case <-second:
+		t.Fatal("After(2s) fired by advancing 1.5s")
+	default:
+	}
+	if f.Sleepers() != 1 {
+		t.Fatalf("Sleepers: got %d, want 1", f.Sleepers())
+	}
+
+	f.Advance(500 * time.Millisecond)
+	select {
+	case <-second:
+	default:
+		t.Fatal("After(2s) not fired by advancing 2s")
+	}
+}
+
+func TestFakeSleep(t *testing.T) {
+	f := NewFake(start)
+	woke := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(woke)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := f.WaitForSleepers(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Advance(59 * time.Second)
+	select {
+	case <-woke:
+		t.Fatal("Sleep(1m) returned after 59s")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	f.Advance(time.Second)
+	select {
+	case <-woke:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sleep(1m) did not return after 1m")
+	}
+}
+
+func TestWaitForSleepersTimesOut(t *testing.T) {
+	f := NewFake(start)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := f.WaitForSleepers(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
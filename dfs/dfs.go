@@ -0,0 +1,336 @@
+/*
+	Usage:
+	go run dfs.go [flags] command [args]
+
+	Commands:
+	ls                          lists the files you may read
+	stat fname                  shows a file's owner, write lock and chunk versions
+	cat fname                   prints a file's contents
+	put localfile fname         copies a local file of at most 8192 bytes into the dfs,
+	                            waiting until another client holds a copy
+	get fname localfile         copies a dfs file to a local file
+	rm fname                    removes a file from the dfs
+	exists (--local|--global) fname
+	                            reports whether a file is cached locally or exists in the dfs
+	watch fname                 prints each write to a file until it is removed
+
+	Flags:
+	-server ip:port     address of the dfs server
+	-callback ip:port   address this client listens on for the server's calls
+	-cache path         local directory caching .dfs files, ending in a separator
+	-cert, -key, -ca    mutual TLS certificate, key and certificate authority
+	-wait duration      how long put waits for another client to copy the file, 2m by default
+	-v                  logs dfslib's activity to stderr
+	-config file        JSON file providing any of the above, e.g.
+	                    {"Server": "127.0.0.1:3000", "Callback": "127.0.0.1:3010", "Cache": "../tmp/"}
+	                    Defaults to $HOME/.dfs.json when present. Flags override the file.
+
+	The dfs keeps chunks only in the caches of connected clients, and a
+	client's copies stop counting once it unmounts. put therefore writes
+	the file and then stays mounted until the server's scrubber has copied
+	every chunk to another connected client that may read the file. If none
+	has within -wait, put fails and the file's chunks become unavailable;
+	keep a long-lived client mounted, or write from one, to store data.
+
+	Example:
+	go run dfs.go -server 127.0.0.1:3000 -callback 127.0.0.1:3010 -cache ../tmp/ put notes.txt notes
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"../dfslib"
+	"../logging"
+)
+
+type Chunk = dfslib.Chunk
+
+const (
+	chunksPerFile = 256
+	fileSize      = chunksPerFile * len(Chunk{})
+	replicaPoll   = 1000 // defines time between checks for copies of a put file in milliseconds
+)
+
+var mounted dfslib.DFS // unmounted before exiting, so the server ends the session at once
+
+// Config holds the settings that may come from the config file
+type Config struct {
+	Server   string
+	Callback string
+	Cache    string
+	Cert     string
+	Key      string
+	CA       string
+}
+
+func main() {
+	config := Config{Server: "127.0.0.1:3000", Callback: "127.0.0.1:3010", Cache: "./"}
+	configFile := flag.String("config", "", "JSON config file")
+	flag.StringVar(&config.Server, "server", config.Server, "address of the dfs server")
+	flag.StringVar(&config.Callback, "callback", config.Callback, "address to listen on for the server's calls")
+	flag.StringVar(&config.Cache, "cache", config.Cache, "local directory caching .dfs files")
+	flag.StringVar(&config.Cert, "cert", "", "client certificate for mutual TLS")
+	flag.StringVar(&config.Key, "key", "", "client private key for mutual TLS")
+	flag.StringVar(&config.CA, "ca", "", "certificate authority that signs the server certificate")
+	wait := flag.Duration("wait", 2*time.Minute, "how long put waits for another client to copy the file")
+	verbose := flag.Bool("v", false, "log dfslib's activity to stderr")
+	flag.Parse()
+
+	exitOnError(applyConfigFile(&config, *configFile))
+
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var opts []dfslib.MountOption
+	if config.Cert != "" || config.Key != "" || config.CA != "" {
+		opts = append(opts, dfslib.WithTLS(config.Cert, config.Key, config.CA))
+	}
+	if *verbose {
+		opts = append(opts, dfslib.WithLogger(logging.NewText(os.Stderr, logging.Debug, "dfslib: ")))
+	}
+
+	dfs, err := dfslib.MountDFS(config.Server, config.Callback, config.Cache, opts...)
+	exitOnError(err)
+	mounted = dfs
+	defer dfs.UMountDFS()
+
+	switch {
+	case args[0] == "ls" && len(args) == 1:
+		fnames, err := dfs.ListFiles()
+		exitOnError(err)
+		sort.Strings(fnames)
+		for _, fname := range fnames {
+			fmt.Println(fname)
+		}
+	case args[0] == "stat" && len(args) == 2:
+		stat, err := dfs.Stat(args[1])
+		exitOnError(err)
+		fmt.Printf("Name:      %s\n", stat.Name)
+		fmt.Printf("Owner:     %s\n", stat.Owner)
+		fmt.Printf("Encrypted: %t\n", stat.Sealed)
+		fmt.Printf("Locked:    %t\n", stat.IsLockedForWrite)
+		for chunkNum, version := range stat.Versions {
+			if version > 0 {
+				fmt.Printf("Chunk %3d: version %d\n", chunkNum, version)
+			}
+		}
+	case args[0] == "cat" && len(args) == 2:
+		contents, err := readFile(dfs, args[1])
+		exitOnError(err)
+		os.Stdout.Write(contents)
+	case args[0] == "put" && len(args) == 3:
+		contents, err := ioutil.ReadFile(args[1])
+		exitOnError(err)
+		exitOnError(writeFile(dfs, args[2], contents))
+		exitOnError(waitForCopies(dfs, args[2], contents, *wait))
+	case args[0] == "get" && len(args) == 3:
+		contents, err := readFile(dfs, args[1])
+		exitOnError(err)
+		exitOnError(ioutil.WriteFile(args[2], contents, 0644))
+	case args[0] == "rm" && len(args) == 2:
+		exitOnError(dfs.Remove(args[1]))
+	case args[0] == "exists" && len(args) == 3:
+		var exists bool
+		switch args[1] {
+		case "--local", "-local":
+			exists, err = dfs.LocalFileExists(args[2])
+		case "--global", "-global":
+			exists, err = dfs.GlobalFileExists(args[2])
+		default:
+			flag.Usage()
+			exit(2)
+		}
+		exitOnError(err)
+		fmt.Println(exists)
+		if !exists {
+			exit(1)
+		}
+	case args[0] == "watch" && len(args) == 2:
+		events, err := dfs.Watch(args[1])
+		exitOnError(err)
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				if ev.Removed {
+					fmt.Printf("%s removed\n", ev.Fname)
+				} else {
+					fmt.Printf("%s chunk %d now at version %d\n", ev.Fname, ev.ChunkNum, ev.Version)
+				}
+			case <-interrupts:
+				return
+			}
+		}
+	default:
+		flag.Usage()
+		exit(2)
+	}
+}
+
+/*
+ Purpose: Fills settings not given as flags from a JSON config file
+ Params: config - the settings parsed from flags; path - the config file, or "" for $HOME/.dfs.json
+ Returns
+ Throws: Any error reading or decoding an explicitly named config file
+*/
+func applyConfigFile(config *Config, path string) error {
+	if path == "" {
+		path = filepath.Join(os.Getenv("HOME"), ".dfs.json")
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var fromFile Config
+	err = json.Unmarshal(contents, &fromFile)
+	if err != nil {
+		return err
+	}
+
+	setByFlag := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setByFlag[f.Name] = true })
+
+	fields := []struct {
+		flag  string
+		value *string
+		file  string
+	}{
+		{"server", &config.Server, fromFile.Server},
+		{"callback", &config.Callback, fromFile.Callback},
+		{"cache", &config.Cache, fromFile.Cache},
+		{"cert", &config.Cert, fromFile.Cert},
+		{"key", &config.Key, fromFile.Key},
+		{"ca", &config.CA, fromFile.CA},
+	}
+	for _, field := range fields {
+		if !setByFlag[field.flag] && field.file != "" {
+			*field.value = field.file
+		}
+	}
+	return nil
+}
+
+/*
+ Purpose: Reads every chunk of a file in READ mode
+ Params: dfs - the mounted dfs; fname - the file
+ Returns: The file's contents without trailing zero padding
+ Throws: Any error opening or reading the file
+*/
+func readFile(dfs dfslib.DFS, fname string) ([]byte, error) {
+	f, err := dfs.Open(fname, dfslib.READ)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	contents := make([]byte, 0, fileSize)
+	for chunkNum := 0; chunkNum < chunksPerFile; chunkNum++ {
+		var c Chunk
+		err = f.Read(uint8(chunkNum), &c)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, c[:]...)
+	}
+
+	end := len(contents)
+	for end > 0 && contents[end-1] == 0 {
+		end--
+	}
+	return contents[:end], nil
+}
+
+/*
+ Purpose: Writes contents into a file in WRITE mode, chunk by chunk
+ Params: dfs - the mounted dfs; fname - the file; contents - at most fileSize bytes
+ Returns
+ Throws: An error if contents are too large, or any error opening or writing the file
+*/
+func writeFile(dfs dfslib.DFS, fname string, contents []byte) error {
+	if len(contents) > fileSize {
+		return fmt.Errorf("dfs: [%d] bytes exceeds the maximum file size of [%d] bytes", len(contents), fileSize)
+	}
+
+	f, err := dfs.Open(fname, dfslib.WRITE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for chunkNum := 0; chunkNum*len(Chunk{}) < len(contents); chunkNum++ {
+		var c Chunk
+		copy(c[:], contents[chunkNum*len(c):])
+		err = f.Write(uint8(chunkNum), &c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ Purpose: Waits until a client other than this one holds every chunk of a file that was
+          written, since this client's copies stop counting once it unmounts
+ Params: dfs - the mounted dfs; fname - the file; contents - what was written; wait - how long to wait
+ Returns
+ Throws: An error if some chunk has no other copy after wait, or any error from Stat
+*/
+func waitForCopies(dfs dfslib.DFS, fname string, contents []byte, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		stat, err := dfs.Stat(fname)
+		if err != nil {
+			return err
+		}
+
+		copied := true
+		for chunkNum := 0; chunkNum*len(Chunk{}) < len(contents); chunkNum++ {
+			if stat.Owners[chunkNum] < 2 {
+				copied = false
+			}
+		}
+		if copied {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dfs: No other client copied [%s] within %v; its chunks are unavailable once this client unmounts", fname, wait)
+		}
+		time.Sleep(replicaPoll * time.Millisecond)
+	}
+}
+
+// exit unmounts, if mounted, before exiting with code
+func exit(code int) {
+	if mounted != nil {
+		mounted.UMountDFS()
+	}
+	os.Exit(code)
+}
+
+func exitOnError(e error) {
+	if e != nil {
+		fmt.Println("dfs: Encountered error - ", e.Error())
+		exit(-1)
+	}
+}
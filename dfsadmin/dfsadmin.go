@@ -0,0 +1,243 @@
+/*
+	Usage:
+	go run dfsadmin.go [-server ip:port] [-cert file -key file -ca file] command [args]
+
+	Commands:
+	users                      lists registered users and their last heartbeat
+	files                      lists files, their writer, and who has them open
+	chunks fname               lists the version and owners of each written chunk of a file
+	usage                      lists bytes stored per owner and per namespace
+	close ip:port path fname   closes a file on behalf of a user
+	revoke fname               revokes the write lock on a file
+	evict ip:port path         disconnects a user
+
+	Example:
+	go run dfsadmin.go -server 127.0.0.1:3000 users
+	go run dfsadmin.go -cert admin.crt -key admin.key -ca ca.crt revoke openTest
+
+	Over TLS, the certificate's common name must be listed in the server's -admins.
+	Without TLS, the server must have been started with -insecure-admin.
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+type FileMode int
+
+type UserInfo struct {
+	LocalIP   string
+	LocalPath string
+}
+
+type UserStatus struct {
+	User          UserInfo
+	Principal     string
+	LastHeartbeat time.Time
+	Suspected     bool
+	Connected     bool
+}
+
+type OpenStatus struct {
+	User  UserInfo
+	Fmode FileMode
+}
+
+type ChunkStatus struct {
+	ChunkNum uint8
+	Version  int
+	Owners   []UserInfo
+}
+
+type FileStatus struct {
+	Name             string
+	Owner            string
+	IsLockedForWrite bool
+	Writer           UserInfo
+	OpenedBy         []OpenStatus
+	Chunks           []ChunkStatus
+}
+
+type AdminInfo struct {
+	User  UserInfo
+	Fname string
+}
+
+type Usage struct {
+	Name  string
+	Bytes int64
+	Limit int64
+}
+
+type UsageReport struct {
+	Users      []Usage
+	Namespaces []Usage
+}
+
+var modeNames = map[FileMode]string{1: "READ", 2: "WRITE", 3: "DREAD"}
+
+func main() {
+	serverAddr := flag.String("server", "127.0.0.1:3000", "address of the dfs server")
+	certFile := flag.String("cert", "", "admin certificate for mutual TLS")
+	keyFile := flag.String("key", "", "admin private key for mutual TLS")
+	caFile := flag.String("ca", "", "certificate authority that signs the server certificate")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	server, err := dialServer(*serverAddr, *certFile, *keyFile, *caFile)
+	exitOnError(err)
+	defer server.Close()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+
+	reply := false
+	switch {
+	case args[0] == "users" && len(args) == 1:
+		var users []UserStatus
+		exitOnError(server.Call("ServerRPC.AdminListUsers", 0, &users))
+		fmt.Fprintln(out, "ADDRESS\tPATH\tPRINCIPAL\tLAST HEARTBEAT\tSUSPECTED\tCONNECTED")
+		for _, u := range users {
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%t\t%t\n", u.User.LocalIP, u.User.LocalPath, u.Principal,
+				u.LastHeartbeat.Format(time.RFC3339), u.Suspected, u.Connected)
+		}
+	case args[0] == "files" && len(args) == 1:
+		fileStatuses := listFiles(server)
+		fmt.Fprintln(out, "NAME\tOWNER\tWRITER\tOPENED BY\tWRITTEN CHUNKS")
+		for _, f := range fileStatuses {
+			writer := "-"
+			if f.IsLockedForWrite {
+				writer = formatUser(f.Writer)
+			}
+			opened := "-"
+			for i, o := range f.OpenedBy {
+				if i == 0 {
+					opened = ""
+				} else {
+					opened += ", "
+				}
+				opened += formatUser(o.User) + " " + modeNames[o.Fmode]
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%d\n", f.Name, f.Owner, writer, opened, len(f.Chunks))
+		}
+	case args[0] == "chunks" && len(args) == 2:
+		for _, f := range listFiles(server) {
+			if f.Name != args[1] {
+				continue
+			}
+			fmt.Fprintln(out, "CHUNK\tVERSION\tOWNERS")
+			for _, c := range f.Chunks {
+				owners := ""
+				for i, o := range c.Owners {
+					if i > 0 {
+						owners += ", "
+					}
+					owners += formatUser(o)
+				}
+				fmt.Fprintf(out, "%d\t%d\t%s\n", c.ChunkNum, c.Version, owners)
+			}
+			return
+		}
+		exitOnError(fmt.Errorf("no such file [%s]", args[1]))
+	case args[0] == "usage" && len(args) == 1:
+		var report UsageReport
+		exitOnError(server.Call("ServerRPC.AdminUsage", 0, &report))
+		fmt.Fprintln(out, "KIND\tNAME\tBYTES\tLIMIT")
+		for _, u := range report.Users {
+			fmt.Fprintf(out, "owner\t%s\t%d\t%s\n", u.Name, u.Bytes, formatLimit(u.Limit))
+		}
+		for _, u := range report.Namespaces {
+			fmt.Fprintf(out, "namespace\t%s\t%d\t%s\n", u.Name, u.Bytes, formatLimit(u.Limit))
+		}
+	case args[0] == "close" && len(args) == 4:
+		ai := AdminInfo{User: UserInfo{LocalIP: args[1], LocalPath: args[2]}, Fname: args[3]}
+		exitOnError(server.Call("ServerRPC.AdminCloseFile", ai, &reply))
+	case args[0] == "revoke" && len(args) == 2:
+		exitOnError(server.Call("ServerRPC.AdminRevokeWriteLock", args[1], &reply))
+	case args[0] == "evict" && len(args) == 3:
+		user := UserInfo{LocalIP: args[1], LocalPath: args[2]}
+		exitOnError(server.Call("ServerRPC.AdminEvictUser", user, &reply))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+/*
+ Purpose: Dials the server, over mutual TLS if a certificate is given
+ Params: addr - the server address; certFile, keyFile, caFile - TLS material, or empty
+ Returns: An RPC client connected to the server
+ Throws: Any error loading certificates or dialing
+*/
+func dialServer(addr, certFile, keyFile, caFile string) (*rpc.Client, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return rpc.Dial("tcp", addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in [%s]", caFile)
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: ca})
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+/*
+ Purpose: Fetches the status of every file, sorted by name
+ Params: server - the connection to the server
+ Returns
+ Throws:
+*/
+func listFiles(server *rpc.Client) []FileStatus {
+	var fileStatuses []FileStatus
+	exitOnError(server.Call("ServerRPC.AdminListFiles", 0, &fileStatuses))
+	sort.Slice(fileStatuses, func(i, j int) bool { return fileStatuses[i].Name < fileStatuses[j].Name })
+	return fileStatuses
+}
+
+func formatUser(u UserInfo) string {
+	return u.LocalIP + " @ " + u.LocalPath
+}
+
+func formatLimit(limit int64) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d", limit)
+}
+
+func exitOnError(e error) {
+	if e != nil {
+		fmt.Println("dfsadmin: Encountered error - ", e.Error())
+		os.Exit(-1)
+	}
+}
@@ -8,13 +8,32 @@
 package dfslib
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/rpc"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
+
+	"../clock"
+	"../logging"
+	"../metrics"
+	"../tracing"
+	"../transport"
 )
 
 // Files are accessed in chunks of 32 bytes.
@@ -30,54 +49,405 @@ const (
 	DREAD FileMode = 3
 )
 
+type Permission int
+
+// Permissions granted by an ACL entry are a combination of the below
+const (
+	PermRead  Permission = 1
+	PermWrite Permission = 2
+	PermAdmin Permission = 4
+)
+
 const (
-	hbInterval = 5000 // defines heartbeat interval in milliseconds
+	watchBuffer     = 64           // defines the events buffered per Watch channel before dropping
+	peerTimeout     = 2000         // bounds each direct fetch from an owner in milliseconds
+	callbackTimeout = 5000         // bounds the wait for the server's callback ping while mounting in milliseconds
+	sequentialReads = 2            // defines the consecutive reads in chunk order that start readahead
+	prefetchExpiry  = 5000         // defines how long a prefetched chunk may serve a read in milliseconds
+	nonceSize       = 12           // defines the AES-GCM nonce size in bytes
+	sealedChunkSize = 32 + 12 + 16 // defines the stored size of an encrypted chunk: nonce, ciphertext, tag
 )
 
 var (
 	theDFSInstance DFS // singleton pattern
 	connToServer   *rpc.Client
 	myUser         UserInfo
+	localVersions  map[string]*[256]int // version of each chunk cached locally, by file name
+	generations    map[string]uint64    // generation of the file localVersions caches, by file name
+	versionsLock   sync.Mutex
+	tlsConfig      *tls.Config                 // nil unless mounted with WithTLS
+	serverIdentity string                      // common name of the server certificate, when using TLS
+	serverCert     *x509.Certificate           // checks grants presented by peers, when using TLS
+	directTransfer bool                        // fetch stale chunks from owners rather than through the server
+	network        transport.Network           // dials the server and peers, and listens for both
+	multiplexed    bool                        // the server's calls arrive over the connection to it, so nothing listens
+	clk            clock.Clock                 // times heartbeats
+	hbInterval     time.Duration               // agreed with the server at Register
+	sessionID      string                      // the session Register started, which heartbeats carry
+	watchChans     map[string][]chan FileEvent // channels returned by Watch, by file name
+	watchLock      sync.Mutex
+	openFiles      map[*dfsFileObject]bool // files opened and not yet closed, which UMountDFS closes
+	openLock       sync.Mutex
+
+	mountLock       sync.Mutex        // guards the mount state below
+	unmounting      bool              // refuses new calls to the server while UMountDFS drains them
+	expiredSession  string            // the session the server ended, which calls report until the next mount
+	serverCalls     sync.WaitGroup    // calls to the server in flight
+	stopHeartbeats  chan struct{}     // closed by UMountDFS to stop keepAlive
+	heartbeatsDone  chan struct{}     // closed once keepAlive returns
+	callbacks       net.Listener      // accepts the server and peers until UMountDFS
+	callbackPinged  chan struct{}     // closed by the server's ping while mounting
+	callbackConns   map[net.Conn]bool // connections accepted by callbacks, closed by UMountDFS
+	callbackServers sync.WaitGroup    // listen and serveConn goroutines
+
+	clientMetrics   = metrics.NewRegistry()
+	metricsListener net.Listener // serving clientMetrics, once mounted WithMetrics
+	metricsLock     sync.Mutex
+	rpcRequests     = clientMetrics.NewCounter("dfs_client_rpc_requests_total", "Calls to the server by method and outcome.", "method", "outcome")
+	rpcDuration     = clientMetrics.NewHistogram("dfs_client_rpc_duration_seconds", "Latency of calls to the server by method.", metrics.DefaultBuckets, "method")
+	chunkReads      = clientMetrics.NewCounter("dfs_client_chunk_reads_total", "DFSFile reads served from the local cache (hit), fetched through the server (miss), fetched from an owner (peer), or prefetched (readahead).", "result")
+	logger          = logging.Nop()
+	tracer          *tracing.Tracer // nil unless mounted WithTracer
 )
 
+// The Context variants return ctx.Err() once ctx is cancelled or its
+// deadline passes. A read's deadline also bounds the server's fetch of
+// the chunk from other clients.
 type DFSFile interface {
 	Read(chunkNum uint8, chunk *Chunk) (err error)
+	ReadContext(ctx context.Context, chunkNum uint8, chunk *Chunk) (err error)
 	Write(chunkNum uint8, chunk *Chunk) (err error)
+	WriteContext(ctx context.Context, chunkNum uint8, chunk *Chunk) (err error)
 	Dread(chunkNum uint8, chunk *Chunk) (err error)
+	Prefetch(from, to uint8) (err error)
+	PrefetchContext(ctx context.Context, from, to uint8) (err error)
 	Close() (err error)
+	CloseContext(ctx context.Context) (err error)
 }
 
 type dfsFileObject struct {
-	fd       *os.File
-	fm       FileMode
-	name     string
-	chunkVer [256]int
+	fd   *os.File
+	fm   FileMode
+	name string
+	aead cipher.AEAD // nil unless the file was opened WithEncryptionKey
+
+	// Each write of a sealed file binds the version it creates, which the
+	// write lock lets this client know. Used only by the writes batcher.
+	versions      [256]int // latest version of each chunk
+	versionsKnown bool     // false until versions is loaded, and after a failed write
+
+	readahead  int                 // chunks fetched per batch once reads turn sequential, 0 to disable
+	raLock     sync.Mutex          // guards the fields below
+	nextChunk  int                 // the chunk a sequential reader reads next
+	sequential int                 // consecutive reads in chunk order, ending at nextChunk - 1
+	prefetched map[uint8]time.Time // chunks cached ahead of the reader, and when
+
+	reads  batcher // coalesces concurrent Reads into ReadChunks calls
+	writes batcher // coalesces concurrent Writes into WriteChunks calls
 }
 
+// Each call to the server has a Context variant, as for DFSFile
 type DFS interface {
 	LocalFileExists(fname string) (exists bool, err error)
 	GlobalFileExists(fname string) (exists bool, err error)
-	Open(fname string, mode FileMode) (f DFSFile, err error)
+	GlobalFileExistsContext(ctx context.Context, fname string) (exists bool, err error)
+	Open(fname string, mode FileMode, opts ...OpenOption) (f DFSFile, err error)
+	OpenContext(ctx context.Context, fname string, mode FileMode, opts ...OpenOption) (f DFSFile, err error)
+	SetACL(fname string, acl ACL) (err error)
+	SetACLContext(ctx context.Context, fname string, acl ACL) (err error)
+	GetACL(fname string) (acl ACL, err error)
+	GetACLContext(ctx context.Context, fname string) (acl ACL, err error)
+	Usage() (usage Usage, err error)
+	UsageContext(ctx context.Context) (usage Usage, err error)
+	ListFiles() (fnames []string, err error)
+	ListFilesContext(ctx context.Context) (fnames []string, err error)
+	Stat(fname string) (stat FileStat, err error)
+	StatContext(ctx context.Context, fname string) (stat FileStat, err error)
+	Remove(fname string) (err error)
+	RemoveContext(ctx context.Context, fname string) (err error)
+	Watch(fname string) (events <-chan FileEvent, err error)
+	WatchContext(ctx context.Context, fname string) (events <-chan FileEvent, err error)
 	UMountDFS() (err error)
+	UMountDFSContext(ctx context.Context) (err error)
+}
+
+// FileStat describes a file as known to the server. Versions holds the
+// global version of each chunk; chunks never written are at version 0.
+type FileStat struct {
+	Name             string
+	Owner            string
+	Sealed           bool // chunks are encrypted
+	IsLockedForWrite bool
+	Versions         [256]int
+	Owners           [256]int // connected clients holding each chunk's latest version
+}
+
+// A FileEvent reports that a chunk of a watched file was written, or that
+// the file was removed. When a client's session ends the server also reports
+// each file it held open for writing, which may now be opened for writing
+// again, and each chunk whose latest version no connected client holds.
+type FileEvent struct {
+	Fname       string
+	ChunkNum    uint8
+	Version     int
+	Removed     bool
+	Released    bool // the writer's session ended, releasing the write lock
+	Unavailable bool // the chunk's latest version is unavailable until rewritten
+}
+
+// Usage reports the bytes of chunk data stored in files owned by Name.
+// A Limit of 0 means unlimited.
+type Usage struct {
+	Name  string
+	Bytes int64
+	Limit int64
+}
+
+// An OpenOption configures optional behaviour of DFS.Open
+type OpenOption func(*openOptions) error
+
+type openOptions struct {
+	aead      cipher.AEAD
+	readahead int
+}
+
+// WithEncryptionKey encrypts the file's chunks with AES-GCM under key,
+// which must be 16, 24 or 32 bytes long. Chunks are sealed before they
+// leave the application, so neither the server nor peers caching the
+// file see plaintext. A file must always be opened with the encryption
+// mode it was created with, and every client must supply the same key.
+func WithEncryptionKey(key []byte) OpenOption {
+	return func(oo *openOptions) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+
+		oo.aead, err = cipher.NewGCM(block)
+		return err
+	}
+}
+
+// WithReadahead sets how many chunks a Read fetches in one call to the
+// server once reads of the file turn sequential. Readahead is off by
+// default, since it weakens READ mode: a Read served from readahead
+// returns the version that was latest when the chunk was prefetched, up
+// to 5 seconds earlier, not the latest. A window of 0 or 1 disables
+// readahead; windows above 256 are capped.
+func WithReadahead(chunks int) OpenOption {
+	return func(oo *openOptions) error {
+		if chunks < 0 {
+			chunks = 0
+		} else if chunks > 256 {
+			chunks = 256
+		}
+		oo.readahead = chunks
+		return nil
+	}
+}
+
+// An ACL grants permissions on a file. Entries are keyed by principal
+// (the certificate common name under TLS), by "group:<name>" for a group
+// defined on the server, or by "*" for every principal. The owner is
+// the principal that created the file and holds every permission.
+type ACL struct {
+	Owner   string
+	Entries map[string]Permission
 }
 
 type dfsObject struct{}
 
+// A MountOption configures optional behaviour of MountDFS
+type MountOption func(*mountOptions) error
+
+type mountOptions struct {
+	tlsConfig   *tls.Config
+	metricsAddr string
+	logger      logging.Logger
+	tracer      *tracing.Tracer
+	direct      bool
+	network     transport.Network
+	clock       clock.Clock
+	heartbeat   time.Duration
+	multiplex   bool
+}
+
+// WithTLS connects to the server over mutual TLS. The client is identified
+// to the server by the common name of its certificate, and only the server
+// may connect to the client's reverse RPC listener. Certificates must be
+// valid for both client and server authentication.
+func WithTLS(certFile, keyFile, caFile string) MountOption {
+	return func(mo *mountOptions) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+
+		ca := x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("dfslib: no certificates found in [%s]", caFile)
+		}
+
+		mo.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: ca}
+		return nil
+	}
+}
+
+// WithMetrics serves the client's metrics in the Prometheus text format
+// at http://addr/metrics. Metrics are process wide, so the endpoint is
+// started by the first mount that asks for it.
+func WithMetrics(addr string) MountOption {
+	return func(mo *mountOptions) error {
+		mo.metricsAddr = addr
+		return nil
+	}
+}
+
+// WithLogger sends dfslib's log entries to l. Without it dfslib logs nothing.
+func WithLogger(l logging.Logger) MountOption {
+	return func(mo *mountOptions) error {
+		mo.logger = l
+		return nil
+	}
+}
+
+// WithTracer records spans for Open, Read, Write and Close, and for
+// chunks this client serves to the server, through t. Span contexts are
+// sent with each call so the server's and peers' spans join the trace.
+// The caller owns t and should Shutdown it after UMountDFS.
+func WithTracer(t *tracing.Tracer) MountOption {
+	return func(mo *mountOptions) error {
+		mo.tracer = t
+		return nil
+	}
+}
+
+// WithDirectTransfer fetches chunks this client does not hold directly
+// from the clients that do, so chunk data no longer passes through the
+// server. Each fetched chunk is checked against the checksum the server
+// recorded when it was written. If no owner can serve it, the server
+// relays the chunk as usual. Owners only serve chunks over TLS, so
+// without it every read is relayed.
+func WithDirectTransfer() MountOption {
+	return func(mo *mountOptions) error {
+		mo.direct = true
+		return nil
+	}
+}
+
+// WithNetwork dials the server and other clients, and listens for their
+// calls, through n instead of TCP. Tests use it with a transport.Proxy to
+// inject faults between chosen nodes.
+func WithNetwork(n transport.Network) MountOption {
+	return func(mo *mountOptions) error {
+		mo.network = n
+		return nil
+	}
+}
+
+// WithMultiplexing carries the server's calls to the client over the
+// connection the client dials, so the client needs no listening port and
+// works behind NAT or a firewall. localIP then only names the client and
+// is not bound; it must still be unique. Peers cannot reach the client,
+// so the server never names it to WithDirectTransfer readers, and relays
+// its chunks to them as to any other reader.
+func WithMultiplexing() MountOption {
+	return func(mo *mountOptions) error {
+		mo.multiplex = true
+		return nil
+	}
+}
+
+// WithHeartbeatInterval asks the server to expect a heartbeat every d
+// rather than at its own interval, e.g. a longer one on a slow network.
+// The server agrees to any interval from 100ms to 1m, and clamps others.
+func WithHeartbeatInterval(d time.Duration) MountOption {
+	return func(mo *mountOptions) error {
+		mo.heartbeat = d
+		return nil
+	}
+}
+
+// WithClock times heartbeats to the server with c instead of the system
+// clock. Tests use it with a clock.Fake to decide when heartbeats are sent.
+func WithClock(c clock.Clock) MountOption {
+	return func(mo *mountOptions) error {
+		mo.clock = c
+		return nil
+	}
+}
+
 type UserInfo struct {
 	LocalIP   string
 	LocalPath string
 }
 
+type RegisterInfo struct {
+	User              UserInfo
+	HeartbeatInterval time.Duration // asked for, or 0 for the server's
+}
+
+type RegisterValue struct {
+	Session           string        // the new session, which heartbeats must carry
+	HeartbeatInterval time.Duration // the interval the server expects
+}
+
+type RegisterFileValue struct {
+	Generation uint64 // changes when the file is removed and created again
+}
+
+type HeartbeatInfo struct {
+	User    UserInfo
+	Session string
+}
+
+func (u UserInfo) String() string {
+	return u.LocalIP + " @ " + u.LocalPath
+}
+
 type FileInfo struct {
-	User  UserInfo
-	Name  string
-	Fmode FileMode
+	User   UserInfo
+	Name   string
+	Fmode  FileMode
+	Sealed bool
+	Trace  tracing.SpanContext
 }
 
 type WriteInfo struct {
 	User     UserInfo
 	Fname    string
 	ChunkNum uint8
+	Checksum [sha256.Size]byte
+	Version  int // for sealed files, the version the ciphertext is bound to; 0 for the next
+	Trace    tracing.SpanContext
+}
+
+type WriteValue struct {
+	GlobalChunkVer int
+}
+
+type WriteChunksInfo struct {
+	User      UserInfo
+	Fname     string
+	ChunkNums []uint8
+	Checksums [][sha256.Size]byte // of the bytes stored for each of ChunkNums
+	Versions  []int               // as WriteInfo.Version for each of ChunkNums, or nil
+	Trace     tracing.SpanContext
+}
+
+type WriteChunksValue struct {
+	GlobalChunkVers []int
+}
+
+type ACLInfo struct {
+	User  UserInfo
+	Fname string
+	ACL   ACL
 }
 
 type ReadInfo struct {
@@ -85,28 +455,147 @@ type ReadInfo struct {
 	Fname         string
 	ChunkNum      uint8
 	LocalChunkVer int
+	Sealed        bool
+	Trace         tracing.SpanContext
+	Deadline      time.Time // zero unless the caller's context has a deadline
+	Direct        bool      // fetch from Peers rather than have the server relay the chunk
+}
+
+type ReadChunksInfo struct {
+	User           UserInfo
+	Fname          string
+	ChunkNums      []uint8
+	LocalChunkVers []int // the cached version of each of ChunkNums
+	Sealed         bool
+	Trace          tracing.SpanContext
+	Deadline       time.Time
+	Direct         bool
+}
+
+// Chunks holds a ReadValue for each of the requested ChunkNums, in order
+type ReadChunksValue struct {
+	Chunks []ReadValue
 }
 
+// Chunk contents travel as the bytes stored for the chunk locally,
+// which are ciphertext for encrypted files. A Direct read receives the
+// owners to fetch from instead, and the checksum of the stored bytes.
 type ReadValue struct {
-	Chnk           Chunk
+	Data           []byte
 	IsNew          bool
-	globalChunkVer int
+	GlobalChunkVer int
+	Peers          []UserInfo
+	Checksum       [sha256.Size]byte
+	Grant          ChunkGrant
+	Unavailable    bool // set by ReadChunks for a chunk whose latest version no owner could serve
+}
+
+// A ChunkGrant, signed by the server, lets Reader fetch a chunk version
+// from its owners until Expires. Without TLS it is unsigned.
+type ChunkGrant struct {
+	Reader    string
+	Fname     string
+	ChunkNum  uint8
+	Version   int
+	Expires   time.Time
+	Algorithm x509.SignatureAlgorithm
+	Signature []byte
+}
+
+// A ChunkReceipt reports that User fetched a chunk version from Owner
+// directly, taking Latency
+type ChunkReceipt struct {
+	User     UserInfo
+	Fname    string
+	ChunkNum uint8
+	Version  int
+	Owner    UserInfo
+	Latency  time.Duration
+	Trace    tracing.SpanContext
+}
+
+type PeerRequest struct {
+	Fname    string
+	ChunkNum uint8
+	Sealed   bool
+	Grant    ChunkGrant
+	Trace    tracing.SpanContext
+}
+
+type VerifyInfo struct {
+	Fname    string
+	ChunkNum uint8
+	Sealed   bool
+	Trace    tracing.SpanContext
+}
+
+type VerifyValue struct {
+	Present  bool
+	Version  int
+	Checksum [sha256.Size]byte
+}
+
+type ReplicaInfo struct {
+	Fname      string
+	Generation uint64
+	ChunkNum   uint8
+	Version    int
+	Sealed     bool
+	Data       []byte
+	Trace      tracing.SpanContext
 }
 
 /*
  Purpose:
  Params:
  Returns
- Throws:
+ Throws: AlreadyMountedError until UMountDFS if this process is mounted, even if its session expired
+ Note: The options of a mount are applied only once nothing is mounted, so a second
+       call cannot change those of the live mount
 */
-func MountDFS(serverAddr string, localIP string, localPath string) (dfs DFS, err error) {
+func MountDFS(serverAddr string, localIP string, localPath string, opts ...MountOption) (dfs DFS, err error) {
+	mountLock.Lock()
+	mounted := callbacks != nil
+	mountLock.Unlock()
+	if mounted {
+		return nil, AlreadyMountedError(myUser.LocalIP)
+	}
+
 	if checkLocalPathOK(localPath) {
-		if theDFSInstance == nil {
-			theDFSInstance = dfsObject{}
+		mo := mountOptions{network: transport.TCP{}, clock: clock.Real{}}
+		for _, opt := range opts {
+			err = opt(&mo)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tlsConfig = mo.tlsConfig
+		if mo.logger != nil {
+			logger = mo.logger
+		}
+		tracer = mo.tracer
+		directTransfer = mo.direct
+		network = mo.network
+		clk = mo.clock
+		multiplexed = mo.multiplex
+
+		if mo.metricsAddr != "" {
+			err = serveMetrics(mo.metricsAddr)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		myUser = UserInfo{LocalIP: localIP, LocalPath: localPath}
-		return theDFSInstance, connectToServer(serverAddr, myUser)
+		err = connectToServer(serverAddr, myUser, mo.heartbeat)
+		if err != nil {
+			return nil, err
+		}
+
+		if theDFSInstance == nil {
+			theDFSInstance = dfsObject{}
+		}
+		return theDFSInstance, nil
 	}
 	return nil, LocalPathError(localPath)
 }
@@ -129,179 +618,792 @@ func checkLocalPathOK(localPath string) bool {
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Binds the callback listener, or starts a multiplexed session in its place,
+          registers with the server, agreeing the heartbeat interval, and waits for
+          the server to call back. On failure everything done so far is undone, so
+          the caller may retry.
+ Params: sAddr - the server's ip:port; user - this client; heartbeat - the interval to ask for, or 0
  Returns
- Throws:
+ Throws: PortInUseError, any error dialing the server, UserRegistrationError, or
+         CallbackUnreachableError
 */
-func connectToServer(sAddr string, user UserInfo) error {
-	if connToServer == nil {
-		client, err := rpc.Dial("tcp", sAddr)
+func connectToServer(sAddr string, user UserInfo, heartbeat time.Duration) error {
+	if connToServer != nil {
+		return nil
+	}
+
+	var listener net.Listener
+	var client *rpc.Client
+	var err error
+	if multiplexed {
+		listener, client, err = dialMultiplexed(sAddr)
 		if err != nil {
 			return err
 		}
-
-		connToServer = client
-		reply := false
-		err = connToServer.Call("ServerRPC.Register", user, &reply)
-		if err != nil || reply == false {
+	} else {
+		listener, err = bindCallbacks(user.LocalIP)
+		if err != nil {
+			return err
+		}
+		client, err = dialServer(sAddr)
+		if err != nil {
+			listener.Close()
 			return err
 		}
-
-		go keepAlive(user)
-		establishReverseRPC(user)
 	}
 
+	mountLock.Lock()
+	connToServer = client
+	expiredSession = ""
+	callbacks = listener
+	callbackConns = make(map[net.Conn]bool, 0)
+	callbackServers.Add(1)
+	mountLock.Unlock()
+	go serveCallbacks(listener)
+
+	rv := RegisterValue{}
+	err = callServer("ServerRPC.Register", RegisterInfo{User: user, HeartbeatInterval: heartbeat}, &rv)
+	if err == nil {
+		hbInterval = rv.HeartbeatInterval
+		sessionID = rv.Session
+		stopHeartbeats = make(chan struct{})
+		heartbeatsDone = make(chan struct{})
+		go keepAlive(user, sessionID, stopHeartbeats, heartbeatsDone)
+
+		err = establishReverseRPC(user)
+	}
+	if err != nil {
+		disconnect(context.Background())
+		return serverError(err)
+	}
 	return nil
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Starts the metrics endpoint unless it is already running
+ Params: addr - the ip:port to serve /metrics on
  Returns
- Throws:
+ Throws: Any error binding addr
 */
-func keepAlive(user UserInfo) {
-	for connToServer != nil {
-		reply := false
-		err := connToServer.Call("ServerRPC.SendHeartbeat", user, &reply)
-		if err != nil || reply == false {
-			// TODO: failure detector is implemented here
-			errMsg := strings.TrimSuffix(err.Error(), "\n")
-			fmt.Printf("dfslib: Error sending heartbeat, [%s]\n", errMsg)
-			connToServer = nil
-		}
+func serveMetrics(addr string) error {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if metricsListener != nil {
+		return nil
+	}
 
-		time.Sleep(time.Millisecond * hbInterval / 2)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
+
+	metricsListener = l
+	go clientMetrics.Serve(l)
+	return nil
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Calls a ServerRPC method without a deadline
+ Params: method - e.g. "ServerRPC.ReadFile"; args, reply - as for rpc.Client.Call
  Returns
- Throws:
+ Throws: Any error from the call
 */
-func establishReverseRPC(user UserInfo) {
-	go listen(user.LocalIP)
+func callServer(method string, args interface{}, reply interface{}) error {
+	return callServerContext(context.Background(), method, args, reply)
+}
 
-	reply := false
-	err := connToServer.Call("ServerRPC.EstablishReverseRPC", user, &reply)
+/*
+ Purpose: Calls a ServerRPC method, recording its latency and outcome
+ Params: ctx - abandons the call when done; method - e.g. "ServerRPC.ReadFile"; args, reply - as for rpc.Client.Call
+ Returns
+ Throws: SessionExpiredError if the server ended the session, NotConnectedError if
+         unmounted or unmounting, ctx.Err() if ctx is done first, else any error from the call
+*/
+func callServerContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	mountLock.Lock()
+	client := connToServer
+	if client == nil && expiredSession != "" {
+		session := expiredSession
+		mountLock.Unlock()
+		return SessionExpiredError(session)
+	}
+	if unmounting || client == nil {
+		mountLock.Unlock()
+		return NotConnectedError(method)
+	}
+	serverCalls.Add(1)
+	mountLock.Unlock()
+	defer serverCalls.Done()
+
+	return observeServerCall(ctx, client, method, args, reply)
+}
+
+// observeServerCall makes a call to the server and records its latency and outcome
+func observeServerCall(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	start := time.Now()
+	err := callContext(ctx, client, method, args, reply)
+
+	outcome := "ok"
 	if err != nil {
-		fmt.Printf("dfslib: Unable to establish reverse RPC connection, err [%s]\n", err.Error())
-		os.Exit(0)
+		outcome = "error"
 	}
+	name := strings.TrimPrefix(method, "ServerRPC.")
+	latency := time.Since(start)
+	rpcRequests.Inc(name, outcome)
+	rpcDuration.Observe(latency.Seconds(), name)
+	logger.Log(logging.Debug, "Called server", logging.F(logging.KeyMethod, name), logging.F(logging.KeyLatency, latency),
+		logging.F(logging.KeyError, err))
+	return err
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Makes an RPC, abandoning it when ctx is done
+ Params: ctx - bounds the call; client - the connection; method, args, reply - as for rpc.Client.Call
  Returns
- Throws:
+ Throws: ctx.Err() if ctx is done first, else any error from the call
+ Note: The reply is decoded into a copy and only stored in reply on success, since
+       an abandoned call may still be answered after this returns
 */
-func listen(cAddr string) {
-	client := new(ClientRPC)
-	clientRPC := rpc.NewServer()
-	clientRPC.Register(client)
-
-	listener, err := net.Listen("tcp", cAddr)
+func callContext(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	err := ctx.Err()
 	if err != nil {
-		fmt.Printf("dfslib: Unable to bind to port [%s] to listen for incoming connection requests\n", cAddr)
-		os.Exit(0)
+		return err
 	}
 
-	for {
-		conn, _ := listener.Accept()
-		go clientRPC.ServeConn(conn)
+	result := reflect.New(reflect.TypeOf(reply).Elem())
+	call := client.Go(method, args, result.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+		reflect.ValueOf(reply).Elem().Set(result.Elem())
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-//================================
-// IMPLEMENTATION: DFS interface
-//================================
-
 /*
- Purpose:
- Params:
- Returns
- Throws:
+ Purpose: Dials the server, over mutual TLS if configured
+ Params: sAddr - the server address
+ Returns: An RPC client connected to the server
+ Throws: Any dial or handshake error
 */
-func (dfs dfsObject) LocalFileExists(fname string) (exists bool, err error) {
-	path := myUser.LocalPath + fname + ".dfs"
-	fmt.Printf("dfslib: checking path: [%s]\n", path)
-	exists = checkLocalPathOK(path)
-	return exists, nil
+func dialServer(sAddr string) (*rpc.Client, error) {
+	conn, err := dialServerConn(sAddr)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
 }
 
 /*
- Purpose:
- Params:
- Returns
- Throws:
+ Purpose: Dials the server and starts a multiplexed session over the connection,
+          so the server's calls to this client need no listening port
+ Params: sAddr - the server's ip:port
+ Returns: The session, which accepts the streams the server opens for its calls,
+          and a client for calls to the server over a stream of the session
+ Throws: Any error dialing or starting the session
 */
-func (dfs dfsObject) GlobalFileExists(fname string) (exists bool, err error) {
-	reply := false
-	err = connToServer.Call("ServerRPC.FileExists", fname, &reply)
-	return reply, err
+func dialMultiplexed(sAddr string) (*transport.Session, *rpc.Client, error) {
+	conn, err := dialServerConn(sAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := transport.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	stream, err := session.Open()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	return session, rpc.NewClient(stream), nil
 }
 
 /*
- Purpose:
- Params:
- Returns
- Throws:
+ Purpose: Dials the server, over TLS if mounted WithTLS
+ Params: sAddr - the server's ip:port
+ Returns: The connection
+ Throws: Any error dialing or in the TLS handshake
 */
-// TODO: if file exists, then need to retrieve from other active clients
-func (dfs dfsObject) Open(fname string, mode FileMode) (f DFSFile, err error) {
-	var file *os.File
-
-	if !validFileName(fname) {
-		return nil, BadFilenameError(fname)
+func dialServerConn(sAddr string) (net.Conn, error) {
+	conn, err := network.DialContext(context.Background(), sAddr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return conn, nil
 	}
 
-	err = registerFile(fname, mode)
+	config := tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(sAddr)
+	}
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.Handshake()
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	if mode == DREAD {
-		file, err = openExistingFile(fname)
+	serverCert = tlsConn.ConnectionState().PeerCertificates[0]
+	serverIdentity = serverCert.Subject.CommonName
+	return tlsConn, nil
+}
 
-		if err != nil {
-			return nil, err
+/*
+ Purpose: Heartbeats at the agreed interval until stop is closed, the connection to the
+          server is lost, or the server refuses a heartbeat because it ended the session
+ Params: user - this client; session - the session to keep alive; stop - closed by UMountDFS;
+         done - closed on return
+ Returns
+ Throws:
+ Note: A heartbeat that fails in transit is retried at the next interval. Once the
+       server ends the session, the connection is closed and later calls fail with
+       SessionExpiredError until the application unmounts and mounts again.
+*/
+func keepAlive(user UserInfo, session string, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		reply := false
+		err := callServer("ServerRPC.SendHeartbeat", HeartbeatInfo{User: user, Session: session}, &reply)
+		_, refused := err.(rpc.ServerError)
+		if err == nil && !reply {
+			refused = true
+		}
+
+		if refused {
+			logger.Log(logging.Error, "Server ended the session", logging.F(logging.KeyUser, user), logging.F("session", session),
+				logging.F(logging.KeyError, err))
+			endSession(session)
+			return
+		} else if err == rpc.ErrShutdown {
+			return
+		} else if err != nil {
+			logger.Log(logging.Warn, "Error sending heartbeat", logging.F(logging.KeyUser, user), logging.F(logging.KeyError, err))
+		}
+
+		select {
+		case <-clk.After(hbInterval):
+		case <-stop:
+			return
 		}
-	} else {
-		file, err = createFile(fname)
 	}
+}
 
-	// TODO: may need to export this
-	dfsFile := dfsFileObject{fd: file, fm: mode, name: fname}
+// endSession closes the connection to the server after it ended session, unless
+// UMountDFS is already tearing it down
+func endSession(session string) {
+	mountLock.Lock()
+	client := connToServer
+	if unmounting || client == nil {
+		mountLock.Unlock()
+		return
+	}
+	connToServer = nil
+	expiredSession = session
+	mountLock.Unlock()
 
-	return &dfsFile, err
+	client.Close()
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Has the server dial back to the callback listener, and waits for its ping
+ Params: user - this client
  Returns
- Throws:
+ Throws: CallbackUnreachableError if the server cannot dial back, or its ping
+         does not arrive within callbackTimeout
 */
-func (dfs dfsObject) UMountDFS() (err error) {
+func establishReverseRPC(user UserInfo) error {
+	pinged := make(chan struct{})
+	mountLock.Lock()
+	callbackPinged = pinged
+	mountLock.Unlock()
+
 	reply := false
-	err = connToServer.Call("ServerRPC.Unregister", myUser, &reply)
-	connToServer.Close()
-	theDFSInstance = nil
-	return err
-}
+	err := callServer("ServerRPC.EstablishReverseRPC", user, &reply)
+	if err != nil {
+		logger.Log(logging.Error, "Unable to establish reverse RPC connection", logging.F(logging.KeyUser, user), logging.F(logging.KeyError, err))
+		return CallbackUnreachableError(user.LocalIP)
+	}
 
-//======================================
-// IMPLEMENTATION: DFS helper functions
-//======================================
+	select {
+	case <-pinged:
+		return nil
+	case <-time.After(callbackTimeout * time.Millisecond):
+		logger.Log(logging.Error, "Server did not call back", logging.F(logging.KeyUser, user))
+		return CallbackUnreachableError(user.LocalIP)
+	}
+}
 
 /*
- Purpose:
- Params:
- Returns
+ Purpose: Binds the address the server and peers call back on
+ Params: cAddr - this client's ip:port
+ Returns: The listener, over TLS if mounted WithTLS
+ Throws: PortInUseError if cAddr cannot be bound
+*/
+func bindCallbacks(cAddr string) (net.Listener, error) {
+	listener, err := network.Listen(cAddr)
+	if err != nil {
+		logger.Log(logging.Error, "Unable to bind to port to listen for incoming connection requests", logging.F("addr", cAddr), logging.F(logging.KeyError, err))
+		return nil, PortInUseError(cAddr)
+	}
+
+	if tlsConfig != nil {
+		listenerConfig := tlsConfig.Clone()
+		listenerConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		listenerConfig.ClientCAs = tlsConfig.RootCAs
+		listener = tls.NewListener(listener, listenerConfig)
+	}
+	return listener, nil
+}
+
+/*
+ Purpose: Serves each connection the callback listener accepts, until it is closed
+ Params: listener - from bindCallbacks
+ Returns
+ Throws:
+*/
+func serveCallbacks(listener net.Listener) {
+	defer callbackServers.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// disconnect closed the listener
+			return
+		}
+
+		mountLock.Lock()
+		callbackConns[conn] = true
+		callbackServers.Add(1)
+		mountLock.Unlock()
+		go func() {
+			defer callbackServers.Done()
+			serveConn(conn)
+
+			mountLock.Lock()
+			delete(callbackConns, conn)
+			mountLock.Unlock()
+		}()
+	}
+}
+
+/*
+ Purpose: Serves RPCs on an incoming connection. Over TLS only the server
+          we dialed may call ClientRPC, and other clients only PeerRPC. Without
+          TLS, ClientRPC serves only a caller that pinged with this client's
+          session ID. Streams of a multiplexed session can only be opened by the server.
+ Params: conn - the accepted connection
+ Returns
+ Throws:
+*/
+func serveConn(conn net.Conn) {
+	server := rpc.NewServer()
+	peer := new(PeerRPC)
+	callee := &ClientRPC{peer: conn.RemoteAddr().String()}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		peer.principal = tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		if peer.principal == serverIdentity {
+			callee.peer = peer.principal
+			callee.server = true
+			server.Register(callee)
+		}
+	} else {
+		server.Register(callee)
+	}
+
+	server.Register(peer)
+	server.ServeConn(conn)
+}
+
+//================================
+// IMPLEMENTATION: DFS interface
+//================================
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (dfs dfsObject) LocalFileExists(fname string) (exists bool, err error) {
+	path := myUser.LocalPath + fname + ".dfs"
+	logger.Log(logging.Debug, "Checking path", logging.F("path", path))
+	exists = checkLocalPathOK(path)
+	return exists, nil
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (dfs dfsObject) GlobalFileExistsContext(ctx context.Context, fname string) (exists bool, err error) {
+	reply := false
+	err = callServerContext(ctx, "ServerRPC.FileExists", fname, &reply)
+	return reply, err
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+// TODO: if file exists, then need to retrieve from other active clients
+func (dfs dfsObject) OpenContext(ctx context.Context, fname string, mode FileMode, opts ...OpenOption) (f DFSFile, err error) {
+	var file *os.File
+
+	if !validFileName(fname) {
+		return nil, BadFilenameError(fname)
+	}
+
+	oo := openOptions{}
+	for _, opt := range opts {
+		err = opt(&oo)
+		if err != nil {
+			return nil, EncryptionError(fname)
+		}
+	}
+	sealed := oo.aead != nil
+
+	span := tracer.Start("dfslib.Open", tracing.KindClient, tracing.SpanContext{},
+		tracing.A(logging.KeyFile, fname), tracing.A("mode", int(mode)), tracing.A("sealed", sealed))
+	defer span.Finish(&err)
+
+	generation, err := registerFile(ctx, fname, mode, sealed, span.Context())
+	if err != nil {
+		return nil, err
+	}
+	// The chunks cached of a file since removed are not this file's
+	if _, recreated := adoptGeneration(fname, generation); recreated {
+		os.Remove(myUser.LocalPath + fname + ".dfs")
+	}
+
+	if mode == DREAD {
+		file, err = openExistingFile(fname)
+
+		if err != nil {
+			return nil, err
+		}
+	} else if cachesChunks(fname) {
+		// The server still counts this client as an owner of the chunks it
+		// cached, and it may hold the only copies, so they are kept
+		file, err = reopenFile(fname, slotSize(sealed))
+	} else {
+		file, err = createFile(fname, slotSize(sealed))
+		resetChunkVersions(fname)
+	}
+
+	// TODO: may need to export this
+	dfsFile := dfsFileObject{fd: file, fm: mode, name: fname, aead: oo.aead, readahead: oo.readahead}
+	if err == nil {
+		openLock.Lock()
+		if openFiles == nil {
+			openFiles = make(map[*dfsFileObject]bool, 0)
+		}
+		openFiles[&dfsFile] = true
+		openLock.Unlock()
+	}
+
+	return &dfsFile, err
+}
+
+/*
+ Purpose: Replaces the ACL entries of a file; the owner cannot be changed
+ Params: fname - the file; acl - the new entries
+ Returns
+ Throws: FileUnavailableError, PermissionDeniedError unless the caller owns
+         the file or holds PermAdmin
+*/
+func (dfs dfsObject) SetACLContext(ctx context.Context, fname string, acl ACL) (err error) {
+	ai := ACLInfo{User: myUser, Fname: fname, ACL: acl}
+	reply := false
+	err = callServerContext(ctx, "ServerRPC.SetACL", ai, &reply)
+	return serverError(err)
+}
+
+/*
+ Purpose: Looks up the owner and ACL entries of a file
+ Params: fname - the file
+ Returns: The file's ACL
+ Throws: FileUnavailableError, PermissionDeniedError unless the caller may read the file
+*/
+func (dfs dfsObject) GetACLContext(ctx context.Context, fname string) (acl ACL, err error) {
+	ai := ACLInfo{User: myUser, Fname: fname}
+	err = callServerContext(ctx, "ServerRPC.GetACL", ai, &acl)
+	return acl, serverError(err)
+}
+
+/*
+ Purpose: Lists the files this client may read
+ Params:
+ Returns: The file names
+ Throws:
+*/
+func (dfs dfsObject) ListFilesContext(ctx context.Context) (fnames []string, err error) {
+	err = callServerContext(ctx, "ServerRPC.ListFiles", myUser, &fnames)
+	return fnames, serverError(err)
+}
+
+/*
+ Purpose: Describes a file's owner, encryption, write lock and chunk versions
+ Params: fname - the file
+ Returns: The file's metadata
+ Throws: FileUnavailableError, PermissionDeniedError
+*/
+func (dfs dfsObject) StatContext(ctx context.Context, fname string) (stat FileStat, err error) {
+	fi := FileInfo{User: myUser, Name: fname}
+	err = callServerContext(ctx, "ServerRPC.StatFile", fi, &stat)
+	return stat, serverError(err)
+}
+
+/*
+ Purpose: Deletes a file from the dfs and from the local cache
+ Params: fname - the file; no client may have it open
+ Returns
+ Throws: FileUnavailableError, PermissionDeniedError, FileInUseError
+*/
+func (dfs dfsObject) RemoveContext(ctx context.Context, fname string) (err error) {
+	fi := FileInfo{User: myUser, Name: fname}
+	reply := false
+	err = callServerContext(ctx, "ServerRPC.RemoveFile", fi, &reply)
+	if err != nil {
+		return serverError(err)
+	}
+
+	forgetFile(fname)
+	return nil
+}
+
+/*
+ Purpose: Subscribes to writes and removal of a file
+ Params: fname - the file
+ Returns: A channel of events, closed once the file is removed. Events are
+          dropped if the channel's buffer is full.
+ Throws: FileUnavailableError, PermissionDeniedError
+*/
+func (dfs dfsObject) WatchContext(ctx context.Context, fname string) (events <-chan FileEvent, err error) {
+	fi := FileInfo{User: myUser, Name: fname}
+	reply := false
+	err = callServerContext(ctx, "ServerRPC.WatchFile", fi, &reply)
+	if err != nil {
+		return nil, serverError(err)
+	}
+
+	ch := make(chan FileEvent, watchBuffer)
+	watchLock.Lock()
+	if watchChans == nil {
+		watchChans = make(map[string][]chan FileEvent, 0)
+	}
+	watchChans[fname] = append(watchChans[fname], ch)
+	watchLock.Unlock()
+
+	return ch, nil
+}
+
+/*
+ Purpose: Reports the bytes stored in files owned by this client's principal
+ Params:
+ Returns: The principal's usage and quota
+ Throws:
+*/
+func (dfs dfsObject) UsageContext(ctx context.Context) (usage Usage, err error) {
+	err = callServerContext(ctx, "ServerRPC.Usage", myUser, &usage)
+	return usage, serverError(err)
+}
+
+/*
+ Purpose: Unmounts gracefully. Closes every open file, releasing its write lock,
+          stops the heartbeats, waits for calls to the server in flight,
+          unregisters, and shuts down the listener the server and peers call
+          back on, so the process may mount again on the same address. Channels
+          returned by Watch are closed. Teardown continues if ctx ends first,
+          abandoning the calls still in flight.
+ Params: ctx - bounds closing the files, draining the calls and unregistering
+ Returns
+ Throws: The first error closing a file, draining or unregistering
+*/
+func (dfs dfsObject) UMountDFSContext(ctx context.Context) (err error) {
+	openLock.Lock()
+	open := make([]*dfsFileObject, 0, len(openFiles))
+	for f := range openFiles {
+		open = append(open, f)
+	}
+	openLock.Unlock()
+	for _, f := range open {
+		closeErr := f.CloseContext(ctx)
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	disconnectErr := disconnect(ctx)
+	if err == nil {
+		err = disconnectErr
+	}
+	theDFSInstance = nil
+	return err
+}
+
+/*
+ Purpose: Stops the heartbeats, waits for calls to the server in flight, unregisters
+          if registered, closes the connection to the server, and shuts down the
+          callback listener and the connections it accepted
+ Params: ctx - bounds draining the calls and unregistering
+ Returns
+ Throws: Any error draining or unregistering
+*/
+func disconnect(ctx context.Context) (err error) {
+	if stopHeartbeats != nil {
+		close(stopHeartbeats)
+		select {
+		case <-heartbeatsDone:
+		case <-ctx.Done():
+		}
+		stopHeartbeats = nil
+	}
+
+	mountLock.Lock()
+	unmounting = true
+	client := connToServer
+	mountLock.Unlock()
+
+	err = waitContext(ctx, &serverCalls)
+	if client != nil && sessionID != "" {
+		reply := false
+		unregisterErr := observeServerCall(ctx, client, "ServerRPC.Unregister", myUser, &reply)
+		if err == nil {
+			err = unregisterErr
+		}
+	}
+	if client != nil {
+		client.Close()
+	}
+	sessionID = ""
+
+	mountLock.Lock()
+	connToServer = nil
+	if callbacks != nil {
+		callbacks.Close()
+		callbacks = nil
+	}
+	for conn := range callbackConns {
+		conn.Close()
+	}
+	mountLock.Unlock()
+
+	// Closing the connections ends whatever was left running promptly
+	serverCalls.Wait()
+	callbackServers.Wait()
+	closeWatches()
+
+	mountLock.Lock()
+	unmounting = false
+	mountLock.Unlock()
+	return err
+}
+
+// The variants without a context neither time out nor can be cancelled
+
+func (dfs dfsObject) GlobalFileExists(fname string) (exists bool, err error) {
+	return dfs.GlobalFileExistsContext(context.Background(), fname)
+}
+
+func (dfs dfsObject) Open(fname string, mode FileMode, opts ...OpenOption) (f DFSFile, err error) {
+	return dfs.OpenContext(context.Background(), fname, mode, opts...)
+}
+
+func (dfs dfsObject) SetACL(fname string, acl ACL) (err error) {
+	return dfs.SetACLContext(context.Background(), fname, acl)
+}
+
+func (dfs dfsObject) GetACL(fname string) (acl ACL, err error) {
+	return dfs.GetACLContext(context.Background(), fname)
+}
+
+func (dfs dfsObject) ListFiles() (fnames []string, err error) {
+	return dfs.ListFilesContext(context.Background())
+}
+
+func (dfs dfsObject) Stat(fname string) (stat FileStat, err error) {
+	return dfs.StatContext(context.Background(), fname)
+}
+
+func (dfs dfsObject) Remove(fname string) (err error) {
+	return dfs.RemoveContext(context.Background(), fname)
+}
+
+func (dfs dfsObject) Watch(fname string) (events <-chan FileEvent, err error) {
+	return dfs.WatchContext(context.Background(), fname)
+}
+
+func (dfs dfsObject) Usage() (usage Usage, err error) {
+	return dfs.UsageContext(context.Background())
+}
+
+func (dfs dfsObject) UMountDFS() (err error) {
+	return dfs.UMountDFSContext(context.Background())
+}
+
+//======================================
+// IMPLEMENTATION: DFS helper functions
+//======================================
+
+/*
+ Purpose: Waits for a WaitGroup, giving up when ctx is done
+ Params: ctx - bounds the wait; wg - the group
+ Returns
+ Throws: ctx.Err() if ctx is done first
+*/
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeWatches closes and forgets every channel returned by Watch
+func closeWatches() {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+
+	for _, chans := range watchChans {
+		for _, ch := range chans {
+			close(ch)
+		}
+	}
+	watchChans = nil
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
  Throws:
 */
 func validFileName(str string) bool {
@@ -333,16 +1435,16 @@ func isAlphaNumeric(str string) bool {
  Returns
  Throws:
 */
-func registerFile(name string, mode FileMode) error {
-	fi := FileInfo{User: myUser, Name: name, Fmode: mode}
-	reply := false
+func registerFile(ctx context.Context, name string, mode FileMode, sealed bool, trace tracing.SpanContext) (uint64, error) {
+	fi := FileInfo{User: myUser, Name: name, Fmode: mode, Sealed: sealed, Trace: trace}
+	rv := RegisterFileValue{}
 	// TODO: need to watch cases where server is down when calling connToServer
-	err := connToServer.Call("ServerRPC.RegisterFile", fi, &reply)
+	err := callServerContext(ctx, "ServerRPC.RegisterFile", fi, &rv)
 	if err != nil {
-		return err
+		return 0, serverError(err)
 	}
 
-	return nil
+	return rv.Generation, nil
 }
 
 /*
@@ -351,160 +1453,1014 @@ func registerFile(name string, mode FileMode) error {
  Returns
  Throws:
 */
-func createFile(name string) (f *os.File, err error) {
+func createFile(name string, chunkSize int) (f *os.File, err error) {
 	path := myUser.LocalPath + name + ".dfs"
-	fmt.Printf("dfslib: Creating file at path [%s]\n", path)
+	logger.Log(logging.Debug, "Creating file", logging.F(logging.KeyFile, name), logging.F("path", path))
 	f, err = os.Create(path)
-	var c Chunk
-	f.Truncate(int64(len(c) * 256))
 	if err != nil {
 		return nil, err
 	}
-
-	return f, nil
+	f.Truncate(int64(chunkSize * 256))
+
+	return f, nil
+}
+
+/*
+ Purpose: Opens a file this client already caches chunks of for reading and writing,
+          creating it again if it was removed from the local path
+ Params: name - the file name; chunkSize - the stored size of each chunk
+ Returns: The open file
+ Throws: Any error opening or creating it
+*/
+func reopenFile(name string, chunkSize int) (f *os.File, err error) {
+	path := myUser.LocalPath + name + ".dfs"
+	f, err = os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		resetChunkVersions(name)
+		return createFile(name, chunkSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Log(logging.Debug, "Reopening file", logging.F(logging.KeyFile, name), logging.F("path", path))
+	return f, nil
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func openExistingFile(name string) (f *os.File, err error) {
+	path := myUser.LocalPath + name + ".dfs"
+	logger.Log(logging.Debug, "Opening file", logging.F(logging.KeyFile, name), logging.F("path", path))
+
+	if !checkLocalPathOK(path) {
+		return nil, FileUnavailableError(name)
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return nil, FileUnavailableError(name)
+	}
+
+	return f, nil
+}
+
+//===================================
+// IMPLEMENTATION: DFSFile Interface
+//===================================
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (f *dfsFileObject) ReadContext(ctx context.Context, chunkNum uint8, chunk *Chunk) (err error) {
+	span := tracer.Start("dfslib.Read", tracing.KindClient, tracing.SpanContext{},
+		tracing.A(logging.KeyFile, f.name), tracing.A(logging.KeyChunk, chunkNum))
+	defer span.Finish(&err)
+
+	// Once reads turn sequential, fetch this chunk and the next few in one call
+	window := f.noteRead(chunkNum)
+	if window > 1 && !f.isPrefetched(chunkNum) {
+		err = f.prefetch(ctx, chunkNum, uint8(int(chunkNum)+window-1), span.Context())
+		if err != nil {
+			return err
+		}
+	}
+	if f.takePrefetched(chunkNum) {
+		chunkReads.Inc("readahead")
+		span.SetAttribute("readahead", true)
+		return f.readCached(chunkNum, chunk)
+	}
+
+	ri := ReadInfo{User: myUser, Fname: f.name, ChunkNum: chunkNum, LocalChunkVer: localChunkVersion(f.name, chunkNum), Sealed: f.aead != nil,
+		Trace: span.Context()}
+	ri.Deadline, _ = ctx.Deadline()
+	ri.Direct = directTransfer
+
+	// TODO: check connToServer is not nil
+	call := &chunkCall{chunkNum: chunkNum, localVer: ri.LocalChunkVer, trace: ri.Trace, deadline: ri.Deadline}
+	err = f.reads.call(ctx, call, f.sendReads)
+	if err != nil {
+		return serverError(err)
+	}
+
+	rv := call.rv
+	var receipt *ChunkReceipt
+	if len(rv.Peers) > 0 {
+		receipt, err = fetchDirect(ctx, ri, &rv)
+		if err != nil {
+			return serverError(err)
+		}
+	}
+
+	logger.Log(logging.Debug, "Read chunk", logging.F(logging.KeyFile, f.name), logging.F(logging.KeyChunk, chunkNum),
+		logging.F(logging.KeyVersion, rv.GlobalChunkVer), logging.F("cached", !rv.IsNew))
+	span.SetAttribute("cached", !rv.IsNew)
+	if rv.IsNew {
+		if receipt != nil {
+			chunkReads.Inc("peer")
+		} else {
+			chunkReads.Inc("miss")
+		}
+		return f.cacheChunk(ctx, chunkNum, rv, receipt, chunk)
+	}
+
+	chunkReads.Inc("hit")
+	return f.readCached(chunkNum, chunk)
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (f *dfsFileObject) WriteContext(ctx context.Context, chunkNum uint8, chunk *Chunk) (err error) {
+	if f.fm == READ {
+		return BadFileModeError("READ")
+	} else if f.fm == DREAD {
+		return BadFileModeError("DREAD")
+	} else if connToServer == nil {
+		return WriteModeTimeoutError(f.name)
+	}
+
+	span := tracer.Start("dfslib.Write", tracing.KindClient, tracing.SpanContext{},
+		tracing.A(logging.KeyFile, f.name), tracing.A(logging.KeyChunk, chunkNum))
+	defer span.Finish(&err)
+
+	// TODO: check connToServer not nil
+	call := &chunkCall{chunkNum: chunkNum, chunk: *chunk, trace: span.Context()}
+	call.deadline, _ = ctx.Deadline()
+	err = f.writes.call(ctx, call, f.sendWrites)
+	if err != nil {
+		logger.Log(logging.Debug, "Unable to write chunk", logging.F(logging.KeyFile, f.name), logging.F(logging.KeyChunk, chunkNum),
+			logging.F(logging.KeyError, err))
+		return err
+	}
+
+	logger.Log(logging.Debug, "Wrote chunk", logging.F(logging.KeyFile, f.name), logging.F(logging.KeyChunk, chunkNum),
+		logging.F(logging.KeyVersion, call.version))
+	return nil
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (f *dfsFileObject) Dread(chunkNum uint8, chunk *Chunk) (err error) {
+	if f.fm == READ {
+		return BadFileModeError("READ")
+	} else if f.fm == WRITE {
+		return BadFileModeError("WRITE")
+	}
+
+	return f.readCached(chunkNum, chunk)
+}
+
+/*
+ Purpose: Fetches chunks from..to inclusive in one call to the server, so that
+          the next Read of each is served locally
+ Params: from, to - the chunks the application is about to read
+ Returns
+ Throws: BadFileModeError in DREAD mode, or any error from the server
+ Note: As with readahead, that Read returns the version that was latest when
+       the chunk was prefetched, up to 5 seconds earlier
+*/
+func (f *dfsFileObject) PrefetchContext(ctx context.Context, from, to uint8) (err error) {
+	if f.fm == DREAD {
+		return BadFileModeError("DREAD")
+	}
+
+	span := tracer.Start("dfslib.Prefetch", tracing.KindClient, tracing.SpanContext{},
+		tracing.A(logging.KeyFile, f.name), tracing.A("from", from), tracing.A("to", to))
+	defer span.Finish(&err)
+
+	return f.prefetch(ctx, from, to, span.Context())
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (f *dfsFileObject) CloseContext(ctx context.Context) (err error) {
+	span := tracer.Start("dfslib.Close", tracing.KindClient, tracing.SpanContext{}, tracing.A(logging.KeyFile, f.name))
+	defer span.Finish(&err)
+
+	reply := false
+	fi := FileInfo{User: myUser, Name: f.name, Fmode: f.fm, Trace: span.Context()}
+
+	err = callServerContext(ctx, "ServerRPC.CloseFile", fi, &reply)
+
+	openLock.Lock()
+	delete(openFiles, f)
+	openLock.Unlock()
+	f.fd.Close()
+	return err
+}
+
+// The variants without a context neither time out nor can be cancelled
+
+func (f *dfsFileObject) Read(chunkNum uint8, chunk *Chunk) (err error) {
+	return f.ReadContext(context.Background(), chunkNum, chunk)
+}
+
+func (f *dfsFileObject) Write(chunkNum uint8, chunk *Chunk) (err error) {
+	return f.WriteContext(context.Background(), chunkNum, chunk)
+}
+
+func (f *dfsFileObject) Prefetch(from, to uint8) (err error) {
+	return f.PrefetchContext(context.Background(), from, to)
+}
+
+func (f *dfsFileObject) Close() (err error) {
+	return f.CloseContext(context.Background())
+}
+
+//==========================================
+// IMPLEMENTATION: DFSFile helper functions
+//==========================================
+
+// A chunkCall is a Read or Write of one chunk waiting to be sent to the server
+type chunkCall struct {
+	chunkNum uint8
+	localVer int    // for reads, the version cached locally
+	chunk    Chunk  // for writes, the plaintext
+	slot     []byte // for writes, the bytes to store, sealed when sent
+	trace    tracing.SpanContext
+	deadline time.Time // zero unless the caller's context has a deadline
+
+	rv      ReadValue // for reads, the server's reply
+	version int       // for writes, the chunk's new version
+	err     error
+	done    chan struct{}
+}
+
+// A batcher coalesces concurrent calls on a file. A call made while none
+// is in flight is sent at once; calls made meanwhile are sent together
+// as soon as it returns.
+type batcher struct {
+	lock    sync.Mutex
+	pending []*chunkCall
+	busy    bool
+}
+
+/*
+ Purpose: Queues a call and waits for the batch it is sent in
+ Params: ctx - the caller's context; c - the call; send - sends a batch, setting each call's reply and err
+ Returns
+ Throws: c.err, or ctx.Err() if ctx is done first; the batch may still be sent
+*/
+func (b *batcher) call(ctx context.Context, c *chunkCall, send func(batch []*chunkCall)) error {
+	c.done = make(chan struct{})
+
+	b.lock.Lock()
+	b.pending = append(b.pending, c)
+	if !b.busy {
+		b.busy = true
+		go b.flush(send)
+	}
+	b.lock.Unlock()
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batcher) flush(send func(batch []*chunkCall)) {
+	for {
+		b.lock.Lock()
+		batch := b.pending
+		b.pending = nil
+		if len(batch) == 0 {
+			b.busy = false
+			b.lock.Unlock()
+			return
+		}
+		b.lock.Unlock()
+
+		send(batch)
+		for _, c := range batch {
+			close(c.done)
+		}
+	}
+}
+
+// batchContext bounds a batch by the latest of its callers' deadlines,
+// or not at all if any caller has none
+func batchContext(batch []*chunkCall) (context.Context, context.CancelFunc) {
+	var deadline time.Time
+	for _, c := range batch {
+		if c.deadline.IsZero() {
+			return context.WithCancel(context.Background())
+		}
+		if c.deadline.After(deadline) {
+			deadline = c.deadline
+		}
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+/*
+ Purpose: Sends a batch of reads, as ReadFile for one chunk or ReadChunks for several
+ Params: batch - the reads
+ Returns
+ Throws:
+*/
+func (f *dfsFileObject) sendReads(batch []*chunkCall) {
+	ctx, cancel := batchContext(batch)
+	defer cancel()
+
+	if len(batch) == 1 {
+		c := batch[0]
+		ri := ReadInfo{User: myUser, Fname: f.name, ChunkNum: c.chunkNum, LocalChunkVer: c.localVer, Sealed: f.aead != nil,
+			Trace: c.trace, Deadline: c.deadline, Direct: directTransfer}
+		c.err = callServerContext(ctx, "ServerRPC.ReadFile", ri, &c.rv)
+		return
+	}
+
+	rci := ReadChunksInfo{User: myUser, Fname: f.name, Sealed: f.aead != nil, Trace: batch[0].trace, Direct: directTransfer}
+	rci.Deadline, _ = ctx.Deadline()
+	for _, c := range batch {
+		rci.ChunkNums = append(rci.ChunkNums, c.chunkNum)
+		rci.LocalChunkVers = append(rci.LocalChunkVers, c.localVer)
+	}
+
+	rcv := ReadChunksValue{}
+	err := callServerContext(ctx, "ServerRPC.ReadChunks", rci, &rcv)
+	for i, c := range batch {
+		c.err = err
+		if err == nil && i < len(rcv.Chunks) {
+			c.rv = rcv.Chunks[i]
+			if c.rv.Unavailable {
+				c.err = ChunkUnavailableError(c.chunkNum)
+			}
+		}
+	}
+}
+
+/*
+ Purpose: Sends a batch of writes, as WriteFile for one chunk or WriteChunks for several,
+          and caches the written chunks in order
+ Params: batch - the writes
+ Note: The write itself is not bounded by the callers' deadlines. A write abandoned
+       after the server applied it would leave this client listed as the owner of
+       a version it never cached, so callers that give up get ctx.Err() while the
+       batch still finishes and caches what the server applied.
+ Returns
+ Throws:
+*/
+func (f *dfsFileObject) sendWrites(batch []*chunkCall) {
+	ctx, cancel := batchContext(batch)
+	defer cancel()
+
+	err := f.sealWrites(ctx, batch)
+	if err != nil {
+		for _, c := range batch {
+			c.err = err
+		}
+		return
+	}
+
+	if len(batch) == 1 {
+		c := batch[0]
+		wi := WriteInfo{User: myUser, Fname: f.name, ChunkNum: c.chunkNum, Checksum: sha256.Sum256(c.slot), Trace: c.trace}
+		if f.aead != nil {
+			wi.Version = c.version
+		}
+		wv := WriteValue{}
+		c.err = serverError(callServer("ServerRPC.WriteFile", wi, &wv))
+		c.version = wv.GlobalChunkVer
+	} else {
+		wci := WriteChunksInfo{User: myUser, Fname: f.name, Trace: batch[0].trace}
+		for _, c := range batch {
+			wci.ChunkNums = append(wci.ChunkNums, c.chunkNum)
+			wci.Checksums = append(wci.Checksums, sha256.Sum256(c.slot))
+			if f.aead != nil {
+				wci.Versions = append(wci.Versions, c.version)
+			}
+		}
+
+		wcv := WriteChunksValue{}
+		err := serverError(callServer("ServerRPC.WriteChunks", wci, &wcv))
+		for i, c := range batch {
+			c.err = err
+			if err == nil && i < len(wcv.GlobalChunkVers) {
+				c.version = wcv.GlobalChunkVers[i]
+			}
+		}
+	}
+
+	// Writes to the same chunk are cached in the order the server applied them
+	for _, c := range batch {
+		if c.err != nil {
+			f.versionsKnown = false
+			continue
+		}
+		f.versions[c.chunkNum] = c.version
+		f.takePrefetched(c.chunkNum)
+		_, c.err = cacheSlot(f.fd, f.name, c.chunkNum, c.version, c.slot)
+	}
+}
+
+/*
+ Purpose: Converts the chunks of a batch of writes into the bytes to store, sealing
+          each chunk of an encrypted file for the version its write will create
+ Params: ctx - bounds looking up the file's versions; batch - the writes
+ Returns
+ Throws: Any error from the server, or EncryptionError if no nonce could be generated
+*/
+func (f *dfsFileObject) sealWrites(ctx context.Context, batch []*chunkCall) error {
+	if f.aead != nil && !f.versionsKnown {
+		stat := FileStat{}
+		err := callServerContext(ctx, "ServerRPC.StatFile", FileInfo{User: myUser, Name: f.name}, &stat)
+		if err != nil {
+			return serverError(err)
+		}
+		f.versions = stat.Versions
+		f.versionsKnown = true
+	}
+
+	next := f.versions
+	for _, c := range batch {
+		next[c.chunkNum]++
+		c.version = next[c.chunkNum]
+
+		var err error
+		c.slot, err = f.seal(c.chunkNum, c.version, &c.chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ Purpose: Fetches the stale chunks among from..to in one ReadChunks call and caches them,
+          marking each chunk now cached at its latest version as prefetched
+ Params: ctx - bounds the fetch; from, to - the chunks, inclusive; trace - the caller's span
+ Returns
+ Throws: Any error from the server
+*/
+func (f *dfsFileObject) prefetch(ctx context.Context, from, to uint8, trace tracing.SpanContext) error {
+	rci := ReadChunksInfo{User: myUser, Fname: f.name, Sealed: f.aead != nil, Trace: trace, Direct: directTransfer}
+	rci.Deadline, _ = ctx.Deadline()
+	for c := int(from); c <= int(to); c++ {
+		if !f.isPrefetched(uint8(c)) {
+			rci.ChunkNums = append(rci.ChunkNums, uint8(c))
+			rci.LocalChunkVers = append(rci.LocalChunkVers, localChunkVersion(f.name, uint8(c)))
+		}
+	}
+	if len(rci.ChunkNums) == 0 {
+		return nil
+	}
+
+	rcv := ReadChunksValue{}
+	err := callServerContext(ctx, "ServerRPC.ReadChunks", rci, &rcv)
+	if err != nil {
+		return serverError(err)
+	}
+
+	var chunk Chunk
+	for i, rv := range rcv.Chunks {
+		// A chunk no owner could serve is left for Read to report
+		if rv.Unavailable {
+			continue
+		}
+
+		ri := ReadInfo{User: myUser, Fname: f.name, ChunkNum: rci.ChunkNums[i], LocalChunkVer: rci.LocalChunkVers[i],
+			Sealed: rci.Sealed, Trace: trace, Deadline: rci.Deadline, Direct: rci.Direct}
+		var receipt *ChunkReceipt
+		if len(rv.Peers) > 0 {
+			receipt, err = fetchDirect(ctx, ri, &rv)
+			if err != nil {
+				return serverError(err)
+			}
+		}
+
+		// A chunk that fails to unseal is left for Read to report
+		if rv.IsNew && f.cacheChunk(ctx, ri.ChunkNum, rv, receipt, &chunk) != nil {
+			continue
+		}
+		f.markPrefetched(ri.ChunkNum)
+	}
+
+	logger.Log(logging.Debug, "Prefetched chunks", logging.F(logging.KeyFile, f.name), logging.F("from", from), logging.F("to", to),
+		logging.F("fetched", len(rci.ChunkNums)))
+	return nil
+}
+
+/*
+ Purpose: Records a read for sequential access detection
+ Params: chunkNum - the chunk being read
+ Returns: How many chunks, starting at chunkNum, the read should fetch at once
+ Throws:
+*/
+func (f *dfsFileObject) noteRead(chunkNum uint8) int {
+	f.raLock.Lock()
+	defer f.raLock.Unlock()
+
+	if int(chunkNum) == f.nextChunk {
+		f.sequential++
+	} else {
+		f.sequential = 1
+	}
+	f.nextChunk = int(chunkNum) + 1
+
+	if f.readahead < 2 || f.sequential < sequentialReads {
+		return 1
+	}
+	if int(chunkNum)+f.readahead > 256 {
+		return 256 - int(chunkNum)
+	}
+	return f.readahead
+}
+
+func (f *dfsFileObject) markPrefetched(chunkNum uint8) {
+	f.raLock.Lock()
+	defer f.raLock.Unlock()
+
+	if f.prefetched == nil {
+		f.prefetched = make(map[uint8]time.Time)
+	}
+	f.prefetched[chunkNum] = time.Now()
+}
+
+func (f *dfsFileObject) isPrefetched(chunkNum uint8) bool {
+	f.raLock.Lock()
+	defer f.raLock.Unlock()
+
+	at, ok := f.prefetched[chunkNum]
+	return ok && time.Since(at) < prefetchExpiry*time.Millisecond
+}
+
+// takePrefetched reports whether a read of chunkNum may be served from the
+// local cache without asking the server. Each prefetch serves one read.
+func (f *dfsFileObject) takePrefetched(chunkNum uint8) bool {
+	f.raLock.Lock()
+	defer f.raLock.Unlock()
+
+	at, ok := f.prefetched[chunkNum]
+	delete(f.prefetched, chunkNum)
+	return ok && time.Since(at) < prefetchExpiry*time.Millisecond
+}
+
+/*
+ Purpose: Caches a chunk the server or a peer returned and, if fetched from a peer,
+          confirms it so the server records this client as an owner
+ Params: ctx - bounds the confirmation; chunkNum - the chunk; rv - the reply holding its stored bytes;
+         receipt - nil unless fetched from a peer; chunk - receives the plaintext
+ Returns
+ Throws: EncryptionError if the chunk fails to unseal, or any error writing the cache
+*/
+func (f *dfsFileObject) cacheChunk(ctx context.Context, chunkNum uint8, rv ReadValue, receipt *ChunkReceipt, chunk *Chunk) error {
+	err := f.unseal(chunkNum, rv.GlobalChunkVer, rv.Data, chunk)
+	if err != nil {
+		return err
+	}
+
+	_, err = cacheSlot(f.fd, f.name, chunkNum, rv.GlobalChunkVer, rv.Data)
+	if err != nil {
+		return err
+	}
+
+	if receipt != nil {
+		// Having cached the chunk, this client may now serve it to others
+		reply := false
+		callServerContext(ctx, "ServerRPC.ConfirmChunk", *receipt, &reply)
+	}
+	return nil
+}
+
+/*
+ Purpose: Fetches a chunk from the owners named in a Direct read's reply, falling back
+          to having the server relay it if none can serve it
+ Params: ctx - bounds the fetch; ri - the read; rv - the server's reply, replaced by the relayed reply on fallback
+ Returns: A receipt for ServerRPC.ConfirmChunk, or nil if the server relayed the chunk
+ Throws: Any error from the server, or ctx.Err()
+*/
+func fetchDirect(ctx context.Context, ri ReadInfo, rv *ReadValue) (*ChunkReceipt, error) {
+	receipt, err := fetchFromPeers(ctx, ri, rv)
+	if err == nil || ctx.Err() != nil {
+		return receipt, err
+	}
+
+	// No owner could serve the chunk directly, so the server relays it
+	ri.Direct = false
+	*rv = ReadValue{IsNew: false}
+	return nil, callServerContext(ctx, "ServerRPC.ReadFile", ri, rv)
+}
+
+/*
+ Purpose: Fetches a chunk directly from the owners the server listed, in order
+ Params: ctx - bounds the fetch; ri - the read; rv - the server's reply, whose Data and IsNew are set on success
+ Returns: A receipt for ServerRPC.ConfirmChunk naming the owner that served the chunk
+ Throws: ChunkUnavailableError if no owner served bytes matching rv.Checksum, or ctx.Err()
+*/
+func fetchFromPeers(ctx context.Context, ri ReadInfo, rv *ReadValue) (*ChunkReceipt, error) {
+	pr := PeerRequest{Fname: ri.Fname, ChunkNum: ri.ChunkNum, Sealed: ri.Sealed, Grant: rv.Grant}
+	for _, owner := range rv.Peers {
+		if owner == myUser {
+			continue
+		}
+
+		span := tracer.Start("dfslib.FetchChunk", tracing.KindClient, ri.Trace, tracing.A("owner", owner))
+		pr.Trace = span.Context()
+		start := time.Now()
+		data, err := fetchFromPeer(ctx, owner, pr)
+		if err == nil && sha256.Sum256(data) != rv.Checksum {
+			err = ChunkUnavailableError(ri.ChunkNum)
+		}
+		span.Finish(&err)
+
+		if err == nil {
+			rv.Data = data
+			rv.IsNew = true
+			return &ChunkReceipt{User: myUser, Fname: ri.Fname, ChunkNum: ri.ChunkNum, Version: rv.GlobalChunkVer,
+				Owner: owner, Latency: time.Since(start), Trace: ri.Trace}, nil
+		}
+		logger.Log(logging.Debug, "Unable to fetch chunk from owner", logging.F("owner", owner), logging.F(logging.KeyFile, ri.Fname),
+			logging.F(logging.KeyChunk, ri.ChunkNum), logging.F(logging.KeyError, err))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, ChunkUnavailableError(ri.ChunkNum)
+}
+
+/*
+ Purpose: Dials an owner's listener and asks it for a chunk
+ Params: ctx - bounds the fetch, together with peerTimeout; owner - the owner; pr - the request
+ Returns: The owner's stored bytes for the chunk
+ Throws: Any dial or RPC error
+*/
+func fetchFromPeer(ctx context.Context, owner UserInfo, pr PeerRequest) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout*time.Millisecond)
+	defer cancel()
+
+	conn, err := network.DialContext(ctx, owner.LocalIP)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		// Owners' addresses are self-reported, so only the CA is checked;
+		// the checksum guards what they return
+		config := tlsConfig.Clone()
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = verifyChain
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	peer := rpc.NewClient(conn)
+	defer peer.Close()
+
+	var data []byte
+	err = callContext(ctx, peer, "PeerRPC.FetchChunk", pr, &data)
+	return data, err
+}
+
+/*
+ Purpose: Checks that a TLS peer's certificate chains to the CA
+ Params: cs - the handshake state
+ Returns
+ Throws: Any verification error
+*/
+func verifyChain(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return AuthenticationError("")
+	}
+
+	opts := x509.VerifyOptions{Roots: tlsConfig.RootCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+/*
+ Purpose: Converts a chunk into the bytes stored and transferred for it
+ Params: chunkNum - the chunk's position; version - the version being written;
+         both are bound into the ciphertext; chunk - the plaintext
+ Returns: A copy of the chunk, or nonce || ciphertext || tag for encrypted files
+ Throws: EncryptionError if no nonce could be generated
+*/
+func (f *dfsFileObject) seal(chunkNum uint8, version int, chunk *Chunk) ([]byte, error) {
+	if f.aead == nil {
+		return append([]byte(nil), chunk[:]...), nil
+	}
+
+	nonce := make([]byte, nonceSize, sealedChunkSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, EncryptionError(f.name)
+	}
+
+	return f.aead.Seal(nonce, nonce, chunk[:], chunkAD(f.name, chunkNum, version)), nil
+}
+
+/*
+ Purpose: Converts the bytes stored for a chunk back into the chunk
+ Params: chunkNum - the chunk's position; version - the version stored, 0 if never written;
+         slot - the stored bytes; chunk - receives the plaintext
+ Returns
+ Throws: EncryptionError if the slot fails authentication under the file's key
+         as that chunk and version
+*/
+func (f *dfsFileObject) unseal(chunkNum uint8, version int, slot []byte, chunk *Chunk) error {
+	if f.aead == nil {
+		copy(chunk[:], slot)
+		return nil
+	}
+
+	// A chunk never written is empty whatever the slot holds
+	if version == 0 {
+		*chunk = Chunk{}
+		return nil
+	}
+
+	if len(slot) != sealedChunkSize {
+		return EncryptionError(f.name)
+	}
+
+	plain, err := f.aead.Open(nil, slot[:nonceSize], slot[nonceSize:], chunkAD(f.name, chunkNum, version))
+	if err != nil {
+		return EncryptionError(f.name)
+	}
+
+	copy(chunk[:], plain)
+	return nil
+}
+
+/*
+ Purpose: Builds the additional data that binds a ciphertext to its file, position and
+          version, so that an older version cannot be passed off as a newer one
+ Params: fname - the file name; chunkNum - the chunk's position; version - the chunk's version
+ Returns
+ Throws:
+*/
+func chunkAD(fname string, chunkNum uint8, version int) []byte {
+	ad := append([]byte(fname), 0, chunkNum)
+	return binary.BigEndian.AppendUint64(ad, uint64(version))
+}
+
+/*
+ Purpose: Reads a chunk from the local cache
+ Params: chunkNum - the chunk; chunk - receives the plaintext
+ Returns
+ Throws: Any read error, or EncryptionError if the cached chunk fails to unseal
+*/
+func (f *dfsFileObject) readCached(chunkNum uint8, chunk *Chunk) error {
+	// The slot and its version are read together, as a write may replace both
+	versionsLock.Lock()
+	slot, err := readSlot(f.fd, chunkNum, slotSize(f.aead != nil))
+	version := 0
+	if localVersions != nil && localVersions[f.name] != nil {
+		version = localVersions[f.name][chunkNum]
+	}
+	versionsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return f.unseal(chunkNum, version, slot, chunk)
+}
+
+/*
+ Purpose: Gives the number of bytes stored per chunk
+ Params: sealed - whether the file is encrypted
+ Returns
+ Throws:
+*/
+func slotSize(sealed bool) int {
+	if sealed {
+		return sealedChunkSize
+	}
+	var c Chunk
+	return len(c)
+}
+
+/*
+ Purpose: Reads the bytes stored for a chunk from a local file
+ Params: fd - the local file; chunkNum - the chunk; size - bytes stored per chunk
+ Returns
+ Throws: Any read error
+*/
+func readSlot(fd *os.File, chunkNum uint8, size int) ([]byte, error) {
+	slot := make([]byte, size)
+	_, err := fd.ReadAt(slot, int64(size*int(chunkNum)))
+	if err != nil {
+		return nil, err
+	}
+	return slot, nil
+}
+
+/*
+ Purpose: Writes the bytes stored for a chunk to a local file and syncs it
+ Params: fd - the local file; chunkNum - the chunk; slot - the bytes to store
+ Returns
+ Throws: Any write error
+*/
+func writeSlot(fd *os.File, chunkNum uint8, slot []byte) error {
+	_, err := fd.WriteAt(slot, int64(len(slot)*int(chunkNum)))
+	if err != nil {
+		return err
+	}
+	return fd.Sync()
 }
 
 /*
- Purpose:
- Params:
- Returns
+ Purpose: Looks up the version of a chunk cached locally
+ Params: fname - the file name; chunkNum - the chunk within the file
+ Returns: The cached version, or 0 if the chunk was never read or written
  Throws:
 */
-func openExistingFile(name string) (f *os.File, err error) {
-	path := myUser.LocalPath + name + ".dfs"
-	fmt.Printf("dfslib: Opening file at path [%s]\n", path)
+func localChunkVersion(fname string, chunkNum uint8) int {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
 
-	if !checkLocalPathOK(path) {
-		return nil, FileUnavailableError(name)
+	if localVersions == nil || localVersions[fname] == nil {
+		return 0
 	}
+	return localVersions[fname][chunkNum]
+}
 
-	f, err = os.Open(path)
-	if err != nil {
-		return nil, FileUnavailableError(name)
-	}
+// cachesChunks reports whether this client has cached any chunk of fname
+func cachesChunks(fname string) bool {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
 
-	return f, nil
+	if localVersions == nil || localVersions[fname] == nil {
+		return false
+	}
+	for _, version := range localVersions[fname] {
+		if version > 0 {
+			return true
+		}
+	}
+	return false
 }
 
-//===================================
-// IMPLEMENTATION: DFSFile Interface
-//===================================
-
 /*
- Purpose:
- Params:
- Returns
- Throws:
+ Purpose: Caches the bytes stored for a chunk version and records the version, unless
+          the same or a newer version is already cached
+ Params: fd - the local file; fname - the file name; chunkNum - the chunk within the file;
+         version - its version; slot - the bytes to store
+ Returns: false if the version already cached was kept
+ Throws: Any write error
+ Note: Holding versionsLock across the write keeps a replica pushed by the scrubber
+       from overwriting a newer version this client wrote or read meanwhile
 */
-func (f *dfsFileObject) Read(chunkNum uint8, chunk *Chunk) (err error) {
-	ri := ReadInfo{User: myUser, Fname: f.name, ChunkNum: chunkNum, LocalChunkVer: f.chunkVer[chunkNum]}
-	rv := ReadValue{IsNew: false}
+func cacheSlot(fd *os.File, fname string, chunkNum uint8, version int, slot []byte) (bool, error) {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
 
-	// TODO: check connToServer is not nil
-	err = connToServer.Call("ServerRPC.ReadFile", ri, &rv)
-	if err != nil {
-		return err
+	if localVersions == nil {
+		localVersions = make(map[string]*[256]int, 0)
 	}
-
-	if rv.IsNew {
-		f.chunkVer[chunkNum] = rv.globalChunkVer
-		*chunk = rv.Chnk
-
-		c := *chunk
-		pos := len(c) * int(chunkNum)
-		f.fd.Seek(int64(pos), 0)
-		f.fd.Write(chunk[:])
-		err = f.fd.Sync()
-	} else {
-		c := *chunk
-		pos := len(c) * int(chunkNum)
-		f.fd.Seek(int64(pos), 0)
-		f.fd.Read(chunk[:])
+	if localVersions[fname] == nil {
+		localVersions[fname] = new([256]int)
+	}
+	if localVersions[fname][chunkNum] >= version {
+		return false, nil
 	}
 
-	return nil
+	err := writeSlot(fd, chunkNum, slot)
+	if err != nil {
+		return false, err
+	}
+	localVersions[fname][chunkNum] = version
+	return true, nil
 }
 
 /*
- Purpose:
- Params:
- Returns
+ Purpose: Records the generation of a file the server reports, forgetting the chunk
+          versions cached of an earlier file of the same name
+ Params: fname - the file name; generation - its generation
+ Returns: current - false if generation is older than the one recorded, which is kept;
+          recreated - true if the chunks cached of an earlier file were forgotten
  Throws:
+ Note: A process that has not recorded a generation keeps the versions it has
 */
-func (f *dfsFileObject) Write(chunkNum uint8, chunk *Chunk) (err error) {
-	if f.fm == READ {
-		return BadFileModeError("READ")
-	} else if f.fm == DREAD {
-		return BadFileModeError("DREAD")
-	} else if connToServer == nil {
-		return WriteModeTimeoutError(f.name)
-	}
-
-	fmt.Printf("dfslib: Writing to file [%s]\n", f.name)
-	wi := WriteInfo{User: myUser, Fname: f.name, ChunkNum: chunkNum}
-	// TODO: check connToServer not nil
-	reply := false
-	err = connToServer.Call("ServerRPC.WriteFile", wi, &reply)
+func adoptGeneration(fname string, generation uint64) (current bool, recreated bool) {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
 
-	if reply {
-		f.chunkVer[chunkNum] = f.chunkVer[chunkNum] + 1
-		c := *chunk
-		pos := len(c) * int(chunkNum)
-		f.fd.Seek(int64(pos), 0)
-		f.fd.Write(chunk[:])
-		err = f.fd.Sync()
+	if generations == nil {
+		generations = make(map[string]uint64, 0)
 	}
-
-	return err
+	recorded, ok := generations[fname]
+	if ok && generation < recorded {
+		return false, false
+	}
+	if ok && generation != recorded {
+		delete(localVersions, fname)
+		recreated = true
+	}
+	generations[fname] = generation
+	return true, recreated
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Forgets a removed file: its generation, its cached chunk versions and its local copy
+ Params: fname - the file name
  Returns
  Throws:
 */
-func (f *dfsFileObject) Dread(chunkNum uint8, chunk *Chunk) (err error) {
-	if f.fm == READ {
-		return BadFileModeError("READ")
-	} else if f.fm == WRITE {
-		return BadFileModeError("WRITE")
-	}
+func forgetFile(fname string) {
+	versionsLock.Lock()
+	delete(localVersions, fname)
+	delete(generations, fname)
+	versionsLock.Unlock()
 
-	c := *chunk
-	pos := len(c) * int(chunkNum)
-	f.fd.Seek(int64(pos), 0)
-	_, err = f.fd.Read(chunk[:])
-
-	return err
+	os.Remove(myUser.LocalPath + fname + ".dfs")
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Forgets all cached chunk versions of a file that was recreated locally
+ Params: fname - the file name
  Returns
  Throws:
 */
-func (f dfsFileObject) Close() (err error) {
-	reply := false
-	fi := FileInfo{User: myUser, Name: f.name, Fmode: f.fm}
-
-	// TODO: check connToServer not nil
-	err = connToServer.Call("ServerRPC.CloseFile", fi, &reply)
+func resetChunkVersions(fname string) {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
 
-	f.fd.Close()
-	return err
+	if localVersions != nil {
+		delete(localVersions, fname)
+	}
 }
 
-//==========================================
-// IMPLEMENTATION: DFSFile helper functions
-//==========================================
-
 //==================================================================
 // Error handling follows go conventions of explicitly typed errors.
 // All errors returned by the DFS library are defined below.
 //==================================================================
 
+// Errors the server shares with dfslib arrive as rpc.ServerError
+// strings; each is recognised by the text around its argument
+var serverErrors = []struct {
+	prefix, suffix string
+	typed          func(arg string) error
+}{
+	{"DFS: Permission denied on filename [", "]", func(arg string) error { return PermissionDeniedError(arg) }},
+	{"DFS: Filename [", "] is opened for writing by another client", func(arg string) error { return OpenWriteConflictError(arg) }},
+	{"DFS: Filename [", "] is unavailable", func(arg string) error { return FileUnavailableError(arg) }},
+	{"DFS: Filename [", "] is open by a client", func(arg string) error { return FileInUseError(arg) }},
+	{"DFS: Storage quota exceeded for [", "]", func(arg string) error { return QuotaExceededError(arg) }},
+	{"DFS: Write access to filename [", "] has timed out; reopen the file", func(arg string) error { return WriteModeTimeoutError(arg) }},
+	{"DFS: Filename [", "] must be opened with the encryption mode it was created with", func(arg string) error { return EncryptionModeError(arg) }},
+	{"DFS: Chunks of filename [", "] were sealed for versions they are not at", func(arg string) error { return ChunkVersionError(arg) }},
+	{"DFS: Session [", "] has ended; remount to start another", func(arg string) error { return SessionExpiredError(arg) }},
+	{"server: The user: [", "] is already registered\n", func(arg string) error { return UserRegistrationError(arg) }},
+	{"DFS: Latest verson of chunk [", "] unavailable", func(arg string) error {
+		n, _ := strconv.ParseUint(arg, 10, 8)
+		return ChunkUnavailableError(n)
+	}},
+}
+
+/*
+ Purpose: Converts an error returned by the server back into its typed dfslib error
+ Params: err - the error returned by an RPC call
+ Returns: The typed error, or err unchanged if it is not recognised
+ Throws:
+*/
+func serverError(err error) error {
+	se, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+
+	msg := string(se)
+	for _, e := range serverErrors {
+		if strings.HasPrefix(msg, e.prefix) && strings.HasSuffix(msg, e.suffix) && len(msg) >= len(e.prefix)+len(e.suffix) {
+			return e.typed(msg[len(e.prefix) : len(msg)-len(e.suffix)])
+		}
+	}
+	return err
+}
+
 // A user is identified by their IP and path
 type UserRegistrationError string
 
@@ -554,6 +2510,83 @@ func (e FileUnavailableError) Error() string {
 	return fmt.Sprintf("DFS: Filename [%s] is unavailable", string(e))
 }
 
+// Contains filename
+type PermissionDeniedError string
+
+func (e PermissionDeniedError) Error() string {
+	return fmt.Sprintf("DFS: Permission denied on filename [%s]", string(e))
+}
+
+// Contains filename
+type EncryptionError string
+
+func (e EncryptionError) Error() string {
+	return fmt.Sprintf("DFS: Cannot encrypt or decrypt filename [%s] with the supplied key", string(e))
+}
+
+// Contains filename
+type EncryptionModeError string
+
+func (e EncryptionModeError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] must be opened with the encryption mode it was created with", string(e))
+}
+
+// Contains filename
+type ChunkVersionError string
+
+func (e ChunkVersionError) Error() string {
+	return fmt.Sprintf("DFS: Chunks of filename [%s] were sealed for versions they are not at", string(e))
+}
+
+// Contains the owner or namespace whose quota is exhausted
+type QuotaExceededError string
+
+func (e QuotaExceededError) Error() string {
+	return fmt.Sprintf("DFS: Storage quota exceeded for [%s]", string(e))
+}
+
+// Contains filename
+type FileInUseError string
+
+func (e FileInUseError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] is open by a client", string(e))
+}
+
+// Contains the address
+type PortInUseError string
+
+func (e PortInUseError) Error() string {
+	return fmt.Sprintf("DFS: Cannot listen for callbacks on [%s]; the port may be in use", string(e))
+}
+
+// Contains the address of the live mount
+type AlreadyMountedError string
+
+func (e AlreadyMountedError) Error() string {
+	return fmt.Sprintf("DFS: Already mounted on [%s]; unmount first", string(e))
+}
+
+// Contains the address
+type CallbackUnreachableError string
+
+func (e CallbackUnreachableError) Error() string {
+	return fmt.Sprintf("DFS: The server cannot call back on [%s]", string(e))
+}
+
+// Contains the method called while not connected
+type NotConnectedError string
+
+func (e NotConnectedError) Error() string {
+	return fmt.Sprintf("DFS: Not connected to the server; cannot call [%s]", string(e))
+}
+
+// Contains the session ID
+type SessionExpiredError string
+
+func (e SessionExpiredError) Error() string {
+	return fmt.Sprintf("DFS: Session [%s] has ended; remount to start another", string(e))
+}
+
 // Contains local path
 type LocalPathError string
 
@@ -561,6 +2594,13 @@ func (e LocalPathError) Error() string {
 	return fmt.Sprintf("DFS: Cannot access local path [%s]", string(e))
 }
 
+// Contains the certificate identity of the peer
+type AuthenticationError string
+
+func (e AuthenticationError) Error() string {
+	return fmt.Sprintf("DFS: Peer [%s] is not the server this client is mounted on", string(e))
+}
+
 // Contains local path
 type NotImplementedError string
 
@@ -575,15 +2615,58 @@ func (e NotImplementedError) Error() string {
 // Client and server communicate via bi-directional RPC calls
 //==================================================================
 
-type ClientRPC int
+// A ClientRPC serves one connection. Only the server may call it: over TLS
+// the connection must carry the server's certificate, and otherwise the
+// caller must first Ping with the session ID the server issued this client.
+type ClientRPC struct {
+	lock   sync.Mutex
+	server bool // true once the caller is known to be the server
+	peer   string
+}
 
 type ClientInterface interface {
-	Ping(stub int, reply *bool) (err error)
-	RetrieveLatestChunk(ri ReadInfo, chunk *Chunk) (err error)
+	Ping(session string, reply *bool) (err error)
+	RetrieveLatestChunk(ri ReadInfo, data *[]byte) (err error)
+	VerifyChunk(vi VerifyInfo, vv *VerifyValue) (err error)
+	StoreChunk(ri ReplicaInfo, reply *bool) (err error)
+	NotifyFileEvent(ev FileEvent, reply *bool) (err error)
+}
+
+/*
+ Purpose: Lets the server check this client can be called back on the connection
+ Params: session - the session ID the server issued this client
+ Returns
+ Throws: AuthenticationError if session is not this client's session
+*/
+func (c *ClientRPC) Ping(session string, reply *bool) (err error) {
+	mountLock.Lock()
+	if session == "" || session != sessionID {
+		mountLock.Unlock()
+		logger.Log(logging.Error, "Refused ping", logging.F("peer", c.peer))
+		return AuthenticationError(c.peer)
+	}
+
+	logger.Log(logging.Debug, "Received ping from server")
+	c.lock.Lock()
+	c.server = true
+	c.lock.Unlock()
+	if callbackPinged != nil {
+		close(callbackPinged)
+		callbackPinged = nil
+	}
+	mountLock.Unlock()
+	*reply = true
+	return nil
 }
 
-func (c *ClientRPC) Ping(stub int, reply *bool) (err error) {
-	fmt.Println("dfslib: Received ping from server")
+// fromServer checks that the caller is the server this client is mounted on
+func (c *ClientRPC) fromServer() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.server {
+		return AuthenticationError(c.peer)
+	}
 	return nil
 }
 
@@ -593,20 +2676,253 @@ func (c *ClientRPC) Ping(stub int, reply *bool) (err error) {
  Returns
  Throws:
 */
-func (c *ClientRPC) RetrieveLatestChunk(ri ReadInfo, chunk *Chunk) (err error) {
+func (c *ClientRPC) RetrieveLatestChunk(ri ReadInfo, data *[]byte) (err error) {
+	span := tracer.Start("dfslib.RetrieveLatestChunk", tracing.KindServer, ri.Trace,
+		tracing.A(logging.KeyFile, ri.Fname), tracing.A(logging.KeyChunk, ri.ChunkNum))
+	defer span.Finish(&err)
+
+	err = c.fromServer()
+	if err != nil {
+		return err
+	}
+
 	path := myUser.LocalPath + ri.Fname + ".dfs"
 	f, err := os.Open(path)
 	if err != nil {
 		return ChunkUnavailableError(ri.ChunkNum)
 	}
+	defer f.Close()
+
+	*data, err = readSlot(f, ri.ChunkNum, slotSize(ri.Sealed))
+	if err != nil {
+		return ChunkUnavailableError(ri.ChunkNum)
+	}
+
+	return nil
+}
+
+/*
+ Purpose: Serves many locally cached chunks of a file to the server in one call
+ Params: rci - the file and chunks to serve
+ Returns: The stored bytes of each of rci.ChunkNums, nil for any that cannot be read
+ Throws: ChunkUnavailableError if the file is not cached locally
+*/
+func (c *ClientRPC) RetrieveLatestChunks(rci ReadChunksInfo, data *[][]byte) (err error) {
+	span := tracer.Start("dfslib.RetrieveLatestChunks", tracing.KindServer, rci.Trace,
+		tracing.A(logging.KeyFile, rci.Fname), tracing.A("chunks", len(rci.ChunkNums)))
+	defer span.Finish(&err)
+
+	err = c.fromServer()
+	if err != nil {
+		return err
+	}
+	if len(rci.ChunkNums) == 0 {
+		return nil
+	}
+
+	path := myUser.LocalPath + rci.Fname + ".dfs"
+	f, err := os.Open(path)
+	if err != nil {
+		return ChunkUnavailableError(rci.ChunkNums[0])
+	}
+	defer f.Close()
+
+	*data = make([][]byte, len(rci.ChunkNums))
+	for i, chunkNum := range rci.ChunkNums {
+		(*data)[i], _ = readSlot(f, chunkNum, slotSize(rci.Sealed))
+	}
+
+	return nil
+}
+
+/*
+ Purpose: Reports the version and checksum of a locally cached chunk to the scrubber
+ Params: vi - the file name and chunk number to verify
+ Returns: vv.Present is false if the file is not cached locally
+ Throws:
+*/
+func (c *ClientRPC) VerifyChunk(vi VerifyInfo, vv *VerifyValue) (err error) {
+	span := tracer.Start("dfslib.VerifyChunk", tracing.KindServer, vi.Trace,
+		tracing.A(logging.KeyFile, vi.Fname), tracing.A(logging.KeyChunk, vi.ChunkNum))
+	defer span.Finish(&err)
+
+	err = c.fromServer()
+	if err != nil {
+		return err
+	}
+
+	path := myUser.LocalPath + vi.Fname + ".dfs"
+	f, err := os.Open(path)
+	if err != nil {
+		vv.Present = false
+		return nil
+	}
+	defer f.Close()
+
+	slot, err := readSlot(f, vi.ChunkNum, slotSize(vi.Sealed))
+	if err != nil {
+		vv.Present = false
+		return nil
+	}
+
+	vv.Present = true
+	vv.Version = localChunkVersion(vi.Fname, vi.ChunkNum)
+	vv.Checksum = sha256.Sum256(slot)
+	return nil
+}
+
+/*
+ Purpose: Caches a chunk version pushed by the scrubber to re-replicate it
+ Params: ri - the file name, chunk number, version and contents to store
+ Returns: false if the same or a newer version is already cached here
+ Throws: ChunkUnavailableError if the chunk cannot be written locally
+*/
+func (c *ClientRPC) StoreChunk(ri ReplicaInfo, reply *bool) (err error) {
+	span := tracer.Start("dfslib.StoreChunk", tracing.KindServer, ri.Trace,
+		tracing.A(logging.KeyFile, ri.Fname), tracing.A(logging.KeyChunk, ri.ChunkNum), tracing.A(logging.KeyVersion, ri.Version))
+	defer span.Finish(&err)
+
+	err = c.fromServer()
+	if err != nil {
+		return err
+	}
+
+	current, _ := adoptGeneration(ri.Fname, ri.Generation)
+	if !current {
+		// The file was removed since the scrubber chose this replica
+		*reply = false
+		return nil
+	}
+
+	// A file left from before this mount holds chunks the server no longer
+	// counts this client an owner of, so only a file this mount cached is kept
+	flags := os.O_RDWR | os.O_CREATE
+	if !cachesChunks(ri.Fname) {
+		flags |= os.O_TRUNC
+	}
+	path := myUser.LocalPath + ri.Fname + ".dfs"
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return ChunkUnavailableError(ri.ChunkNum)
+	}
+	defer f.Close()
+
+	size := int64(slotSize(ri.Sealed) * 256)
+	if fi, err := f.Stat(); err == nil && fi.Size() < size {
+		f.Truncate(size)
+	}
 
-	pos := len(chunk) * int(ri.ChunkNum)
-	f.Seek(int64(pos), 0)
-	_, err = f.Read(chunk[:])
+	// A replica older than the version cached here is not stored
+	*reply, err = cacheSlot(f, ri.Fname, ri.ChunkNum, ri.Version, ri.Data)
 	if err != nil {
 		return ChunkUnavailableError(ri.ChunkNum)
 	}
+	return nil
+}
+
+/*
+ Purpose: Delivers a FileEvent pushed by the server to the channels returned by Watch
+ Params: ev - the event
+ Returns
+ Throws:
+*/
+func (c *ClientRPC) NotifyFileEvent(ev FileEvent, reply *bool) (err error) {
+	err = c.fromServer()
+	if err != nil {
+		return err
+	}
+
+	watchLock.Lock()
+	defer watchLock.Unlock()
+
+	for _, ch := range watchChans[ev.Fname] {
+		select {
+		case ch <- ev:
+		default:
+		}
+
+		if ev.Removed {
+			close(ch)
+		}
+	}
 
-	f.Close()
+	if ev.Removed {
+		delete(watchChans, ev.Fname)
+		forgetFile(ev.Fname)
+	}
+	*reply = true
+	return nil
+}
+
+//==================================================================
+// Clients serve the chunks they hold to other clients reading
+// directly. A request must arrive over TLS and carry a grant the
+// server signed for the requesting client.
+//==================================================================
+
+type PeerRPC struct {
+	principal string // common name of the requesting client, when using TLS
+}
+
+/*
+ Purpose: Serves a locally cached chunk to another client
+ Params: pr - the chunk, and the grant authorising the request
+ Returns: The stored bytes for the chunk
+ Throws: PermissionDeniedError without TLS or if the grant is invalid, BadFilenameError,
+         ChunkUnavailableError if the chunk version granted is not cached here
+*/
+func (p *PeerRPC) FetchChunk(pr PeerRequest, data *[]byte) (err error) {
+	span := tracer.Start("dfslib.ServeChunk", tracing.KindServer, pr.Trace,
+		tracing.A(logging.KeyFile, pr.Fname), tracing.A(logging.KeyChunk, pr.ChunkNum))
+	defer span.Finish(&err)
+
+	// Without TLS nothing identifies the requester, so the grant cannot be checked
+	if tlsConfig == nil {
+		return PermissionDeniedError(pr.Fname)
+	}
+	if !validFileName(pr.Fname) {
+		return BadFilenameError(pr.Fname)
+	}
+	err = verifyGrant(pr, p.principal)
+	if err != nil {
+		return PermissionDeniedError(pr.Fname)
+	}
+	if localChunkVersion(pr.Fname, pr.ChunkNum) != pr.Grant.Version {
+		return ChunkUnavailableError(pr.ChunkNum)
+	}
+
+	path := myUser.LocalPath + pr.Fname + ".dfs"
+	f, err := os.Open(path)
+	if err != nil {
+		return ChunkUnavailableError(pr.ChunkNum)
+	}
+	defer f.Close()
+
+	*data, err = readSlot(f, pr.ChunkNum, slotSize(pr.Sealed))
+	if err != nil {
+		return ChunkUnavailableError(pr.ChunkNum)
+	}
 	return nil
 }
+
+/*
+ Purpose: Checks that the server granted this request to the requesting client
+ Params: pr - the request; principal - the requesting client's common name
+ Returns
+ Throws: An error if the grant is for another client or chunk, has expired, or was not signed by the server
+*/
+func verifyGrant(pr PeerRequest, principal string) error {
+	g := pr.Grant
+	if g.Reader != principal || g.Fname != pr.Fname || g.ChunkNum != pr.ChunkNum {
+		return errors.New("dfslib: grant does not cover the request")
+	}
+	if time.Now().After(g.Expires) {
+		return errors.New("dfslib: grant expired")
+	}
+	return serverCert.CheckSignature(g.Algorithm, grantMessage(g), g.Signature)
+}
+
+// grantMessage is the signed encoding of a grant, shared with the server
+func grantMessage(g ChunkGrant) []byte {
+	return []byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%d", g.Reader, g.Fname, g.ChunkNum, g.Version, g.Expires.UnixNano()))
+}
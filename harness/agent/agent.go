@@ -0,0 +1,278 @@
+/*
+	Usage:
+	agent
+
+	A dfslib client driven by the test harness. It serves the Agent RPCs
+	on stdin and stdout, so it must never print to stdout; dfslib logs to
+	stderr. Started by harness.NewCluster rather than by hand.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	"../../clock"
+	"../../dfslib"
+	"../../logging"
+	"../../transport"
+	".."
+)
+
+// settleTimeout bounds how long AdvanceClock waits for the heartbeat it
+// woke to be sent, in milliseconds
+const settleTimeout = 5000
+
+type Agent struct {
+	lock    sync.Mutex
+	dfs     dfslib.DFS
+	files   map[int]dfslib.DFSFile
+	watches map[int]<-chan dfslib.FileEvent
+	next    int
+	clock   *clock.Fake // nil unless mounted with a fake clock
+}
+
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error {
+	return nil
+}
+
+func main() {
+	agent := &Agent{files: make(map[int]dfslib.DFSFile), watches: make(map[int]<-chan dfslib.FileEvent)}
+	server := rpc.NewServer()
+	server.Register(agent)
+
+	// Returns when the harness closes stdin or exits
+	server.ServeConn(stdio{os.Stdin, os.Stdout})
+}
+
+func (a *Agent) Mount(ma harness.MountArgs, reply *harness.Reply) error {
+	logger := logging.NewText(os.Stderr, logging.Debug, "dfslib: ")
+	opts := []dfslib.MountOption{dfslib.WithLogger(logger)}
+	if ma.Proxy != "" {
+		opts = append(opts, dfslib.WithNetwork(transport.ViaProxy(ma.Proxy, ma.Node)))
+	}
+	if ma.Multiplex {
+		opts = append(opts, dfslib.WithMultiplexing())
+	}
+	var fake *clock.Fake
+	if ma.FakeClock {
+		fake = clock.NewFake(time.Now())
+		opts = append(opts, dfslib.WithClock(fake))
+	}
+
+	dfs, err := dfslib.MountDFS(ma.Server, ma.Addr, ma.Path, opts...)
+	if err != nil {
+		reply.Err = harness.EncodeError(err)
+		return nil
+	}
+
+	// A refused mount leaves the live mount's clock in place
+	a.lock.Lock()
+	a.dfs = dfs
+	if fake != nil {
+		a.clock = fake
+	}
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *Agent) Unmount(_ bool, reply *harness.Reply) error {
+	dfs, err := a.mount()
+	if err != nil {
+		return err
+	}
+
+	reply.Err = harness.EncodeError(dfs.UMountDFS())
+	return nil
+}
+
+func (a *Agent) Open(oa harness.OpenArgs, reply *harness.Reply) error {
+	dfs, err := a.mount()
+	if err != nil {
+		return err
+	}
+
+	var opts []dfslib.OpenOption
+	if oa.Readahead >= 0 {
+		opts = append(opts, dfslib.WithReadahead(oa.Readahead))
+	}
+
+	f, err := dfs.Open(oa.Fname, oa.Mode, opts...)
+	if err != nil {
+		reply.Err = harness.EncodeError(err)
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.next++
+	a.files[a.next] = f
+	reply.File = a.next
+	return nil
+}
+
+func (a *Agent) Read(ca harness.ChunkArgs, reply *harness.Reply) error {
+	f, err := a.file(ca.File)
+	if err != nil {
+		return err
+	}
+
+	reply.Err = harness.EncodeError(f.Read(ca.ChunkNum, &reply.Chunk))
+	return nil
+}
+
+func (a *Agent) Write(ca harness.ChunkArgs, reply *harness.Reply) error {
+	f, err := a.file(ca.File)
+	if err != nil {
+		return err
+	}
+
+	reply.Err = harness.EncodeError(f.Write(ca.ChunkNum, &ca.Chunk))
+	return nil
+}
+
+func (a *Agent) Dread(ca harness.ChunkArgs, reply *harness.Reply) error {
+	f, err := a.file(ca.File)
+	if err != nil {
+		return err
+	}
+
+	reply.Err = harness.EncodeError(f.Dread(ca.ChunkNum, &reply.Chunk))
+	return nil
+}
+
+func (a *Agent) Close(ca harness.ChunkArgs, reply *harness.Reply) error {
+	f, err := a.file(ca.File)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	delete(a.files, ca.File)
+	a.lock.Unlock()
+
+	reply.Err = harness.EncodeError(f.Close())
+	return nil
+}
+
+func (a *Agent) LocalFileExists(oa harness.OpenArgs, reply *harness.Reply) error {
+	dfs, err := a.mount()
+	if err != nil {
+		return err
+	}
+
+	exists, err := dfs.LocalFileExists(oa.Fname)
+	reply.Exists = exists
+	reply.Err = harness.EncodeError(err)
+	return nil
+}
+
+func (a *Agent) GlobalFileExists(oa harness.OpenArgs, reply *harness.Reply) error {
+	dfs, err := a.mount()
+	if err != nil {
+		return err
+	}
+
+	exists, err := dfs.GlobalFileExists(oa.Fname)
+	reply.Exists = exists
+	reply.Err = harness.EncodeError(err)
+	return nil
+}
+
+func (a *Agent) Remove(oa harness.OpenArgs, reply *harness.Reply) error {
+	dfs, err := a.mount()
+	if err != nil {
+		return err
+	}
+
+	reply.Err = harness.EncodeError(dfs.Remove(oa.Fname))
+	return nil
+}
+
+func (a *Agent) Watch(oa harness.OpenArgs, reply *harness.Reply) error {
+	dfs, err := a.mount()
+	if err != nil {
+		return err
+	}
+
+	events, err := dfs.Watch(oa.Fname)
+	if err != nil {
+		reply.Err = harness.EncodeError(err)
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.next++
+	a.watches[a.next] = events
+	reply.Watch = a.next
+	return nil
+}
+
+// NextEvent waits for the next event on a watch, until the timeout or
+// until dfslib closes the channel
+func (a *Agent) NextEvent(wa harness.WatchArgs, reply *harness.Reply) error {
+	a.lock.Lock()
+	events := a.watches[wa.Watch]
+	a.lock.Unlock()
+	if events == nil {
+		return errors.New("agent: no such watch")
+	}
+
+	select {
+	case reply.Event, reply.Received = <-events:
+	case <-time.After(wa.Timeout):
+	}
+	return nil
+}
+
+// AdvanceClock moves the fake clock forward, and returns once the
+// heartbeat that woke, if any, has been sent
+func (a *Agent) AdvanceClock(d time.Duration, reply *harness.Reply) error {
+	a.lock.Lock()
+	fake := a.clock
+	a.lock.Unlock()
+	if fake == nil {
+		return errors.New("agent: not mounted with a fake clock")
+	}
+
+	sleepers := fake.Sleepers()
+	fake.Advance(d)
+
+	// Times out if the heartbeat failed and dfslib stopped sending them
+	ctx, cancel := context.WithTimeout(context.Background(), settleTimeout*time.Millisecond)
+	defer cancel()
+	fake.WaitForSleepers(ctx, sleepers)
+	return nil
+}
+
+func (a *Agent) mount() (dfslib.DFS, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.dfs == nil {
+		return nil, errors.New("agent: not mounted")
+	}
+	return a.dfs, nil
+}
+
+func (a *Agent) file(id int) (dfslib.DFSFile, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	f := a.files[id]
+	if f == nil {
+		return nil, errors.New("agent: no such open file")
+	}
+	return f, nil
+}
@@ -0,0 +1,754 @@
+// Package harness runs a dfs server and dfslib clients on localhost for
+// integration tests, e.g.
+//
+//	c, err := harness.NewCluster(2)
+//	defer c.Close()
+//	w, _ := c.Clients[0].Open("notes", dfslib.WRITE)
+//	w.Write(3, harness.ChunkOf("hello"))
+//	r, _ := c.Clients[1].Open("notes", dfslib.READ)
+//	chunk, _ := r.Read(3)
+//
+// dfslib keeps its state in package variables and the server is a main
+// package, so every node runs in its own process, built from this tree
+// on first use. Each client listens on an ephemeral port with its own
+// temporary cache directory. Tests drive the clients one call at a time,
+// so interleavings of reads, writes and disconnected reads are exactly
+// those the test makes.
+//
+// A cluster started WithFaults routes every connection through a
+// transport.Proxy, so tests can partition, delay or drop traffic between
+// two nodes, e.g.
+//
+//	c, err := harness.NewCluster(2, harness.WithFaults(1))
+//	c.Network.Link(c.Clients[0].Name(), c.Server.Name()).Partition()
+//
+// A cluster started WithFakeClock times heartbeats and reaping on clocks
+// that only move when the test calls Advance, e.g.
+//
+//	c, err := harness.NewCluster(2, harness.WithFakeClock())
+//	c.Clients[1].Kill()
+//	c.Advance(10 * time.Second) // reaps client 1, and only client 1
+package harness
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"../dfslib"
+	"../transport"
+)
+
+const (
+	startTimeout   = 5000  // defines how long a node may take to start in milliseconds
+	restartTimeout = 30000 // defines how long a restarted client waits for the server to reap its old session in milliseconds
+	retryInterval  = 250   // defines the wait between attempts to mount in milliseconds
+	exitGrace      = 200   // defines how long a failed call waits to see whether the node exited in milliseconds
+	clockStep      = 1000  // defines the most Advance moves the clocks at once in milliseconds, well under a heartbeat interval
+)
+
+var (
+	buildOnce sync.Once
+	binDir    string // holds the server and agent binaries
+	buildErr  error
+)
+
+// An Option configures a Cluster
+type Option func(*config)
+
+type config struct {
+	serverFlags []string
+	logs        io.Writer // receives every node's output as well as its log file, if set
+	faults      bool
+	seed        int64
+	fakeClock   bool
+	multiplex   bool
+}
+
+// WithServerFlags passes flags to the server, e.g. "-client-timeout", "500ms"
+func WithServerFlags(flags ...string) Option {
+	return func(c *config) {
+		c.serverFlags = append(c.serverFlags, flags...)
+	}
+}
+
+// WithLogs copies every node's output to w, e.g. os.Stderr while debugging
+func WithLogs(w io.Writer) Option {
+	return func(c *config) {
+		c.logs = w
+	}
+}
+
+// WithFaults routes every connection between nodes through a proxy,
+// reached as Cluster.Network, that injects the faults a test sets on the
+// link between two nodes. seed fixes the random delays and drops.
+func WithFaults(seed int64) Option {
+	return func(c *config) {
+		c.faults = true
+		c.seed = seed
+	}
+}
+
+// WithFakeClock runs the server's failure detector and the clients'
+// heartbeats on fake clocks that stand still until Cluster.Advance
+func WithFakeClock() Option {
+	return func(c *config) {
+		c.fakeClock = true
+	}
+}
+
+// WithMultiplexing mounts every client WithMultiplexing, so the server
+// calls them back over the connections they dial rather than dialing them
+func WithMultiplexing() Option {
+	return func(c *config) {
+		c.multiplex = true
+	}
+}
+
+type Cluster struct {
+	Dir       string // holds each client's cache directory and each node's log
+	Server    *Server
+	Clients   []*Client
+	Network   *transport.Proxy // nil unless started WithFaults
+	fakeClock bool
+}
+
+/*
+ Purpose: Starts a server and mounts clients against it
+ Params: clients - the number of clients; opts - optional configuration
+ Returns: The running cluster, which the caller must Close
+ Throws: Any error building or starting a node
+*/
+func NewCluster(clients int, opts ...Option) (*Cluster, error) {
+	cfg := config{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "dfs-cluster")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{Dir: dir, fakeClock: cfg.fakeClock}
+
+	if cfg.faults {
+		c.Network, err = transport.NewProxy(cfg.seed)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	addr, err := freeAddr()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	flags := cfg.serverFlags
+	if cfg.fakeClock {
+		flags = append(flags, "-fake-clock")
+	}
+	c.Server = &Server{Addr: addr, flags: flags, node: node{name: "server", dir: dir, logs: cfg.logs, network: c.Network}}
+	err = c.Server.start()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	for i := 0; i < clients; i++ {
+		name := fmt.Sprintf("client-%d", i)
+		path := filepath.Join(dir, name) + string(filepath.Separator)
+		err = os.Mkdir(path, 0755)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		client := &Client{Path: path, server: c.Server, fakeClock: cfg.fakeClock, multiplex: cfg.multiplex,
+			node: node{name: name, dir: dir, logs: cfg.logs, network: c.Network}}
+		c.Clients = append(c.Clients, client)
+		err = client.mount(true)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Close kills every node and removes Dir
+func (c *Cluster) Close() error {
+	for _, client := range c.Clients {
+		client.Kill()
+	}
+	if c.Server != nil {
+		c.Server.Kill()
+	}
+	if c.Network != nil {
+		c.Network.Close()
+	}
+	return os.RemoveAll(c.Dir)
+}
+
+/*
+ Purpose: Advances the clocks of a cluster started WithFakeClock, in steps of at
+          most clockStep. In each step every client that is up and not partitioned
+          sends any heartbeat now due before the server's clock moves, so only
+          clients that are down or partitioned miss heartbeats and are reaped.
+ Params: d - how far to advance
+ Returns
+ Throws: FakeClockError if the cluster has real clocks, or any error advancing a node's clock
+*/
+func (c *Cluster) Advance(d time.Duration) error {
+	if !c.fakeClock {
+		return FakeClockError(c.Dir)
+	}
+
+	for d > 0 {
+		step := d
+		if step > clockStep*time.Millisecond {
+			step = clockStep * time.Millisecond
+		}
+		d -= step
+
+		for _, client := range c.Clients {
+			if !client.running() || client.isPartitioned() {
+				continue
+			}
+			_, err := client.call("Agent.AdvanceClock", step)
+			if err != nil {
+				return err
+			}
+		}
+		err := c.Server.advance(step)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ Purpose: Builds the server and agent binaries once per process
+ Params:
+ Returns
+ Throws: Any build error, with the compiler's output
+*/
+func build() error {
+	buildOnce.Do(func() {
+		_, file, _, _ := runtime.Caller(0)
+		root := filepath.Dir(filepath.Dir(file))
+
+		binDir, buildErr = ioutil.TempDir("", "dfs-harness-bin")
+		if buildErr != nil {
+			return
+		}
+
+		for _, target := range []struct{ dir, bin string }{{"server", "server"}, {"harness/agent", "agent"}} {
+			cmd := exec.Command("go", "build", "-o", filepath.Join(binDir, target.bin), ".")
+			cmd.Dir = filepath.Join(root, target.dir)
+			cmd.Env = append(os.Environ(), "GO111MODULE=off")
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				buildErr = fmt.Errorf("harness: building %s: %v\n%s", target.dir, err, out)
+				return
+			}
+		}
+	})
+	return buildErr
+}
+
+// freeAddr picks a localhost port that is free, at least for now
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+//==========================================
+// Processes
+//==========================================
+
+// A node is the process running a server or client
+type node struct {
+	name    string
+	dir     string
+	logs    io.Writer
+	network *transport.Proxy // the cluster's, if started WithFaults
+
+	lock        sync.Mutex
+	cmd         *exec.Cmd
+	exited      chan struct{} // closed once cmd has exited
+	partitioned bool
+}
+
+// Name identifies the node to the cluster's Network
+func (n *node) Name() string {
+	return n.name
+}
+
+/*
+ Purpose: Starts the node's process, appending its output to <name>.log in the cluster directory
+ Params: cmd - the process, without output configured
+ Returns
+ Throws: Any error opening the log or starting the process
+*/
+func (n *node) run(cmd *exec.Cmd) error {
+	log, err := os.OpenFile(filepath.Join(n.dir, n.name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = log
+	if n.logs != nil {
+		out = io.MultiWriter(log, n.logs)
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = out
+	}
+	cmd.Stderr = out
+
+	err = cmd.Start()
+	if err != nil {
+		log.Close()
+		return err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		log.Close()
+		close(exited)
+	}()
+
+	n.lock.Lock()
+	n.cmd = cmd
+	n.exited = exited
+	n.partitioned = false
+	n.lock.Unlock()
+	return nil
+}
+
+// running reports whether the node's process has been started and not exited
+func (n *node) running() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.cmd == nil {
+		return false
+	}
+	select {
+	case <-n.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// Kill stops the node's process at once, as a crash would
+func (n *node) Kill() error {
+	n.lock.Lock()
+	cmd, exited := n.cmd, n.exited
+	n.cmd = nil
+	n.partitioned = false
+	n.lock.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+	cmd.Process.Kill()
+	<-exited
+	return nil
+}
+
+// Partition cuts the node off by suspending its process, so it neither
+// sends nor answers anything until Heal. Its connections stay open, as
+// they would across a real partition. To cut it off from only some
+// nodes, start the cluster WithFaults and partition their links instead.
+func (n *node) Partition() error {
+	return n.signal(syscall.SIGSTOP, true)
+}
+
+// Heal resumes a partitioned node
+func (n *node) Heal() error {
+	return n.signal(syscall.SIGCONT, false)
+}
+
+func (n *node) signal(sig os.Signal, partitioned bool) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.cmd == nil {
+		return NodeDownError(n.name)
+	}
+	n.partitioned = partitioned
+	return n.cmd.Process.Signal(sig)
+}
+
+// waitExit reports whether the node's process exits within d
+func (n *node) waitExit(d time.Duration) bool {
+	n.lock.Lock()
+	cmd, exited := n.cmd, n.exited
+	n.lock.Unlock()
+
+	if cmd == nil {
+		return true
+	}
+	select {
+	case <-exited:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (n *node) isPartitioned() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.partitioned
+}
+
+//==========================================
+// Server
+//==========================================
+
+type Server struct {
+	Addr  string
+	flags []string
+	node
+}
+
+/*
+ Purpose: Starts the server and waits until it accepts connections
+ Params:
+ Returns
+ Throws: Any error starting it, or NodeDownError if it exits or does not listen within startTimeout
+*/
+func (s *Server) start() error {
+	args := append([]string(nil), s.flags...)
+	if s.network != nil {
+		s.network.Name(s.Addr, s.name)
+		args = append(args, "-proxy", s.network.Addr, "-node", s.name)
+	}
+	args = append(args, s.Addr)
+	err := s.run(exec.Command(filepath.Join(binDir, "server"), args...))
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(startTimeout * time.Millisecond)
+	for time.Now().Before(deadline) && s.running() {
+		conn, err := net.Dial("tcp", s.Addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Kill()
+	return NodeDownError(s.name)
+}
+
+// advance moves the server's fake clock forward by d
+func (s *Server) advance(d time.Duration) error {
+	if !s.running() {
+		return NodeDownError(s.name)
+	}
+
+	conn, err := rpc.Dial("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var now time.Time
+	return conn.Call("ClockRPC.Advance", d, &now)
+}
+
+// Restart starts a killed server again at the same address. The server
+// keeps no state across restarts, so clients must remount.
+func (s *Server) Restart() error {
+	s.Kill()
+	return s.start()
+}
+
+//==========================================
+// Clients
+//==========================================
+
+type Client struct {
+	Addr      string // the address the client listens on for the server's calls, or only its name if multiplexed
+	Path      string // the client's cache directory
+	server    *Server
+	agent     *rpc.Client
+	fakeClock bool
+	multiplex bool
+	node
+}
+
+type File struct {
+	Name   string
+	Mode   dfslib.FileMode
+	client *Client
+	id     int
+}
+
+// A Watch delivers the events dfslib.Watch returns in a client
+type Watch struct {
+	Fname  string
+	client *Client
+	id     int
+}
+
+/*
+ Purpose: Starts the client's process and mounts the dfs
+ Params: fresh - whether the client may take a new address if mounting fails
+ Returns
+ Throws: Any error starting the process, or the error MountDFS returns
+*/
+func (c *Client) mount(fresh bool) error {
+	err := c.start()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(restartTimeout * time.Millisecond)
+	for {
+		if fresh || c.Addr == "" {
+			addr, err := freeAddr()
+			if err != nil {
+				c.Kill()
+				return err
+			}
+			c.Addr = addr
+		}
+
+		_, err = c.call("Agent.Mount", c.mountArgs())
+		if err == nil {
+			return nil
+		}
+
+		// Another process may take a free address before the client binds it,
+		// and the server keeps a killed client's session until it is reaped
+		_, inUse := err.(dfslib.PortInUseError)
+		_, registered := err.(dfslib.UserRegistrationError)
+		if !inUse && !registered || time.Now().After(deadline) {
+			c.Kill()
+			return err
+		}
+		time.Sleep(retryInterval * time.Millisecond)
+	}
+}
+
+// mountArgs names the client's address on the fault network, if any, and returns its MountArgs
+func (c *Client) mountArgs() MountArgs {
+	ma := MountArgs{Server: c.server.Addr, Addr: c.Addr, Path: c.Path, FakeClock: c.fakeClock, Multiplex: c.multiplex}
+	if c.network != nil {
+		c.network.Name(c.Addr, c.name)
+		ma.Proxy, ma.Node = c.network.Addr, c.name
+	}
+	return ma
+}
+
+// start runs the agent with an RPC connection over its stdin and stdout
+func (c *Client) start() error {
+	cmd := exec.Command(filepath.Join(binDir, "agent"))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = c.run(cmd)
+	if err != nil {
+		return err
+	}
+	c.agent = rpc.NewClient(pipe{stdout, stdin})
+	return nil
+}
+
+// A pipe joins the agent's stdout and stdin into one connection
+type pipe struct {
+	io.ReadCloser
+	w io.WriteCloser
+}
+
+func (p pipe) Write(b []byte) (int, error) {
+	return p.w.Write(b)
+}
+
+func (p pipe) Close() error {
+	p.w.Close()
+	return p.ReadCloser.Close()
+}
+
+/*
+ Purpose: Calls an Agent RPC on the client
+ Params: method - e.g. "Agent.Read"; args - its arguments
+ Returns: The agent's reply
+ Throws: NodeDownError or NodePartitionedError, any error reaching the agent, or
+         the typed dfslib error the call returned
+*/
+func (c *Client) call(method string, args interface{}) (Reply, error) {
+	reply := Reply{}
+	if !c.running() {
+		return reply, NodeDownError(c.name)
+	}
+	if c.isPartitioned() {
+		return reply, NodePartitionedError(c.name)
+	}
+
+	err := c.agent.Call(method, args, &reply)
+	if err != nil {
+		if c.waitExit(exitGrace * time.Millisecond) {
+			return reply, NodeDownError(c.name)
+		}
+		return reply, err
+	}
+	return reply, reply.Err.decode()
+}
+
+// Restart starts a killed client again with the same address and cache
+// directory, and mounts. It waits for the server to reap the old
+// session first, which takes a few heartbeat intervals; under a fake
+// clock, Advance the cluster past them before restarting.
+func (c *Client) Restart() error {
+	c.Kill()
+	return c.mount(false)
+}
+
+func (c *Client) Unmount() error {
+	_, err := c.call("Agent.Unmount", true)
+	return err
+}
+
+// Remount mounts an unmounted client again, in the same process and at the same address
+func (c *Client) Remount() error {
+	_, err := c.call("Agent.Mount", c.mountArgs())
+	return err
+}
+
+func (c *Client) LocalFileExists(fname string) (bool, error) {
+	reply, err := c.call("Agent.LocalFileExists", OpenArgs{Fname: fname})
+	return reply.Exists, err
+}
+
+func (c *Client) GlobalFileExists(fname string) (bool, error) {
+	reply, err := c.call("Agent.GlobalFileExists", OpenArgs{Fname: fname})
+	return reply.Exists, err
+}
+
+// Remove removes a file from the dfs, which no client may have open
+func (c *Client) Remove(fname string) error {
+	_, err := c.call("Agent.Remove", OpenArgs{Fname: fname})
+	return err
+}
+
+// An OpenOption configures how a client opens a file
+type OpenOption func(*OpenArgs)
+
+// WithReadahead opens the file with dfslib.WithReadahead(chunks)
+func WithReadahead(chunks int) OpenOption {
+	return func(oa *OpenArgs) {
+		oa.Readahead = chunks
+	}
+}
+
+func (c *Client) Open(fname string, mode dfslib.FileMode, opts ...OpenOption) (*File, error) {
+	oa := OpenArgs{Fname: fname, Mode: mode, Readahead: -1}
+	for _, opt := range opts {
+		opt(&oa)
+	}
+
+	reply, err := c.call("Agent.Open", oa)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Name: fname, Mode: mode, client: c, id: reply.File}, nil
+}
+
+func (f *File) Read(chunkNum uint8) (dfslib.Chunk, error) {
+	reply, err := f.client.call("Agent.Read", ChunkArgs{File: f.id, ChunkNum: chunkNum})
+	return reply.Chunk, err
+}
+
+func (f *File) Write(chunkNum uint8, chunk dfslib.Chunk) error {
+	_, err := f.client.call("Agent.Write", ChunkArgs{File: f.id, ChunkNum: chunkNum, Chunk: chunk})
+	return err
+}
+
+func (f *File) Dread(chunkNum uint8) (dfslib.Chunk, error) {
+	reply, err := f.client.call("Agent.Dread", ChunkArgs{File: f.id, ChunkNum: chunkNum})
+	return reply.Chunk, err
+}
+
+func (f *File) Close() error {
+	_, err := f.client.call("Agent.Close", ChunkArgs{File: f.id})
+	return err
+}
+
+func (c *Client) Watch(fname string) (*Watch, error) {
+	reply, err := c.call("Agent.Watch", OpenArgs{Fname: fname})
+	if err != nil {
+		return nil, err
+	}
+	return &Watch{Fname: fname, client: c, id: reply.Watch}, nil
+}
+
+// Next waits up to timeout for the next event, and reports false if none
+// arrived or the client closed the watch, e.g. by unmounting
+func (w *Watch) Next(timeout time.Duration) (dfslib.FileEvent, bool, error) {
+	reply, err := w.client.call("Agent.NextEvent", WatchArgs{Watch: w.id, Timeout: timeout})
+	return reply.Event, reply.Received, err
+}
+
+// ChunkOf returns a chunk holding s, truncated or padded with zeros
+func ChunkOf(s string) dfslib.Chunk {
+	var c dfslib.Chunk
+	copy(c[:], s)
+	return c
+}
+
+//==========================================
+// Errors
+//==========================================
+
+type NodeDownError string
+
+func (e NodeDownError) Error() string {
+	return fmt.Sprintf("harness: Node [%s] is not running", string(e))
+}
+
+type FakeClockError string
+
+func (e FakeClockError) Error() string {
+	return fmt.Sprintf("harness: Cluster [%s] was not started WithFakeClock", string(e))
+}
+
+type NodePartitionedError string
+
+func (e NodePartitionedError) Error() string {
+	return fmt.Sprintf("harness: Node [%s] is partitioned", string(e))
+}
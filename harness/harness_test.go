@@ -0,0 +1,599 @@
+package harness
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+
+	"../dfslib"
+)
+
+func TestInterleaving(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	c, err := NewCluster(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writer, reader := c.Clients[0], c.Clients[1]
+
+	w, err := writer.Open("shared", dfslib.WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := reader.Open("shared", dfslib.READ)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one client may hold the write lock
+	_, err = reader.Open("shared", dfslib.WRITE)
+	if _, ok := err.(dfslib.OpenWriteConflictError); !ok {
+		t.Fatalf("second WRITE open: got %v, want OpenWriteConflictError", err)
+	}
+
+	// A READ sees every write as soon as it returns
+	for _, value := range []string{"first", "second"} {
+		err = w.Write(0, ChunkOf(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk, err := r.Read(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk != ChunkOf(value) {
+			t.Fatalf("READ after writing %q: got %q", value, chunk[:])
+		}
+	}
+
+	// A DREAD sees only what the reader has cached, however stale
+	d, err := reader.Open("shared", dfslib.DREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(0, ChunkOf("third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := d.Dread(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != ChunkOf("second") {
+		t.Fatalf("DREAD after a write the reader has not read: got %q, want %q", chunk[:], "second")
+	}
+	chunk, err = r.Read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != ChunkOf("third") {
+		t.Fatalf("READ after the third write: got %q", chunk[:])
+	}
+	chunk, err = d.Dread(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != ChunkOf("third") {
+		t.Fatalf("DREAD after the reader read the third write: got %q", chunk[:])
+	}
+
+	// READ and WRITE refuse the calls of the other modes
+	_, err = w.Dread(0)
+	if _, ok := err.(dfslib.BadFileModeError); !ok {
+		t.Errorf("Dread in WRITE mode: got %v, want BadFileModeError", err)
+	}
+	err = r.Write(0, ChunkOf("refused"))
+	if _, ok := err.(dfslib.BadFileModeError); !ok {
+		t.Errorf("Write in READ mode: got %v, want BadFileModeError", err)
+	}
+
+	// Closing releases the write lock
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = reader.Open("shared", dfslib.WRITE)
+	if err != nil {
+		t.Fatalf("WRITE open after the writer closed: %v", err)
+	}
+	w.Close()
+}
+
+func TestRestartKeepsCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	c, err := NewCluster(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	client := c.Clients[0]
+
+	w, err := client.Open("kept", dfslib.WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(3, ChunkOf("cached"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server keeps the killed client's session until it is reaped,
+	// so Restart waits for that before mounting again
+	err = client.Kill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Open("kept", dfslib.READ)
+	if _, ok := err.(NodeDownError); !ok {
+		t.Fatalf("Open on a killed client: got %v, want NodeDownError", err)
+	}
+	err = client.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := client.LocalFileExists("kept")
+	if err != nil || !exists {
+		t.Fatalf("LocalFileExists after restart: %v, %v", exists, err)
+	}
+	d, err := client.Open("kept", dfslib.DREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := d.Dread(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != ChunkOf("cached") {
+		t.Fatalf("DREAD after restart: got %q", chunk[:])
+	}
+}
+
+// Under a fake clock only a client that stops heartbeating is reaped,
+// and only once the cluster is advanced past its heartbeats
+func TestFakeClockReaping(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	c, err := NewCluster(2, WithFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	live, dead := c.Clients[0], c.Clients[1]
+
+	w, err := dead.Open("locked", dfslib.WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(0, ChunkOf("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dead.Kill()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// However long it takes in real time, the killed writer keeps its lock
+	// until the clock moves
+	time.Sleep(3 * time.Second)
+	_, err = live.Open("locked", dfslib.WRITE)
+	if _, ok := err.(dfslib.OpenWriteConflictError); !ok {
+		t.Fatalf("WRITE open before advancing: got %v, want OpenWriteConflictError", err)
+	}
+
+	err = c.Advance(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The live client kept heartbeating, so it still has its session
+	w, err = live.Open("locked", dfslib.WRITE)
+	if err != nil {
+		t.Fatalf("WRITE open after the writer was reaped: %v", err)
+	}
+	err = w.Write(0, ChunkOf("rewritten"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart would wait for the reaper if the old session were still there
+	err = dead.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dead.Open("locked", dfslib.READ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := r.Read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != ChunkOf("rewritten") {
+		t.Fatalf("READ after restart: got %q", chunk[:])
+	}
+}
+
+// A client whose session the server ended reports it once a heartbeat is refused,
+// rather than a transient NotConnectedError
+func TestSessionExpires(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	c, err := NewCluster(1, WithFakeClock(), WithServerFlags("-insecure-admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	client := c.Clients[0]
+
+	server, err := rpc.Dial("tcp", c.Server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var users []struct{ User dfslib.UserInfo }
+	err = server.Call("ServerRPC.AdminListUsers", 0, &users)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("AdminListUsers: %v, %v", users, err)
+	}
+	err = server.Call("ServerRPC.AdminEvictUser", users[0].User, new(bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Advance(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Open("after", dfslib.READ)
+	if _, ok := err.(dfslib.SessionExpiredError); !ok {
+		t.Fatalf("Open after eviction: got %v, want SessionExpiredError", err)
+	}
+
+	// Unmounting and mounting again starts a new session
+	err = client.Unmount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Remount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Open("after", dfslib.READ)
+	if err != nil {
+		t.Fatalf("Open after remounting: %v", err)
+	}
+	f.Close()
+}
+
+// A second mount is refused without touching the live one
+func TestMountTwice(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	c, err := NewCluster(1, WithFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	client := c.Clients[0]
+
+	err = client.Remount()
+	if _, ok := err.(dfslib.AlreadyMountedError); !ok {
+		t.Fatalf("mounting twice: got %v, want AlreadyMountedError", err)
+	}
+
+	// The live mount still heartbeats on the cluster's clock
+	err = c.Advance(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := client.Open("mounted", dfslib.WRITE)
+	if err != nil {
+		t.Fatalf("Open after the second mount was refused: %v", err)
+	}
+	err = w.Write(0, ChunkOf("still mounted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+// Multiplexed clients bind nothing, so every call the server makes to them,
+// from fetching a chunk to pushing an event, runs over the connections they dialed
+func TestMultiplexing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	c, err := NewCluster(2, WithMultiplexing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writer, reader := c.Clients[0], c.Clients[1]
+
+	w, err := writer.Open("muxed", dfslib.WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(0, ChunkOf("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.Open("muxed", dfslib.WRITE)
+	if _, ok := err.(dfslib.OpenWriteConflictError); !ok {
+		t.Fatalf("second WRITE open: got %v, want OpenWriteConflictError", err)
+	}
+
+	// Only the writer holds the chunk, so the server fetches it from the writer
+	r, err := reader.Open("muxed", dfslib.READ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := r.Read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != ChunkOf("first") {
+		t.Fatalf("READ over a multiplexed cluster: got %q", chunk[:])
+	}
+
+	watch, err := reader.Watch("muxed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(1, ChunkOf("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, ok, err := watch.Next(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dfslib.FileEvent{Fname: "muxed", ChunkNum: 1, Version: 1}
+	if !ok || ev != want {
+		t.Fatalf("event after writing chunk 1: got %+v, %v, want %+v", ev, ok, want)
+	}
+	chunk, err = r.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != ChunkOf("second") {
+		t.Fatalf("READ of chunk 1: got %q", chunk[:])
+	}
+}
+
+// A client partitioned from the server misses its heartbeats and is reaped,
+// and once the partition heals it learns its session has ended
+func TestPartitionedClientIsReaped(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	c, err := NewCluster(2, WithFaults(1), WithServerFlags("-heartbeat-interval", "200ms"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cutOff, other := c.Clients[0], c.Clients[1]
+
+	_, err = cutOff.Open("held", dfslib.WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := c.Network.Link(cutOff.Name(), c.Server.Name())
+	link.Partition()
+
+	// The write lock is freed once the reaper ends the partitioned client's session
+	var w *File
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w, err = other.Open("held", dfslib.WRITE)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(dfslib.OpenWriteConflictError); !ok || time.Now().After(deadline) {
+			t.Fatalf("WRITE open while the holder is partitioned: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	w.Close()
+
+	// The heartbeat held by the partition is refused once it arrives
+	link.Heal()
+	for {
+		_, err = cutOff.Open("held", dfslib.READ)
+		if _, ok := err.(dfslib.SessionExpiredError); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Open after the partition healed: got %v, want SessionExpiredError", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// When the first owner the server asks for a chunk cannot be reached,
+// the read is served by another owner
+func TestOwnerFetchFallback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	metricsAddr, err := freeAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCluster(3, WithFaults(1), WithServerFlags("-metrics", metricsAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writer, owner, reader := c.Clients[0], c.Clients[1], c.Clients[2]
+
+	w, err := writer.Open("owned", dfslib.WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(0, ChunkOf("replicated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reading makes the second client an owner, which the server has not fetched from yet
+	r, err := owner.Open("owned", dfslib.READ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Owners the server has not fetched from are asked first, so the second client,
+	// and the writer left to serve the read answers slowly
+	c.Network.Link(owner.Name(), c.Server.Name()).Drop(1)
+	c.Network.Link(writer.Name(), c.Server.Name()).Delay(20*time.Millisecond, 20*time.Millisecond)
+	r, err = reader.Open("owned", dfslib.READ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := r.Read(0)
+	if err != nil {
+		t.Fatalf("READ with an owner unreachable: %v", err)
+	}
+	if chunk != ChunkOf("replicated") {
+		t.Fatalf("READ with an owner unreachable: got %q", chunk[:])
+	}
+	if !fetchFailed(t, metricsAddr) {
+		t.Error("the server did not try the unreachable owner first")
+	}
+}
+
+// fetchFailed reports whether the server's metrics count a chunk fetch from an owner that failed
+func fetchFailed(t *testing.T, metricsAddr string) bool {
+	resp, err := http.Get("http://" + metricsAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "dfs_server_chunk_fetch_attempts_total") && !strings.Contains(line, `outcome="ok"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// A client that cached a file must not serve those chunks once the file is
+// removed and created again, whether or not it watched the removal
+func TestRecreatedFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	c, err := NewCluster(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	remover, watching, unaware := c.Clients[0], c.Clients[1], c.Clients[2]
+
+	// Both readers cache version 2 of chunk 0
+	w, err := remover.Open("recreated", dfslib.WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"old 1", "old 2"} {
+		err = w.Write(0, ChunkOf(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	for _, reader := range []*Client{watching, unaware} {
+		r, err := reader.Open("recreated", dfslib.READ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Read(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	watch, err := watching.Watch("recreated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = remover.Remove("recreated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, ok, err := watch.Next(5 * time.Second)
+	if err != nil || !ok || !ev.Removed {
+		t.Fatalf("event after removing: got %+v, %v, %v", ev, ok, err)
+	}
+	exists, err := watching.LocalFileExists("recreated")
+	if err != nil || exists {
+		t.Fatalf("watcher's copy after removing: %v, %v", exists, err)
+	}
+
+	// The new file's chunk 0 is at version 1, behind the copies cached of the old one
+	w, err = remover.Open("recreated", dfslib.WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(0, ChunkOf("new 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	for _, reader := range []*Client{watching, unaware} {
+		r, err := reader.Open("recreated", dfslib.READ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk, err := r.Read(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk != ChunkOf("new 1") {
+			t.Errorf("%s READ of the recreated file: got %q", reader.Name(), chunk[:])
+		}
+		chunk, err = r.Read(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk != (dfslib.Chunk{}) {
+			t.Errorf("%s READ of an unwritten chunk: got %q", reader.Name(), chunk[:])
+		}
+		r.Close()
+	}
+}
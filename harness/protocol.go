@@ -0,0 +1,124 @@
+package harness
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"../dfslib"
+)
+
+// Arguments and replies of the Agent RPCs, which the harness makes to
+// each client process over its stdin and stdout
+
+type MountArgs struct {
+	Server    string
+	Addr      string
+	Path      string
+	Proxy     string // the fault-injection proxy to connect through, if any
+	Node      string // the client's name to the proxy
+	FakeClock bool   // times heartbeats on a clock advanced by Agent.AdvanceClock
+	Multiplex bool   // mounts WithMultiplexing, so the client does not listen
+}
+
+type OpenArgs struct {
+	Fname     string
+	Mode      dfslib.FileMode
+	Readahead int // chunks to read ahead, or -1 for dfslib's default window
+}
+
+type ChunkArgs struct {
+	File     int
+	ChunkNum uint8
+	Chunk    dfslib.Chunk
+}
+
+type WatchArgs struct {
+	Watch   int
+	Timeout time.Duration // bounds the wait for the next event
+}
+
+type Reply struct {
+	File     int
+	Watch    int
+	Chunk    dfslib.Chunk
+	Exists   bool
+	Event    dfslib.FileEvent
+	Received bool   // an event arrived before the timeout
+	Err      *Error // nil unless the dfslib call failed
+}
+
+// An Error carries a dfslib error across the process boundary, so the
+// harness can return it with its original type
+type Error struct {
+	Type string // e.g. "OpenWriteConflictError"
+	Arg  string // the error's underlying value
+	Msg  string
+}
+
+// dfslibErrors rebuilds each typed dfslib error from its argument
+var dfslibErrors = map[string]func(arg string) error{
+	"UserRegistrationError":    func(arg string) error { return dfslib.UserRegistrationError(arg) },
+	"OpenWriteConflictError":   func(arg string) error { return dfslib.OpenWriteConflictError(arg) },
+	"BadFileModeError":         func(arg string) error { return dfslib.BadFileModeError(arg) },
+	"WriteModeTimeoutError":    func(arg string) error { return dfslib.WriteModeTimeoutError(arg) },
+	"BadFilenameError":         func(arg string) error { return dfslib.BadFilenameError(arg) },
+	"FileUnavailableError":     func(arg string) error { return dfslib.FileUnavailableError(arg) },
+	"PermissionDeniedError":    func(arg string) error { return dfslib.PermissionDeniedError(arg) },
+	"EncryptionError":          func(arg string) error { return dfslib.EncryptionError(arg) },
+	"EncryptionModeError":      func(arg string) error { return dfslib.EncryptionModeError(arg) },
+	"ChunkVersionError":        func(arg string) error { return dfslib.ChunkVersionError(arg) },
+	"QuotaExceededError":       func(arg string) error { return dfslib.QuotaExceededError(arg) },
+	"FileInUseError":           func(arg string) error { return dfslib.FileInUseError(arg) },
+	"LocalPathError":           func(arg string) error { return dfslib.LocalPathError(arg) },
+	"AuthenticationError":      func(arg string) error { return dfslib.AuthenticationError(arg) },
+	"NotImplementedError":      func(arg string) error { return dfslib.NotImplementedError(arg) },
+	"SessionExpiredError":      func(arg string) error { return dfslib.SessionExpiredError(arg) },
+	"NotConnectedError":        func(arg string) error { return dfslib.NotConnectedError(arg) },
+	"PortInUseError":           func(arg string) error { return dfslib.PortInUseError(arg) },
+	"AlreadyMountedError":      func(arg string) error { return dfslib.AlreadyMountedError(arg) },
+	"CallbackUnreachableError": func(arg string) error { return dfslib.CallbackUnreachableError(arg) },
+	"ChunkUnavailableError": func(arg string) error {
+		n, _ := strconv.ParseUint(arg, 10, 8)
+		return dfslib.ChunkUnavailableError(n)
+	},
+}
+
+/*
+ Purpose: Encodes an error returned by dfslib for the reply to the harness
+ Params: err - the error, or nil
+ Returns: nil if err is nil
+ Throws:
+*/
+func EncodeError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	e := &Error{Type: reflect.TypeOf(err).Name(), Msg: err.Error()}
+	if reflect.TypeOf(err).PkgPath() != reflect.TypeOf(dfslib.Chunk{}).PkgPath() {
+		e.Type = ""
+	}
+
+	v := reflect.ValueOf(err)
+	switch v.Kind() {
+	case reflect.String:
+		e.Arg = v.String()
+	case reflect.Uint8:
+		e.Arg = strconv.FormatUint(v.Uint(), 10)
+	}
+	return e
+}
+
+// decode returns the typed dfslib error, or an error with the original message
+func (e *Error) decode() error {
+	if e == nil {
+		return nil
+	}
+	if typed, ok := dfslibErrors[e.Type]; ok {
+		return typed(e.Arg)
+	}
+	return errors.New(strings.TrimSpace(e.Msg))
+}
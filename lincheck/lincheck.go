@@ -0,0 +1,204 @@
+/*
+	Usage:
+	go run lincheck.go [-rounds n] [-clients n] [-ops n] [-chunks n] [-crashes n]
+	                   [-jitter duration] [-seed n]
+
+	Checks that reads and writes in READ and WRITE mode are linearizable.
+	Each round starts a test cluster, has every client open one file and
+	make random reads, writes, closes and reopens of a few chunks at once,
+	records the history, and checks it. -crashes kills that many clients
+	at random points in each round; their unfinished writes may or may not
+	have taken effect. Readahead stays off, as it is by default, since a
+	prefetched chunk may be up to 5 seconds stale by design. -jitter delays each delivery between a client and
+	the server by up to the given duration, to vary the interleavings.
+
+	Prints each round's outcome. On a violation, prints the operations on
+	the offending chunk and exits with status 1.
+
+	Example:
+	go run lincheck.go -rounds 5 -clients 4 -crashes 1 -jitter 5ms
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"../dfslib"
+	"../harness"
+	lin "../linearizability"
+)
+
+const (
+	checkTimeout = 60000 // bounds the check of each round's history in milliseconds
+	closeOdds    = 10    // defines a 1 in closeOdds chance of closing the file after each operation
+	writerOdds   = 3     // defines a 1 in writerOdds chance of opening the file for writing
+)
+
+type workload struct {
+	clients int
+	ops     int
+	chunks  int
+	crashes int
+	jitter  time.Duration
+}
+
+func main() {
+	rounds := flag.Int("rounds", 3, "clusters to run a workload on")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seeds each round's workload and faults")
+	w := workload{}
+	flag.IntVar(&w.clients, "clients", 3, "clients per round")
+	flag.IntVar(&w.ops, "ops", 100, "reads and writes per client")
+	flag.IntVar(&w.chunks, "chunks", 4, "chunks of the file the clients use")
+	flag.IntVar(&w.crashes, "crashes", 0, "clients killed at random points in each round")
+	flag.DurationVar(&w.jitter, "jitter", 0, "most each delivery between a client and the server is delayed")
+	flag.Parse()
+
+	if w.chunks < 1 || w.chunks > 256 || w.crashes > w.clients {
+		fmt.Fprintln(os.Stderr, "lincheck: -chunks must be 1 to 256 and -crashes at most -clients")
+		os.Exit(2)
+	}
+
+	fmt.Printf("seed %d\n", *seed)
+	for i := 0; i < *rounds; i++ {
+		roundSeed := *seed + int64(i)
+		history, err := w.run(fmt.Sprintf("lincheck%d", i), roundSeed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "round %d: %v\n", i, err)
+			os.Exit(2)
+		}
+
+		start := time.Now()
+		err = lin.Check(history, checkTimeout*time.Millisecond)
+		if _, timedOut := err.(lin.CheckTimeoutError); timedOut {
+			fmt.Printf("round %d: %d operations, check inconclusive: %v\n", i, len(history), err)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("round %d (seed %d): %d operations\n%v\n", i, roundSeed, len(history), err)
+			os.Exit(1)
+		}
+		fmt.Printf("round %d: %d operations, linearizable, checked in %v\n", i, len(history), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+/*
+ Purpose: Runs one round of the workload on a new cluster
+ Params: fname - the file the clients share; seed - seeds the clients, crashes and faults
+ Returns: The recorded history
+ Throws: Any error starting the cluster or opening the file
+*/
+func (w workload) run(fname string, seed int64) ([]lin.Operation, error) {
+	var opts []harness.Option
+	if w.jitter > 0 {
+		opts = append(opts, harness.WithFaults(seed))
+	}
+	c, err := harness.NewCluster(w.clients, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if w.jitter > 0 {
+		for _, client := range c.Clients {
+			c.Network.Link(client.Name(), c.Server.Name()).Delay(0, w.jitter)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	rec := lin.NewRecorder()
+	errs := make([]error, w.clients)
+	var wg sync.WaitGroup
+	for i, client := range c.Clients {
+		wg.Add(1)
+		go func(i int, client *harness.Client, clientSeed int64) {
+			defer wg.Done()
+			errs[i] = w.runClient(i, client, fname, rec, rand.New(rand.NewSource(clientSeed)))
+		}(i, client, rng.Int63())
+	}
+
+	// Each crash strikes a different client, somewhere in its share of the operations
+	for _, i := range rng.Perm(w.clients)[:w.crashes] {
+		wg.Add(1)
+		go func(client *harness.Client, after time.Duration) {
+			defer wg.Done()
+			time.Sleep(after)
+			client.Kill()
+		}(c.Clients[i], time.Duration(rng.Intn(w.ops*10))*time.Millisecond)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rec.History(), nil
+}
+
+/*
+ Purpose: Makes one client's random operations, recording each, until done or killed
+ Params: id - the client's index; client - the client; fname - the shared file;
+         rec - records the history; rng - chooses the operations
+ Returns
+ Throws: Any error opening the file, other than the client having been killed
+*/
+func (w workload) runClient(id int, client *harness.Client, fname string, rec *lin.Recorder, rng *rand.Rand) error {
+	var f *harness.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for i := 0; i < w.ops; i++ {
+		var err error
+		if f == nil {
+			f, err = open(client, fname, rng)
+			if err != nil {
+				if _, down := err.(harness.NodeDownError); down {
+					return nil
+				}
+				return err
+			}
+		}
+
+		chunkNum := uint8(rng.Intn(w.chunks))
+		if f.Mode == dfslib.WRITE && rng.Intn(2) == 0 {
+			chunk := harness.ChunkOf(fmt.Sprintf("client %d write %d", id, i))
+			op := rec.Invoke(id, lin.Write, fname, chunkNum, chunk)
+			err = f.Write(chunkNum, chunk)
+			rec.Complete(op, dfslib.Chunk{}, err)
+		} else {
+			op := rec.Invoke(id, lin.Read, fname, chunkNum, dfslib.Chunk{})
+			var chunk dfslib.Chunk
+			chunk, err = f.Read(chunkNum)
+			rec.Complete(op, chunk, err)
+		}
+		if _, down := err.(harness.NodeDownError); down {
+			f = nil
+			return nil
+		}
+
+		if rng.Intn(closeOdds) == 0 {
+			f.Close()
+			f = nil
+		}
+	}
+	return nil
+}
+
+// open opens fname for writing now and then, or for reading if another client is writing
+func open(client *harness.Client, fname string, rng *rand.Rand) (*harness.File, error) {
+	if rng.Intn(writerOdds) == 0 {
+		f, err := client.Open(fname, dfslib.WRITE, harness.WithReadahead(0))
+		if _, conflict := err.(dfslib.OpenWriteConflictError); !conflict {
+			return f, err
+		}
+	}
+	return client.Open(fname, dfslib.READ, harness.WithReadahead(0))
+}
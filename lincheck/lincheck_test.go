@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	lin "../linearizability"
+)
+
+// TestRound runs a short randomized round with a crash, as lincheck
+// -clients 3 -ops 40 -chunks 2 -crashes 1 would, and fails on a history
+// that is not linearizable
+func TestRound(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a test cluster")
+	}
+
+	w := workload{clients: 3, ops: 40, chunks: 2, crashes: 1}
+	seed := time.Now().UnixNano()
+	history, err := w.run("lincheck", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lin.Check(history, checkTimeout*time.Millisecond)
+	if _, timedOut := err.(lin.CheckTimeoutError); timedOut {
+		t.Skipf("seed %d: %d operations, check inconclusive: %v", seed, len(history), err)
+	}
+	if err != nil {
+		t.Fatalf("seed %d: %d operations\n%v", seed, len(history), err)
+	}
+}
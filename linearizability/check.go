@@ -0,0 +1,264 @@
+package linearizability
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"../dfslib"
+)
+
+// A NotLinearizableError holds the operations on the first chunk found
+// whose history cannot be linearized
+type NotLinearizableError struct {
+	Fname    string
+	ChunkNum uint8
+	Ops      []Operation
+}
+
+func (e NotLinearizableError) Error() string {
+	lines := make([]string, 0, len(e.Ops)+1)
+	lines = append(lines, fmt.Sprintf("linearizability: History of chunk [%d] of file [%s] is not linearizable:", e.ChunkNum, e.Fname))
+	for _, op := range e.Ops {
+		lines = append(lines, "\t"+op.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type CheckTimeoutError string
+
+func (e CheckTimeoutError) Error() string {
+	return fmt.Sprintf("linearizability: Gave up checking chunk [%s] after the timeout", string(e))
+}
+
+type chunkKey struct {
+	fname    string
+	chunkNum uint8
+}
+
+/*
+ Purpose: Checks that a history is linearizable. Each chunk is a register,
+          zero until first written, and independent of the others, so the
+          history of each is checked on its own.
+ Params: history - e.g. from Recorder.History; timeout - bounds the whole check, 0 for none
+ Returns
+ Throws: NotLinearizableError, or CheckTimeoutError if the search ran out of time
+*/
+func Check(history []Operation, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	chunks := make(map[chunkKey][]Operation)
+	var keys []chunkKey
+	for _, op := range history {
+		key := chunkKey{op.Fname, op.ChunkNum}
+		if chunks[key] == nil {
+			keys = append(keys, key)
+		}
+		chunks[key] = append(chunks[key], op)
+	}
+
+	for _, key := range keys {
+		ok, finished := checkRegister(chunks[key], deadline)
+		if !finished {
+			return CheckTimeoutError(fmt.Sprintf("%s:%d", key.fname, key.chunkNum))
+		}
+		if !ok {
+			return NotLinearizableError{Fname: key.fname, ChunkNum: key.chunkNum, Ops: chunks[key]}
+		}
+	}
+	return nil
+}
+
+//==================================================================
+// The search, after Wing and Gong with Lowe's memoization, as in Porcupine
+//==================================================================
+
+// An entry is the call or return of an operation, in a list ordered by time
+type entry struct {
+	id         int // index of the operation
+	op         *Operation
+	isCall     bool
+	match      *entry // a call's return
+	prev, next *entry
+}
+
+type frame struct {
+	call  *entry
+	state dfslib.Chunk
+}
+
+// A linearized set records which operations a partial linearization holds
+type linearized []uint64
+
+func (l linearized) set(id int)        { l[id/64] |= 1 << uint(id%64) }
+func (l linearized) clear(id int)      { l[id/64] &^= 1 << uint(id%64) }
+func (l linearized) clone() linearized { return append(linearized(nil), l...) }
+
+func (l linearized) equals(other linearized) bool {
+	for i := range l {
+		if l[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (l linearized) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range l {
+		h = (h ^ w) * 1099511628211
+	}
+	return h
+}
+
+type cached struct {
+	linearized linearized
+	state      dfslib.Chunk
+}
+
+/*
+ Purpose: Searches for a linearization of one chunk's operations
+ Params: ops - the operations; deadline - when to give up, zero for never
+ Returns: ok - whether one exists; finished - false if the deadline passed first
+ Throws:
+*/
+func checkRegister(ops []Operation, deadline time.Time) (ok bool, finished bool) {
+	head := buildEntries(ops)
+	state := dfslib.Chunk{}
+	done := make(linearized, (len(ops)+63)/64)
+	seen := make(map[uint64][]cached)
+	var stack []frame
+
+	e := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if !deadline.IsZero() && steps%1024 == 0 && time.Now().After(deadline) {
+			return false, false
+		}
+
+		if e.isCall {
+			next, legal := step(state, e.op)
+			if legal {
+				candidate := done.clone()
+				candidate.set(e.id)
+				if !isCached(seen, candidate, next) {
+					h := candidate.hash()
+					seen[h] = append(seen[h], cached{candidate, next})
+					stack = append(stack, frame{e, state})
+					state = next
+					done.set(e.id)
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// An operation returned before any order of those called so far
+		// could include it, so undo the last choice
+		if len(stack) == 0 {
+			return false, true
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		done.clear(top.call.id)
+		unlift(top.call)
+		e = top.call.next
+	}
+	return true, true
+}
+
+// step applies op to a register holding state, reporting whether op could see it
+func step(state dfslib.Chunk, op *Operation) (dfslib.Chunk, bool) {
+	if op.Kind == Write {
+		return op.Value, true
+	}
+	return state, op.Value == state
+}
+
+func isCached(seen map[uint64][]cached, l linearized, state dfslib.Chunk) bool {
+	for _, c := range seen[l.hash()] {
+		if c.state == state && c.linearized.equals(l) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ Purpose: Lists the calls and returns of ops in time order. Pending operations
+          return after everything else, so they may take effect at any point
+          after their call, or in effect never. At equal times calls come
+          first, treating the operations as concurrent.
+ Params: ops - the operations
+ Returns: The sentinel head of the list
+ Throws:
+*/
+func buildEntries(ops []Operation) *entry {
+	entries := make([]*entry, 0, 2*len(ops))
+	for i := range ops {
+		call := &entry{id: i, op: &ops[i], isCall: true}
+		ret := &entry{id: i, op: &ops[i]}
+		call.match = ret
+		entries = append(entries, call, ret)
+	}
+
+	at := func(e *entry) (time.Time, bool) {
+		if e.isCall {
+			return e.op.Call, false
+		}
+		return e.op.Return, e.op.Pending()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		ti, pendingI := at(entries[i])
+		tj, pendingJ := at(entries[j])
+		if pendingI != pendingJ {
+			return pendingJ
+		}
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return entries[i].isCall && !entries[j].isCall
+	})
+
+	head := &entry{}
+	prev := head
+	for _, e := range entries {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+	return head
+}
+
+// lift removes a call and its return from the list
+func lift(call *entry) {
+	call.prev.next = call.next
+	if call.next != nil {
+		call.next.prev = call.prev
+	}
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// unlift puts back a call and its return removed by lift
+func unlift(call *entry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	if call.next != nil {
+		call.next.prev = call
+	}
+}
@@ -0,0 +1,71 @@
+package linearizability
+
+import (
+	"testing"
+	"time"
+
+	"../dfslib"
+)
+
+// op builds an operation that was called at call and returned at ret,
+// in milliseconds from a fixed start, or is pending if ret is negative
+func op(client int, kind Kind, value string, call, ret int) Operation {
+	start := time.Unix(0, 0)
+	var chunk dfslib.Chunk
+	copy(chunk[:], value)
+
+	o := Operation{Client: client, Kind: kind, Fname: "f", ChunkNum: 0, Value: chunk,
+		Call: start.Add(time.Duration(call) * time.Millisecond)}
+	if ret >= 0 {
+		o.Return = start.Add(time.Duration(ret) * time.Millisecond)
+	}
+	return o
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []Operation
+		ok      bool
+	}{
+		{"read of the initial zero chunk", []Operation{
+			op(0, Read, "", 0, 1),
+		}, true},
+		{"read overlapping a write sees either value", []Operation{
+			op(0, Write, "a", 0, 10),
+			op(1, Read, "", 1, 2),
+			op(2, Read, "a", 3, 4),
+		}, true},
+		{"stale read after a write returned", []Operation{
+			op(0, Write, "a", 0, 1),
+			op(1, Read, "", 2, 3),
+		}, false},
+		{"reads going back in time", []Operation{
+			op(0, Write, "a", 0, 1),
+			op(0, Write, "b", 2, 10),
+			op(1, Read, "b", 3, 4),
+			op(2, Read, "a", 5, 6),
+		}, false},
+		{"pending write may have taken effect", []Operation{
+			op(0, Write, "a", 0, -1),
+			op(1, Read, "a", 5, 6),
+		}, true},
+		{"pending write may not have taken effect", []Operation{
+			op(0, Write, "a", 0, -1),
+			op(1, Read, "", 5, 6),
+		}, true},
+		{"value never written", []Operation{
+			op(1, Read, "x", 0, 1),
+		}, false},
+	}
+
+	for _, test := range tests {
+		err := Check(test.history, time.Second)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if _, violation := err.(NotLinearizableError); !test.ok && !violation {
+			t.Errorf("%s: got %v, want NotLinearizableError", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Package linearizability records the history of chunk reads and writes
+// made by dfs clients, and checks that it is linearizable: that every
+// operation appears to take effect at one instant between its call and
+// its return, as the READ and WRITE modes promise
+package linearizability
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"../dfslib"
+)
+
+type Kind int
+
+const (
+	Read Kind = iota
+	Write
+)
+
+func (k Kind) String() string {
+	if k == Write {
+		return "Write"
+	}
+	return "Read"
+}
+
+// An Operation is one read or write of a chunk, as its client saw it
+type Operation struct {
+	Client   int
+	Kind     Kind
+	Fname    string
+	ChunkNum uint8
+	Value    dfslib.Chunk // the chunk written, or read
+	Call     time.Time
+	Return   time.Time // zero for a write that failed, which may or may not have taken effect
+}
+
+// Pending reports whether the operation's outcome is unknown
+func (op Operation) Pending() bool {
+	return op.Return.IsZero()
+}
+
+func (op Operation) String() string {
+	end := "pending"
+	if !op.Pending() {
+		end = op.Return.Format("15:04:05.000000")
+	}
+	return fmt.Sprintf("client %d %s(%s, %d) %q [%s, %s]", op.Client, op.Kind, op.Fname, op.ChunkNum,
+		trimChunk(op.Value), op.Call.Format("15:04:05.000000"), end)
+}
+
+// trimChunk drops a chunk's trailing zeros, for printing
+func trimChunk(c dfslib.Chunk) string {
+	n := len(c)
+	for n > 0 && c[n-1] == 0 {
+		n--
+	}
+	return string(c[:n])
+}
+
+// A Recorder collects a history from many clients at once
+type Recorder struct {
+	lock sync.Mutex
+	ops  []Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+/*
+ Purpose: Records the call of an operation, just before it is made
+ Params: client - identifies the caller; kind - Read or Write; fname, chunkNum - the chunk;
+         value - the chunk being written, ignored for a read
+ Returns: An id to pass to Complete
+ Throws:
+*/
+func (r *Recorder) Invoke(client int, kind Kind, fname string, chunkNum uint8, value dfslib.Chunk) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.ops = append(r.ops, Operation{Client: client, Kind: kind, Fname: fname, ChunkNum: chunkNum, Value: value,
+		Call: time.Now()})
+	return len(r.ops) - 1
+}
+
+/*
+ Purpose: Records the return of an operation. A failed read tells nothing and is
+          dropped; a failed write, including one cut short by its client crashing,
+          stays pending, since it may still have taken effect.
+ Params: id - from Invoke; value - the chunk read, ignored for a write; err - the operation's error
+ Returns
+ Throws:
+*/
+func (r *Recorder) Complete(id int, value dfslib.Chunk, err error) {
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err != nil {
+		return
+	}
+	if r.ops[id].Kind == Read {
+		r.ops[id].Value = value
+	}
+	r.ops[id].Return = now
+}
+
+// History returns the operations recorded so far. Reads that failed or
+// have not returned are left out; such writes are pending.
+func (r *Recorder) History() []Operation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	history := make([]Operation, 0, len(r.ops))
+	for _, op := range r.ops {
+		if op.Kind == Read && op.Pending() {
+			continue
+		}
+		history = append(history, op)
+	}
+	return history
+}
+
+// Wrap returns f, opened on fname by client, recording each Read and Write
+func (r *Recorder) Wrap(client int, fname string, f dfslib.DFSFile) dfslib.DFSFile {
+	return recordedFile{DFSFile: f, recorder: r, client: client, fname: fname}
+}
+
+type recordedFile struct {
+	dfslib.DFSFile
+	recorder *Recorder
+	client   int
+	fname    string
+}
+
+func (f recordedFile) Read(chunkNum uint8, chunk *dfslib.Chunk) error {
+	return f.ReadContext(context.Background(), chunkNum, chunk)
+}
+
+func (f recordedFile) ReadContext(ctx context.Context, chunkNum uint8, chunk *dfslib.Chunk) error {
+	id := f.recorder.Invoke(f.client, Read, f.fname, chunkNum, dfslib.Chunk{})
+	err := f.DFSFile.ReadContext(ctx, chunkNum, chunk)
+	f.recorder.Complete(id, *chunk, err)
+	return err
+}
+
+func (f recordedFile) Write(chunkNum uint8, chunk *dfslib.Chunk) error {
+	return f.WriteContext(context.Background(), chunkNum, chunk)
+}
+
+func (f recordedFile) WriteContext(ctx context.Context, chunkNum uint8, chunk *dfslib.Chunk) error {
+	id := f.recorder.Invoke(f.client, Write, f.fname, chunkNum, *chunk)
+	err := f.DFSFile.WriteContext(ctx, chunkNum, chunk)
+	f.recorder.Complete(id, dfslib.Chunk{}, err)
+	return err
+}
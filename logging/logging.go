@@ -0,0 +1,208 @@
+// Package logging defines the leveled, structured logger used by the
+// server and dfslib, with silent, text and JSON implementations
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+/*
+ Purpose: Parses a level name as accepted on the command line
+ Params: name - one of debug, info, warn or error
+ Returns: The level
+ Throws: An error for an unknown name
+*/
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(l), nil
+		}
+	}
+	return Debug, fmt.Errorf("unknown log level [%s]", name)
+}
+
+// Keys of the fields shared by the server and dfslib
+const (
+	KeyUser    = "user"
+	KeyFile    = "file"
+	KeyChunk   = "chunk"
+	KeyVersion = "version"
+	KeyMethod  = "method"
+	KeyLatency = "latency"
+	KeyError   = "error"
+)
+
+// A Field is a key and value attached to a log entry. Fields with a nil
+// Value are omitted, so an error may be passed whether or not it is set.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// A Logger records messages with a level and structured fields.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...Field) {}
+
+// Nop returns a Logger that discards everything
+func Nop() Logger {
+	return nopLogger{}
+}
+
+type writerLogger struct {
+	lock   sync.Mutex
+	w      io.Writer
+	min    Level
+	prefix string // prepended to text messages, e.g. "server: "
+	json   bool
+}
+
+/*
+ Purpose: Creates a logger writing one human readable line per entry
+ Params: w - the destination; min - entries below this level are dropped; prefix - prepended to each message
+ Returns: e.g. "server: Received heartbeat user=127.0.0.1:3010 @ ../tmp/"
+ Throws:
+*/
+func NewText(w io.Writer, min Level, prefix string) Logger {
+	return &writerLogger{w: w, min: min, prefix: prefix}
+}
+
+/*
+ Purpose: Creates a logger writing one JSON object per entry
+ Params: w - the destination; min - entries below this level are dropped
+ Returns: e.g. {"time":"...","level":"info","msg":"Received heartbeat","user":"..."}
+ Throws:
+*/
+func NewJSON(w io.Writer, min Level) Logger {
+	return &writerLogger{w: w, min: min, json: true}
+}
+
+func (l *writerLogger) Log(level Level, msg string, fields ...Field) {
+	if level < l.min {
+		return
+	}
+
+	var line []byte
+	if l.json {
+		line = encodeJSON(level, msg, fields)
+	} else {
+		line = encodeText(l.prefix, level, msg, fields)
+	}
+
+	l.lock.Lock()
+	l.w.Write(line)
+	l.lock.Unlock()
+}
+
+func encodeText(prefix string, level Level, msg string, fields []Field) []byte {
+	var b strings.Builder
+	b.WriteString(prefix)
+	if level != Info {
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteString(" ")
+	}
+	b.WriteString(msg)
+	for _, f := range fields {
+		if f.Value == nil {
+			continue
+		}
+		value := formatValue(f.Value)
+		if strings.ContainsAny(value, " \t\n\"") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", f.Key, value)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+/*
+ Purpose: Encodes an entry as a single line JSON object, keeping field order
+ Params: level, msg, fields - the entry
+ Returns
+ Throws:
+*/
+func encodeJSON(level Level, msg string, fields []Field) []byte {
+	var b strings.Builder
+	b.WriteString("{")
+	writeJSONPair(&b, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(",")
+	writeJSONPair(&b, "level", level.String())
+	b.WriteString(",")
+	writeJSONPair(&b, "msg", msg)
+	for _, f := range fields {
+		if f.Value == nil {
+			continue
+		}
+		b.WriteString(",")
+		writeJSONPair(&b, f.Key, jsonValue(f.Value))
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+func writeJSONPair(b *strings.Builder, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(k)
+	b.WriteString(":")
+	b.Write(v)
+}
+
+// jsonValue keeps numbers and booleans as JSON values and formats
+// everything else, such as users and errors, as strings
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool, string:
+		return v
+	case time.Duration:
+		return v.Seconds()
+	}
+	return formatValue(v)
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,258 @@
+// Package metrics implements counters and histograms exported in the
+// Prometheus text exposition format, shared by the server and dfslib
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are upper bounds in seconds suited to RPC latencies
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Registry holds metrics and serves them over HTTP
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// A Counter is a monotonically increasing value per combination of labels
+type Counter struct {
+	lock       sync.Mutex
+	name, help string
+	labelNames []string
+	values     map[string]float64 // by encoded label values
+}
+
+// A Histogram counts observations into cumulative buckets per combination of labels
+type Histogram struct {
+	lock       sync.Mutex
+	name, help string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*histogramSeries // by encoded label values
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+/*
+ Purpose: Creates and registers a counter
+ Params: name, help - as exported; labelNames - labels each increment must supply values for
+ Returns
+ Throws:
+*/
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+	if len(labelNames) == 0 {
+		c.values[""] = 0 // export 0 before the first increment
+	}
+	r.register(c)
+	return c
+}
+
+/*
+ Purpose: Creates and registers a histogram
+ Params: name, help - as exported; buckets - ascending upper bounds; labelNames - as for NewCounter
+ Returns
+ Throws:
+*/
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labelNames: labelNames, buckets: buckets,
+		series: make(map[string]*histogramSeries)}
+	if len(labelNames) == 0 {
+		h.series[""] = &histogramSeries{counts: make([]uint64, len(buckets))}
+	}
+	r.register(h)
+	return h
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+/*
+ Purpose: Writes every metric in the Prometheus text format
+ Params: w - the destination
+ Returns
+ Throws: Any write error
+*/
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics, so a Registry can be mounted at /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+/*
+ Purpose: Serves the registry at /metrics on addr until the listener fails
+ Params: addr - the ip:port to listen on
+ Returns
+ Throws: Any error listening or from the HTTP server
+*/
+func (r *Registry) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return r.Serve(l)
+}
+
+/*
+ Purpose: Serves the registry at /metrics on an existing listener until it fails
+ Params: l - the listener, e.g. one bound before serving so bind errors can be reported
+ Returns
+ Throws: Any error from the HTTP server
+*/
+func (r *Registry) Serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	return http.Serve(l, mux)
+}
+
+// Inc adds one to the counter for the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the given label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := encodeLabels(c.labelNames, labelValues)
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, braces(key), formatFloat(c.values[key]))
+	}
+}
+
+// Observe records v for the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := encodeLabels(h.labelNames, labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(joinLabels(key, `le="`+formatFloat(bound)+`"`)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(joinLabels(key, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braces(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(key), s.count)
+	}
+}
+
+/*
+ Purpose: Encodes label values as the body of a Prometheus label set
+ Params: names - the label names; values - one value per name, missing values are empty
+ Returns: e.g. method="ReadFile",outcome="ok"
+ Throws:
+*/
+func encodeLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + escaper.Replace(value) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -1,23 +1,125 @@
 /*
 	Usage:
-	go run server.go [server ip:port]
+	go run server.go [-cert file -key file -ca file] [-groups file] [-quotas file]
+	                 [-admins names | -insecure-admin] [-metrics ip:port]
+	                 [-log-format text|json] [-log-level level]
+	                 [-trace-file file | -trace-endpoint url] [-hedge-percentile p]
+	                 [-client-timeout duration] [-proxy ip:port [-node name]] [-fake-clock]
+	                 [-heartbeat-interval duration] [-missed-beats n] [-suspicion-timeout duration]
+	                 [-detector fixed|phi [-phi-threshold phi]]
+	                 [server ip:port]
 
 	Example:
 	go run server.go 127.0.0.1:3000
+	go run server.go -cert server.crt -key server.key -ca ca.crt 127.0.0.1:3000
+
+	When -cert, -key and -ca are given, clients must connect over mutual TLS
+	and are identified by the common name of their certificate. The server
+	certificate must be valid for both server and client authentication since
+	it is also presented when dialing back to clients.
+
+	The optional -groups file is a JSON object mapping group names to the
+	principals in each group, e.g. {"devs": ["alice", "bob"]}. ACL entries
+	of the form "group:devs" then apply to every member.
+
+	The optional -quotas file is a JSON object limiting the bytes of chunk
+	data stored per file owner and per namespace, e.g.
+	{"Users": {"alice": 8192, "*": 4096}, "Namespaces": {"proj": 16384}}.
+	"*" applies to owners not listed. A file belongs to the namespace that is
+	the longest prefix of its name.
+
+	-admins is a comma separated list of principals allowed to call the
+	Admin RPCs. Without TLS there are no principals, so the Admin RPCs are
+	refused unless -insecure-admin is given, which lets any caller use them.
+
+	-metrics serves Prometheus metrics over HTTP at ip:port/metrics.
+
+	-log-format selects human readable text (the default) or one JSON object
+	per line. -log-level is debug, info (the default), warn or error;
+	heartbeats and per-RPC entries are logged at debug.
+
+	-trace-file appends spans as OTLP JSON, one export request per line.
+	-trace-endpoint posts them to an OpenTelemetry collector instead, e.g.
+	http://127.0.0.1:4318/v1/traces.
+
+	-hedge-percentile sets when a read that must fetch a chunk asks another
+	owner: once the first has taken longer than this percentile of recent
+	fetches, or failed. Owners with lower average latency are asked first.
+	It defaults to 95; 0 asks every owner at once.
+
+	-client-timeout bounds each call the server makes to a client, such as
+	fetching a chunk from one owner, e.g. 500ms. It defaults to 2s. A read
+	whose caller set a deadline also stops trying owners at that deadline.
+
+	-proxy routes the server's connections to clients through a
+	transport.Proxy, which tests use to inject faults. -node names the
+	server to the proxy and defaults to "server".
+
+	-heartbeat-interval sets how often clients send heartbeats, 2.5s by
+	default. A client may ask for another interval, from 100ms to 1m, when
+	it registers; the server then expects heartbeats at that interval.
+
+	-detector chooses how the server decides that a client has failed. The
+	default, fixed, suspects a client once it has missed -missed-beats
+	heartbeats in a row, 2 by default. phi suspects a client once the time
+	since its last heartbeat is unlikely enough, given the gaps between its
+	recent heartbeats: phi is -log10 of the chance that a heartbeat still
+	arrives, and -phi-threshold, 8 by default, is the level at which it
+	suspects. phi adapts to networks whose delays vary. A suspected client
+	that stays silent for -suspicion-timeout, 0 by default, is reaped.
+
+	-fake-clock runs heartbeat deadlines and write locks on a clock that
+	stands still until advanced with the ClockRPC.Advance RPC, so tests
+	decide exactly when a client misses its heartbeat and is reaped.
 */
 package main
 
 import (
+	"container/heap"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
 	rpc "net/rpc"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"../clock"
+	"../logging"
+	"../metrics"
+	"../tracing"
+	"../transport"
 )
 
 const (
-	hbInterval = 5000 // defines heartbeat interval in milliseconds
+	minHeartbeat      = 100   // defines the shortest heartbeat interval a client may ask for in milliseconds
+	maxHeartbeat      = 60000 // defines the longest heartbeat interval a client may ask for in milliseconds
+	phiWindow         = 100   // defines the gaps between heartbeats the phi detector keeps per user
+	phiMinDeviation   = 0.25  // defines the least standard deviation of heartbeat gaps the phi detector assumes, as a fraction of the interval
+	scrubInterval     = 30000 // defines time between scrubber passes in milliseconds
+	scrubCallInterval = 100   // defines minimum time between scrubber RPCs to clients in milliseconds
+	replicationFactor = 2     // defines the number of owners the scrubber maintains per chunk version
+	chunkSize         = 32    // defines the bytes stored per chunk
+	sealedChunkSize   = 60    // defines the bytes stored per encrypted chunk
+	latencySamples    = 128   // defines the number of recent owner fetch latencies kept for hedging
+	latencyWeight     = 0.2   // defines the weight of each new sample in an owner's average fetch latency
+	minHedgeDelay     = 5     // defines the minimum wait in milliseconds before hedging a fetch
+	grantLifetime     = 30000 // defines how long a grant to fetch a chunk from peers is valid in milliseconds
 )
 
 type Chunk [32]byte
@@ -31,31 +133,100 @@ const (
 	DREAD FileMode = 3
 )
 
+type Permission int
+
+// Permissions granted by an ACL entry are a combination of the below
+const (
+	PermRead  Permission = 1
+	PermWrite Permission = 2
+	PermAdmin Permission = 4
+)
+
+const (
+	anyPrincipal = "*"      // ACL entry that applies to every principal
+	groupPrefix  = "group:" // ACL entries with this prefix name a group
+)
+
 var (
 	ipPort          string
 	files           map[string]*FileState            // Assumption: global namespace, all file names are unique
 	filesOpened     map[UserInfo]map[string]FileMode // Assumption: files cannot be deleted after opening
 	clientConns     map[UserInfo]*rpc.Client
+	multiplexed     map[UserInfo]bool // users whose clientConns stream over their own connection, so peers cannot reach them
 	registeredUsers []UserInfo
-	lastHeartBeat   map[UserInfo]time.Time
+	sessions        map[string]*session           // current session of each registered principal
+	reaperQueue     sessionHeap                   // every session, by when the reaper next checks it
+	reaperKick      = make(chan chan struct{}, 1) // wakes the reaper early, closing any channel sent once it has checked
+	principals      map[UserInfo]string           // identity each registered user is bound to, which keys its session
+	groups          map[string][]string           // principals in each group, loaded at startup
+	admins          []string                      // principals allowed to call the Admin RPCs
+	insecureAdmin   bool                          // without TLS, lets any caller use the Admin RPCs
+	quotas          QuotaConfig
+	ownerUsage      map[string]int64      // bytes of chunk data stored, by file owner
+	namespaceUsage  map[string]int64      // bytes of chunk data stored, by namespace
+	watchers        map[string][]UserInfo // users notified of changes, by file name
+	stateLock       sync.Mutex            // guards all server metadata above
+	tlsConfig       *tls.Config           // nil unless the server runs over mutual TLS
+	network         transport.Network     // accepts clients and dials back to them
+	clk             clock.Clock           // times heartbeats and write locks
+	fakeClock       *clock.Fake           // clk under -fake-clock, advanced by ClockRPC
+	logger          logging.Logger
+	tracer          *tracing.Tracer // nil unless -trace-file or -trace-endpoint is given
+	clientTimeout   time.Duration   // bound on each call to a client
+	hedgePercentile float64         // of recent fetch latencies after which another owner is asked, or 0
+	lastGeneration  uint64          // generation of the file created last; guarded by stateLock
+
+	heartbeatInterval time.Duration   // how often clients heartbeat unless they ask for another interval
+	suspicionTimeout  time.Duration   // how long a suspected user may stay silent before it is reaped
+	detector          failureDetector // decides when a user is suspected
+
+	ownerLatency    map[UserInfo]time.Duration // moving average of each owner's chunk fetch latency
+	recentLatencies [latencySamples]time.Duration
+	numLatencies    int        // samples recorded in recentLatencies, which wraps around
+	latencyLock     sync.Mutex // guards the latency state above, independently of stateLock
+
+	serverMetrics  = metrics.NewRegistry()
+	rpcRequests    = serverMetrics.NewCounter("dfs_server_rpc_requests_total", "ServerRPC calls by method and outcome.", "method", "outcome")
+	rpcDuration    = serverMetrics.NewHistogram("dfs_server_rpc_duration_seconds", "ServerRPC latency by method.", metrics.DefaultBuckets, "method")
+	fetchAttempts  = serverMetrics.NewCounter("dfs_server_chunk_fetch_attempts_total", "Calls to owners' ClientRPC.RetrieveLatestChunk by outcome.", "outcome")
+	batchFetches   = serverMetrics.NewCounter("dfs_server_chunk_batch_fetches_total", "Chunks requested from owners' ClientRPC.RetrieveLatestChunks by outcome.", "outcome")
+	fetchHedges    = serverMetrics.NewCounter("dfs_server_chunk_fetch_hedges_total", "Owners asked for a chunk because earlier owners were slow rather than failed.")
+	directReads    = serverMetrics.NewCounter("dfs_server_direct_reads_total", "Stale reads answered with owners for the reader to fetch from itself.")
+	fetchFanout    = serverMetrics.NewHistogram("dfs_server_chunk_fetch_fanout", "Owners tried per stale read before one served the chunk.", []float64{1, 2, 3, 4, 6, 8, 12, 16}, "outcome")
+	heartbeats     = serverMetrics.NewCounter("dfs_server_heartbeats_total", "Heartbeats received from registered users.")
+	reapedClients  = serverMetrics.NewCounter("dfs_server_reaped_clients_total", "Users disconnected for a late or missed heartbeat.")
+	suspectedUsers = serverMetrics.NewCounter("dfs_server_suspected_users_total", "Users the failure detector began to suspect, whether later reaped or not.")
+	writeLockHeld  = serverMetrics.NewHistogram("dfs_server_write_lock_held_seconds", "Time a write lock was held before release.", []float64{.1, 1, 5, 10, 30, 60, 300, 900, 3600})
+	writeLockWait  = serverMetrics.NewHistogram("dfs_server_write_lock_wait_seconds", "Time a WRITE open waited for the server's state before it was granted or refused the write lock.", metrics.DefaultBuckets, "outcome")
+	writeConflicts = serverMetrics.NewCounter("dfs_server_write_lock_conflicts_total", "WRITE opens rejected because another user held the write lock.")
 )
 
 type FileInfo struct {
-	User  UserInfo
-	Name  string
-	Fmode FileMode
+	User   UserInfo
+	Name   string
+	Fmode  FileMode
+	Sealed bool // chunks are encrypted by clients and stored in sealed slots
+	Trace  tracing.SpanContext
 }
 
 type FileState struct {
 	fileExists       bool
+	sealed           bool                  // chunks are opaque ciphertext; fixed when the file is created
+	owner            string                // principal that created the file; holds every permission
+	namespace        string                // longest quota namespace prefixing the file name
+	acl              map[string]Permission // permissions by principal, group, or anyPrincipal
 	isLockedForWrite bool
+	writer           UserInfo  // holder of writeAccess while isLockedForWrite
+	lockedAt         time.Time // when writer acquired writeAccess
 	writeAccess      *sync.Mutex
 	chunkVersion     []*FileVersionOwners // All chunks initialized at version 0; each write increments by 1
+	generation       uint64               // tells the file from earlier files removed under its name
 }
 
 type FileVersionOwners struct {
-	version int
-	owners  []UserInfo
+	version  int
+	checksum [sha256.Size]byte // checksum of the chunk contents at this version
+	owners   []UserInfo
 }
 
 type UserInfo struct {
@@ -63,10 +234,54 @@ type UserInfo struct {
 	LocalPath string
 }
 
+// A RegisterInfo registers User, which asks to heartbeat every
+// HeartbeatInterval, or at the server's interval if 0
+type RegisterInfo struct {
+	User              UserInfo
+	HeartbeatInterval time.Duration
+}
+
+// A RegisterValue holds the user's new session, whose ID its heartbeats
+// must carry, and the heartbeat interval the server expects of it
+type RegisterValue struct {
+	Session           string
+	HeartbeatInterval time.Duration
+}
+
+// A HeartbeatInfo keeps User's session alive
+type HeartbeatInfo struct {
+	User    UserInfo
+	Session string
+}
+
+func (u UserInfo) String() string {
+	return u.LocalIP + " @ " + u.LocalPath
+}
+
 type WriteInfo struct {
 	User     UserInfo
 	Fname    string
 	ChunkNum uint8
+	Checksum [sha256.Size]byte
+	Version  int // for sealed files, the version the ciphertext is bound to; 0 for the next
+	Trace    tracing.SpanContext
+}
+
+type WriteValue struct {
+	GlobalChunkVer int
+}
+
+type WriteChunksInfo struct {
+	User      UserInfo
+	Fname     string
+	ChunkNums []uint8
+	Checksums [][sha256.Size]byte // of the bytes stored for each of ChunkNums
+	Versions  []int               // as WriteInfo.Version for each of ChunkNums, or nil
+	Trace     tracing.SpanContext
+}
+
+type WriteChunksValue struct {
+	GlobalChunkVers []int
 }
 
 type ReadInfo struct {
@@ -74,294 +289,2369 @@ type ReadInfo struct {
 	Fname         string
 	ChunkNum      uint8
 	LocalChunkVer int
+	Sealed        bool
+	Trace         tracing.SpanContext
+	Deadline      time.Time // zero unless the reader set a deadline
+	Direct        bool      // the reader fetches from owners itself when given Peers
+}
+
+type ReadChunksInfo struct {
+	User           UserInfo
+	Fname          string
+	ChunkNums      []uint8
+	LocalChunkVers []int // the reader's cached version of each of ChunkNums
+	Sealed         bool
+	Trace          tracing.SpanContext
+	Deadline       time.Time
+	Direct         bool
+}
+
+type ReadChunksValue struct {
+	Chunks []ReadValue
 }
 
+// Chunk contents are relayed as the bytes a client stores for the
+// chunk, which the server never interprets. For a Direct read the
+// server instead returns the owners to fetch from, fastest first, and
+// the checksum the fetched bytes must match.
 type ReadValue struct {
-	Chnk           Chunk
+	Data           []byte
 	IsNew          bool
-	globalChunkVer int
+	GlobalChunkVer int
+	Peers          []UserInfo
+	Checksum       [sha256.Size]byte
+	Grant          ChunkGrant
+	Unavailable    bool // set by ReadChunks for a chunk whose latest version no owner could serve
+}
+
+// A ChunkGrant, signed with the server's TLS key, lets Reader fetch a
+// chunk version from its owners until Expires. Without TLS it is unsigned.
+type ChunkGrant struct {
+	Reader    string
+	Fname     string
+	ChunkNum  uint8
+	Version   int
+	Expires   time.Time
+	Algorithm x509.SignatureAlgorithm
+	Signature []byte
+}
+
+// A ChunkReceipt reports that User fetched a chunk version from Owner
+// directly, taking Latency
+type ChunkReceipt struct {
+	User     UserInfo
+	Fname    string
+	ChunkNum uint8
+	Version  int
+	Owner    UserInfo
+	Latency  time.Duration
+	Trace    tracing.SpanContext
+}
+
+type VerifyInfo struct {
+	Fname    string
+	ChunkNum uint8
+	Sealed   bool
+	Trace    tracing.SpanContext
+}
+
+type VerifyValue struct {
+	Present  bool
+	Version  int
+	Checksum [sha256.Size]byte
+}
+
+type ReplicaInfo struct {
+	Fname      string
+	Generation uint64
+	ChunkNum   uint8
+	Version    int
+	Sealed     bool
+	Data       []byte
+	Trace      tracing.SpanContext
+}
+
+// A ServerRPC serves a single client connection. Over mutual TLS,
+// principal is the common name of the client's certificate.
+type ServerRPC struct {
+	principal string
+	session   *transport.Session // the client's connection, when it carries our calls back to the client too
+}
+
+type ACL struct {
+	Owner   string
+	Entries map[string]Permission
+}
+
+type ACLInfo struct {
+	User  UserInfo
+	Fname string
+	ACL   ACL
+}
+
+// Byte limits; a limit of 0 or a missing entry means unlimited
+type QuotaConfig struct {
+	Users      map[string]int64 // by file owner principal, or anyPrincipal
+	Namespaces map[string]int64 // by file name prefix
+}
+
+type Usage struct {
+	Name  string
+	Bytes int64
+	Limit int64
+}
+
+type UsageReport struct {
+	Users      []Usage
+	Namespaces []Usage
+}
+
+type UserStatus struct {
+	User          UserInfo
+	Principal     string
+	LastHeartbeat time.Time
+	Suspected     bool // the failure detector judges the user's heartbeat late
+	Connected     bool // the server holds a reverse RPC connection to the user
+}
+
+type OpenStatus struct {
+	User  UserInfo
+	Fmode FileMode
+}
+
+type ChunkStatus struct {
+	ChunkNum uint8
+	Version  int
+	Owners   []UserInfo
+}
+
+type FileStatus struct {
+	Name             string
+	Owner            string
+	IsLockedForWrite bool
+	Writer           UserInfo
+	OpenedBy         []OpenStatus
+	Chunks           []ChunkStatus // written chunks only
+}
+
+type AdminInfo struct {
+	User  UserInfo
+	Fname string
+}
+
+type FileStat struct {
+	Name             string
+	Owner            string
+	Sealed           bool
+	IsLockedForWrite bool
+	Versions         [256]int
+	Owners           [256]int // connected clients holding each chunk's latest version
+}
+
+// A FileEvent is pushed to watchers when a chunk is written or the file is removed,
+// and when a departed user's session leaves the file unlocked or a chunk unavailable
+type FileEvent struct {
+	Fname       string
+	ChunkNum    uint8
+	Version     int
+	Removed     bool
+	Released    bool // the writer's session ended, releasing the write lock
+	Unavailable bool // the only owners of the chunk's latest version have gone
 }
 
-type ServerRPC int
+// A RegisterFileValue holds the generation of the file opened, which changes
+// when the file is removed and created again, so that clients drop the
+// chunks they cached of the earlier file
+type RegisterFileValue struct {
+	Generation uint64
+}
 
 type ServerInterface interface {
 	Ping(stub int, reply *bool) (err error)
-	Register(user UserInfo, reply *bool) (err error)
+	Register(ri RegisterInfo, rv *RegisterValue) (err error)
 	Unregister(user UserInfo, reply *bool) (err error)
-	SendHeartbeat(user UserInfo, reply *bool) (err error)
+	SendHeartbeat(hi HeartbeatInfo, reply *bool) (err error)
 	EstablishReverseRPC(user UserInfo, reply *bool) (err error)
 	FileExists(fname string, reply *bool) (err error)
-	RegisterFile(fi FileInfo, reply *bool) (err error)
-	WriteFile(wi WriteInfo, reply *bool) (err error)
+	RegisterFile(fi FileInfo, rv *RegisterFileValue) (err error)
+	WriteFile(wi WriteInfo, wv *WriteValue) (err error)
 	ReadFile(ri ReadInfo, rv *ReadValue) (err error)
 	CloseFile(fi FileInfo, reply *bool) (err error)
+	SetACL(ai ACLInfo, reply *bool) (err error)
+	GetACL(ai ACLInfo, acl *ACL) (err error)
+	Usage(user UserInfo, usage *Usage) (err error)
+	AdminUsage(stub int, report *UsageReport) (err error)
+	ListFiles(user UserInfo, fnames *[]string) (err error)
+	StatFile(fi FileInfo, stat *FileStat) (err error)
+	RemoveFile(fi FileInfo, reply *bool) (err error)
+	WatchFile(fi FileInfo, reply *bool) (err error)
+	AdminListUsers(stub int, users *[]UserStatus) (err error)
+	AdminListFiles(stub int, fileStatuses *[]FileStatus) (err error)
+	AdminCloseFile(ai AdminInfo, reply *bool) (err error)
+	AdminRevokeWriteLock(fname string, reply *bool) (err error)
+	AdminEvictUser(user UserInfo, reply *bool) (err error)
 }
 
 func main() {
-	args := os.Args[1:]
-	fmt.Println("args: ", args)
+	certFile := flag.String("cert", "", "server certificate for mutual TLS")
+	keyFile := flag.String("key", "", "server private key for mutual TLS")
+	caFile := flag.String("ca", "", "certificate authority that signs client certificates")
+	groupsFile := flag.String("groups", "", "JSON file mapping group names to principals")
+	quotasFile := flag.String("quotas", "", "JSON file of byte limits per owner and namespace")
+	adminList := flag.String("admins", "", "comma separated principals allowed to call Admin RPCs")
+	flag.BoolVar(&insecureAdmin, "insecure-admin", false, "without TLS, let any caller use the Admin RPCs")
+	metricsAddr := flag.String("metrics", "", "address to serve Prometheus metrics on")
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	logLevel := flag.String("log-level", "info", "minimum level logged: debug, info, warn or error")
+	traceFile := flag.String("trace-file", "", "file to append OTLP JSON spans to")
+	traceEndpoint := flag.String("trace-endpoint", "", "OTLP/HTTP traces URL of an OpenTelemetry collector")
+	flag.DurationVar(&clientTimeout, "client-timeout", 2*time.Second, "bound on each call to a client, such as a chunk fetch from one owner")
+	flag.Float64Var(&hedgePercentile, "hedge-percentile", 95, "percentile of recent fetch latencies after which another owner is asked; 0 asks all at once")
+	proxyAddr := flag.String("proxy", "", "fault-injection proxy to dial clients through, for tests")
+	nodeName := flag.String("node", "server", "name of this server to the -proxy")
+	useFakeClock := flag.Bool("fake-clock", false, "run heartbeats and write locks on a clock advanced by ClockRPC, for tests")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", 2500*time.Millisecond, "how often clients send heartbeats, unless they ask for another interval")
+	missedBeats := flag.Int("missed-beats", 2, "heartbeats in a row a user may miss before -detector fixed suspects it")
+	flag.DurationVar(&suspicionTimeout, "suspicion-timeout", 0, "how long a suspected user may stay silent before it is reaped")
+	detectorName := flag.String("detector", "fixed", "failure detector, fixed or phi")
+	phiThreshold := flag.Float64("phi-threshold", 8, "suspicion level at which -detector phi suspects a user")
+	flag.Parse()
+
+	network = transport.TCP{}
+	if *proxyAddr != "" {
+		network = transport.ViaProxy(*proxyAddr, *nodeName)
+	}
+
+	clk = clock.Real{}
+	if *useFakeClock {
+		fakeClock = clock.NewFake(time.Now())
+		clk = fakeClock
+	}
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Printf("server: %s\n", err.Error())
+		os.Exit(0)
+	}
+	if heartbeatInterval < minHeartbeat*time.Millisecond || heartbeatInterval > maxHeartbeat*time.Millisecond {
+		fmt.Printf("server: Heartbeat interval [%v] must be from %v to %v\n", heartbeatInterval,
+			minHeartbeat*time.Millisecond, maxHeartbeat*time.Millisecond)
+		os.Exit(0)
+	}
+	switch *detectorName {
+	case "fixed":
+		if *missedBeats < 1 {
+			fmt.Printf("server: Missed beats [%d] must be at least 1\n", *missedBeats)
+			os.Exit(0)
+		}
+		detector = missedBeatsDetector(*missedBeats)
+	case "phi":
+		detector = phiDetector(*phiThreshold)
+	default:
+		fmt.Printf("server: Unknown failure detector [%s]\n", *detectorName)
+		os.Exit(0)
+	}
+
+	switch *logFormat {
+	case "text":
+		logger = logging.NewText(os.Stdout, level, "server: ")
+	case "json":
+		logger = logging.NewJSON(os.Stdout, level)
+	default:
+		fmt.Printf("server: Unknown log format [%s]\n", *logFormat)
+		os.Exit(0)
+	}
+
+	if *traceFile != "" {
+		exporter, err := tracing.NewFileExporter(*traceFile)
+		if err != nil {
+			logger.Log(logging.Error, "Unable to open trace file", logging.F("path", *traceFile), logging.F(logging.KeyError, err))
+			os.Exit(0)
+		}
+		tracer = tracing.NewTracer("dfs-server", exporter)
+	} else if *traceEndpoint != "" {
+		tracer = tracing.NewTracer("dfs-server", tracing.NewOTLPExporter(*traceEndpoint))
+	}
+
+	args := flag.Args()
+	logger.Log(logging.Debug, "Starting", logging.F("args", args))
 	ipPort = args[0]
 
 	files = make(map[string]*FileState, 0)
+	// Clients cache generations across server restarts, so numbering starts from the time
+	lastGeneration = uint64(time.Now().UnixNano())
 	filesOpened = make(map[UserInfo]map[string]FileMode, 0)
 	clientConns = make(map[UserInfo]*rpc.Client, 0)
-	lastHeartBeat = make(map[UserInfo]time.Time, 0)
+	multiplexed = make(map[UserInfo]bool, 0)
+	sessions = make(map[string]*session, 0)
+	principals = make(map[UserInfo]string, 0)
+	groups = make(map[string][]string, 0)
+	ownerUsage = make(map[string]int64, 0)
+	namespaceUsage = make(map[string]int64, 0)
+	watchers = make(map[string][]UserInfo, 0)
+	ownerLatency = make(map[UserInfo]time.Duration, 0)
+
+	if *groupsFile != "" {
+		err := loadJSON(*groupsFile, &groups)
+		if err != nil {
+			logger.Log(logging.Error, "Unable to load groups", logging.F("path", *groupsFile), logging.F(logging.KeyError, err))
+			os.Exit(0)
+		}
+	}
 
-	server := new(ServerRPC)
-	serverRPC := rpc.NewServer()
-	serverRPC.Register(server)
+	if *quotasFile != "" {
+		err := loadJSON(*quotasFile, &quotas)
+		if err != nil {
+			logger.Log(logging.Error, "Unable to load quotas", logging.F("path", *quotasFile), logging.F(logging.KeyError, err))
+			os.Exit(0)
+		}
+	}
+
+	if *adminList != "" {
+		admins = strings.Split(*adminList, ",")
+	}
 
-	listener, err := net.Listen("tcp", ipPort)
+	listener, err := network.Listen(ipPort)
 	if err != nil {
-		fmt.Printf("server: Unable to bind to port [%s] to listen for incoming connection requests\n", ipPort)
+		logger.Log(logging.Error, "Unable to bind to port to listen for incoming connection requests", logging.F("addr", ipPort), logging.F(logging.KeyError, err))
 		os.Exit(0)
 	}
 
+	if *certFile != "" || *keyFile != "" || *caFile != "" {
+		tlsConfig, err = loadTLSConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			logger.Log(logging.Error, "Unable to load TLS configuration", logging.F(logging.KeyError, err))
+			os.Exit(0)
+		}
+
+		listenerConfig := tlsConfig.Clone()
+		listenerConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		listenerConfig.ClientCAs = tlsConfig.RootCAs
+		listener = tls.NewListener(listener, listenerConfig)
+	}
+
+	if *metricsAddr != "" {
+		go func() {
+			err := serverMetrics.ListenAndServe(*metricsAddr)
+			logger.Log(logging.Error, "Unable to serve metrics", logging.F("addr", *metricsAddr), logging.F(logging.KeyError, err))
+		}()
+	}
+
+	go reaper()
+	go scrub()
+
 	for {
 		conn, _ := listener.Accept()
-		go serverRPC.ServeConn(conn)
+		go serveConn(conn)
 	}
 }
 
-//==================================================================
-// Monitor reaps a user if it
-// (1) failed to send a heartbeat or
-// (2) sent a late heartbeat (> 2 seconds)
-//==================================================================
-
 /*
- Purpose:
- Params:
+ Purpose: Serves RPCs on a client connection, identifying the client by its certificate
+          over TLS. A client that begins a multiplexed session makes its calls on
+          streams it opens, and EstablishReverseRPC opens a stream back to it.
+ Params: conn - the accepted connection
  Returns
  Throws:
 */
-func monitor(user UserInfo) {
+func serveConn(conn net.Conn) {
+	principal := ""
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			logger.Log(logging.Warn, "TLS handshake failed", logging.F("addr", conn.RemoteAddr()), logging.F(logging.KeyError, err))
+			conn.Close()
+			return
+		}
+		principal = tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	sniffed, muxed, err := transport.Sniff(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if !muxed {
+		serveRPC(sniffed, &ServerRPC{principal: principal})
+		return
+	}
+
+	session := transport.Server(sniffed)
 	for {
-		timeBetween := time.Now().Sub(lastHeartBeat[user])
-		if timeBetween > hbInterval*time.Millisecond {
-			reap(user)
-			break
-		} else {
-			time.Sleep(2 * time.Second)
+		stream, err := session.Accept()
+		if err != nil {
+			return
 		}
+		go serveRPC(stream, &ServerRPC{principal: principal, session: session})
+	}
+}
+
+// serveRPC serves server's methods, and ClockRPC under -fake-clock, on conn until it closes
+func serveRPC(conn net.Conn, server *ServerRPC) {
+	serverRPC := rpc.NewServer()
+	serverRPC.Register(server)
+	if fakeClock != nil {
+		serverRPC.Register(ClockRPC{})
 	}
+	serverRPC.ServeConn(conn)
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Loads a JSON configuration file
+ Params: path - the file; v - receives the decoded contents
  Returns
- Throws:
+ Throws: Any error reading or decoding the file
 */
-func reap(user UserInfo) {
-	fmt.Printf("server: [%s] disconnected due to late heartbeat\n", user)
-	removeUser(user)
-	fmt.Println("Users: ", registeredUsers)
+func loadJSON(path string, v interface{}) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, v)
+}
+
+/*
+ Purpose: Loads the server's key pair and the certificate authority trusted for clients
+ Params: certFile, keyFile - the server key pair; caFile - PEM encoded CA certificates
+ Returns: A TLS configuration presenting the server certificate and trusting the CA
+ Throws: Any error reading or parsing the files
+*/
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in [%s]", caFile)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: ca}, nil
+}
+
+/*
+ Purpose: Signs a grant with the server's TLS key, so owners can check a direct fetch
+ Params: g - the grant, without Algorithm and Signature
+ Returns: The signed grant, or g unchanged without TLS
+ Throws: An error if the key cannot sign
+*/
+func signGrant(g ChunkGrant) (ChunkGrant, error) {
+	if tlsConfig == nil {
+		return g, nil
+	}
+
+	signer, ok := tlsConfig.Certificates[0].PrivateKey.(crypto.Signer)
+	if !ok {
+		return g, fmt.Errorf("server: TLS key cannot sign grants")
+	}
+
+	msg := grantMessage(g)
+	digest := sha256.Sum256(msg)
+	var err error
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		g.Algorithm = x509.SHA256WithRSA
+		g.Signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case *ecdsa.PublicKey:
+		g.Algorithm = x509.ECDSAWithSHA256
+		g.Signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		g.Algorithm = x509.PureEd25519
+		g.Signature, err = signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	default:
+		err = fmt.Errorf("server: TLS key type cannot sign grants")
+	}
+	return g, err
+}
+
+// grantMessage is the signed encoding of a grant, shared with dfslib
+func grantMessage(g ChunkGrant) []byte {
+	return []byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%d", g.Reader, g.Fname, g.ChunkNum, g.Version, g.Expires.UnixNano()))
+}
+
+/*
+ Purpose: Dials the reverse RPC connection to a client
+ Params: user - the client to dial; principal - the identity the client authenticated as
+ Returns: An RPC client connected to the client's ClientRPC
+ Throws: Any dial error, or an error if the client's certificate does not match principal
+*/
+func dialClient(user UserInfo, principal string) (*rpc.Client, error) {
+	conn, err := network.DialContext(context.Background(), user.LocalIP)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return rpc.NewClient(conn), nil
+	}
+
+	// The client's address is self-reported, so the peer is checked
+	// against the CA and the identity it authenticated with instead
+	config := tlsConfig.Clone()
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return AuthenticationError(principal)
+		}
+
+		opts := x509.VerifyOptions{Roots: tlsConfig.RootCAs,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		if err != nil {
+			return err
+		}
+		if cs.PeerCertificates[0].Subject.CommonName != principal {
+			return AuthenticationError(principal)
+		}
+		return nil
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(tlsConn), nil
 }
 
 //==================================================================
-// Server interface
+// Each Register starts a session with a new ID, which the user's
+// heartbeats must carry. One reaper checks every session twice per
+// heartbeat interval, earliest due first, suspects a user once the
+// failure detector judges its heartbeat late, and ends the session
+// if the user stays silent for the suspicion timeout.
 //==================================================================
 
+// A session is one registration of a user, until it is reaped or unregistered
+type session struct {
+	id          string
+	user        UserInfo
+	interval    time.Duration   // agreed at Register
+	last        time.Time       // when the last heartbeat, or the registration, arrived
+	beating     bool            // a heartbeat has arrived since the registration
+	gaps        []time.Duration // between recent heartbeats, oldest first, at most phiWindow
+	suspectedAt time.Time       // zero unless the user is suspected
+	due         time.Time       // when the reaper next checks the session
+	index       int             // in reaperQueue
+}
+
+// A failureDetector decides whether a session's heartbeat is late at now
+type failureDetector interface {
+	late(s *session, now time.Time) bool
+}
+
+// missedBeatsDetector suspects a user that has missed this many heartbeats in a row
+type missedBeatsDetector int
+
+func (m missedBeatsDetector) late(s *session, now time.Time) bool {
+	return now.Sub(s.last) > time.Duration(m)*s.interval
+}
+
+// phiDetector suspects a user once phi, the suspicion level of the phi
+// accrual failure detector, exceeds this threshold
+type phiDetector float64
+
+func (p phiDetector) late(s *session, now time.Time) bool {
+	return phi(s, now) > float64(p)
+}
+
 /*
- Purpose:
- Params:
- Returns
+ Purpose: Computes how unlikely it is that a heartbeat is still to come, modelling
+          the gaps between heartbeats as normally distributed with the mean and
+          standard deviation of the recent gaps, or of the interval before any
+ Params: s - the session; now - the time
+ Returns: -log10 of the chance that the next gap is longer than the time since the last heartbeat
  Throws:
 */
-func (s *ServerRPC) Ping(stub int, reply *bool) (err error) {
-	fmt.Println("Received ping from client")
-	return nil
+func phi(s *session, now time.Time) float64 {
+	mean := float64(s.interval)
+	variance := 0.0
+	if len(s.gaps) > 0 {
+		mean = 0
+		for _, gap := range s.gaps {
+			mean += float64(gap)
+		}
+		mean /= float64(len(s.gaps))
+		for _, gap := range s.gaps {
+			variance += (float64(gap) - mean) * (float64(gap) - mean)
+		}
+		variance /= float64(len(s.gaps))
+	}
+	deviation := math.Max(math.Sqrt(variance), phiMinDeviation*float64(s.interval))
+
+	y := (float64(now.Sub(s.last)) - mean) / deviation
+	return -math.Log10(0.5 * math.Erfc(y/math.Sqrt2))
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Records a heartbeat, clearing any suspicion
+ Params: now - when the heartbeat arrived
  Returns
  Throws:
+ Note: Callers must hold stateLock
 */
-func (s *ServerRPC) Register(user UserInfo, reply *bool) (err error) {
-	if !containsUser(user, registeredUsers) {
-		registeredUsers = append(registeredUsers, user)
-		lastHeartBeat[user] = time.Now()
-		go monitor(user)
-		fmt.Println("server: Received register from ", user)
-		*reply = true
-		return nil
+func (s *session) heartbeat(now time.Time) {
+	if s.beating {
+		s.gaps = append(s.gaps, now.Sub(s.last))
+		if len(s.gaps) > phiWindow {
+			s.gaps = s.gaps[len(s.gaps)-phiWindow:]
+		}
 	}
+	s.beating = true
+	s.last = now
+	s.suspectedAt = time.Time{}
+}
 
-	*reply = false
-	return UserRegistrationError(user.LocalIP + " @ path " + user.LocalPath)
+// sessionHeap orders sessions by when the reaper next checks them
+type sessionHeap []*session
+
+func (h sessionHeap) Len() int           { return len(h) }
+func (h sessionHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+
+func (h sessionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *sessionHeap) Push(x interface{}) {
+	s := x.(*session)
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *sessionHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return s
 }
 
 /*
- Purpose:
- Params:
- Returns
- Throws:
+ Purpose: Starts a session for a newly registered user and schedules its first check
+ Params: user - the user; principal - the identity it registered as; interval - its heartbeat interval
+ Returns: The session
+ Throws: Any error generating the session ID
+ Note: Callers must hold stateLock
 */
-func (s *ServerRPC) Unregister(user UserInfo, reply *bool) (err error) {
-	fmt.Printf("server: Removing requested user [%s]\n", user)
-	removeUser(user)
-	fmt.Println("Users: ", registeredUsers)
-	return nil
+func startSession(user UserInfo, principal string, interval time.Duration) (*session, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := clk.Now()
+	s := &session{id: fmt.Sprintf("%x", id), user: user, interval: interval, last: now, due: now.Add(interval / 2)}
+	sessions[principal] = s
+	heap.Push(&reaperQueue, s)
+
+	// The reaper may be waiting for a later session, or for none
+	select {
+	case reaperKick <- nil:
+	default:
+	}
+	return s, nil
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Ends a user's session, whether it was reaped, evicted or unregistered. Releases
+          its write locks, drops it from the owners of every chunk and the watchers of
+          every file, forgets the files it has open, closes the reverse connection and
+          unregisters it. Watchers of a file whose write lock was released, or with a
+          chunk whose latest version the user alone held, are then notified.
+ Params: user - the user
  Returns
  Throws:
+ Note: Callers must hold stateLock
 */
-func (s *ServerRPC) SendHeartbeat(user UserInfo, reply *bool) (err error) {
-	if !containsUser(user, registeredUsers) {
-		*reply = false
-		return HeartbeatRegistrationError(user.LocalIP + " @ path " + user.LocalPath)
+func endSession(user UserInfo) {
+	events := make([]FileEvent, 0)
+	for fname, fs := range files {
+		if fs.isLockedForWrite && userEquals(fs.writer, user) {
+			releaseWriteAccess(fs)
+			events = append(events, FileEvent{Fname: fname, Released: true})
+		}
+		for i, fvo := range fs.chunkVersion {
+			if fvo == nil || !containsUser(user, fvo.owners) {
+				continue
+			}
+			fvo.owners = withoutUser(fvo.owners, user)
+			if len(fvo.owners) == 0 && fvo.version > 0 {
+				events = append(events, FileEvent{Fname: fname, ChunkNum: uint8(i), Version: fvo.version, Unavailable: true})
+			}
+		}
+	}
+	for fname, users := range watchers {
+		if containsUser(user, users) {
+			watchers[fname] = withoutUser(users, user)
+		}
+	}
+	delete(filesOpened, user)
+	if clientConns[user] != nil {
+		clientConns[user].Close()
+		delete(clientConns, user)
 	}
+	delete(multiplexed, user)
+	removeUser(user)
 
-	fmt.Println("server: Received heartbeat from: ", user)
-	lastHeartBeat[user] = time.Now()
-	*reply = true
-	return nil
+	for _, ev := range events {
+		notifyWatchers(ev)
+	}
 }
 
 /*
- Purpose:
+ Purpose: Checks each session as it falls due, until the server exits. Waits for the
+          earliest due session, a new session, or a kick from ClockRPC.Advance, which
+          passes a channel to close once the sessions due have been checked.
  Params:
  Returns
  Throws:
 */
-func (s *ServerRPC) EstablishReverseRPC(user UserInfo, reply *bool) (err error) {
-	clientConns[user], err = rpc.Dial("tcp", user.LocalIP)
-	if err != nil {
-		return err
-	}
-
+func reaper() {
+	for {
+		stateLock.Lock()
+		wait := maxHeartbeat * time.Millisecond
+		if len(reaperQueue) > 0 {
+			wait = reaperQueue[0].due.Sub(clk.Now())
+		}
+		stateLock.Unlock()
+
+		var checked chan struct{}
+		select {
+		case <-clk.After(wait):
+		case checked = <-reaperKick:
+		}
+
+		checkSessions()
+		if checked != nil {
+			close(checked)
+		}
+	}
+}
+
+/*
+ Purpose: Checks every session now due, suspecting users whose heartbeats are late
+          and ending the sessions of those that stayed silent for suspicionTimeout
+ Params:
+ Returns
+ Throws:
+*/
+func checkSessions() {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	now := clk.Now()
+	for len(reaperQueue) > 0 && !reaperQueue[0].due.After(now) {
+		s := reaperQueue[0]
+		late := detector.late(s, now)
+		if late && s.suspectedAt.IsZero() {
+			s.suspectedAt = now
+			suspectedUsers.Inc()
+			logger.Log(logging.Warn, "Suspected user of failing", logging.F(logging.KeyUser, s.user),
+				logging.F("silent", now.Sub(s.last)))
+		}
+
+		if late && now.Sub(s.suspectedAt) >= suspicionTimeout {
+			logger.Log(logging.Info, "Disconnected due to late heartbeat", logging.F(logging.KeyUser, s.user),
+				logging.F("session", s.id))
+			reapedClients.Inc()
+			endSession(s.user)
+			logger.Log(logging.Debug, "Registered users", logging.F("users", registeredUsers))
+			continue
+		}
+
+		s.due = now.Add(s.interval / 2)
+		heap.Fix(&reaperQueue, s.index)
+	}
+}
+
+// ClockRPC is served only under -fake-clock, for tests to move time
+type ClockRPC struct{}
+
+/*
+ Purpose: Advances the fake clock, then has the reaper check every session now due,
+          so any user whose heartbeats are late by the new time has been suspected
+          or reaped before the call returns
+ Params: d - how far to advance
+ Returns: reply - the fake time now
+ Throws:
+*/
+func (ClockRPC) Advance(d time.Duration, reply *time.Time) error {
+	fakeClock.Advance(d)
+
+	checked := make(chan struct{})
+	reaperKick <- checked
+	<-checked
+
+	*reply = fakeClock.Now()
+	return nil
+}
+
+//==================================================================
+// Scrubber periodically asks every owner of a chunk version to
+// confirm it still holds that version, prunes owners that do not,
+// and re-replicates chunk versions held by too few live clients.
+// Calls to clients are spaced at least scrubCallInterval apart.
+//==================================================================
+
+type chunkRecord struct {
+	fname      string
+	generation uint64
+	sealed     bool
+	chunkNum   uint8
+	version    int
+	checksum   [sha256.Size]byte
+	owners     []UserInfo
+	trace      tracing.SpanContext // of the span scrubbing this chunk
+}
+
+/*
+ Purpose: Runs scrubber passes forever
+ Params:
+ Returns
+ Throws:
+*/
+func scrub() {
+	limiter := time.NewTicker(scrubCallInterval * time.Millisecond)
+	defer limiter.Stop()
+
+	for {
+		clk.Sleep(scrubInterval * time.Millisecond)
+		for _, cr := range snapshotChunks() {
+			scrubChunk(cr, limiter.C)
+		}
+	}
+}
+
+/*
+ Purpose: Copies the ownership of every written chunk version
+ Params:
+ Returns: A record per chunk with version > 0
+ Throws:
+*/
+func snapshotChunks() []chunkRecord {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	records := make([]chunkRecord, 0)
+	for fname, fs := range files {
+		for i, fvo := range fs.chunkVersion {
+			if fvo == nil || fvo.version == 0 {
+				continue
+			}
+			records = append(records, chunkRecord{fname: fname,
+				generation: fs.generation,
+				sealed:     fs.sealed,
+				chunkNum:   uint8(i),
+				version:    fvo.version,
+				checksum:   fvo.checksum,
+				owners:     append([]UserInfo(nil), fvo.owners...)})
+		}
+	}
+	return records
+}
+
+/*
+ Purpose: Verifies, prunes, and re-replicates a single chunk version
+ Params: cr - snapshot of the chunk version; limiter - paces calls to clients
+ Returns
+ Throws:
+*/
+func scrubChunk(cr chunkRecord, limiter <-chan time.Time) {
+	span := tracer.Start("server.ScrubChunk", tracing.KindInternal, tracing.SpanContext{},
+		tracing.A(logging.KeyFile, cr.fname), tracing.A(logging.KeyChunk, cr.chunkNum), tracing.A(logging.KeyVersion, cr.version))
+	defer span.End()
+	cr.trace = span.Context()
+
+	valid := make([]UserInfo, 0)
+	for _, owner := range cr.owners {
+		<-limiter
+		if verifyOwner(owner, cr) {
+			valid = append(valid, owner)
+		} else {
+			logger.Log(logging.Info, "Pruning owner", logging.F(logging.KeyUser, owner), logging.F(logging.KeyFile, cr.fname), logging.F(logging.KeyChunk, cr.chunkNum),
+				logging.F(logging.KeyVersion, cr.version))
+		}
+	}
+
+	if !pruneOwners(cr, valid) {
+		return
+	}
+
+	if len(valid) == 0 {
+		logger.Log(logging.Warn, "No live owner holds chunk", logging.F(logging.KeyFile, cr.fname), logging.F(logging.KeyChunk, cr.chunkNum),
+			logging.F(logging.KeyVersion, cr.version))
+	} else if len(valid) < replicationFactor {
+		replicate(cr, valid, limiter)
+	}
+}
+
+/*
+ Purpose: Asks an owner to confirm the version and checksum of its copy of a chunk
+ Params: owner - the user claiming the chunk; cr - the expected chunk version
+ Returns: true if the owner is live and holds the expected version
+ Throws:
+*/
+func verifyOwner(owner UserInfo, cr chunkRecord) bool {
+	stateLock.Lock()
+	connToClient := clientConns[owner]
+	isRegistered := containsUser(owner, registeredUsers)
+	stateLock.Unlock()
+
+	if !isRegistered || connToClient == nil {
+		return false
+	}
+
+	span := tracer.Start("server.VerifyChunk", tracing.KindClient, cr.trace, tracing.A(logging.KeyUser, owner))
+	defer span.End()
+
+	vi := VerifyInfo{Fname: cr.fname, ChunkNum: cr.chunkNum, Sealed: cr.sealed, Trace: span.Context()}
+	vv := VerifyValue{}
+	err := callClient(context.Background(), connToClient, "ClientRPC.VerifyChunk", vi, &vv)
+	if err != nil {
+		span.SetError(err)
+		return false
+	}
+	span.SetAttribute("present", vv.Present)
+	span.SetAttribute(logging.KeyVersion, vv.Version)
+
+	return vv.Present && vv.Version == cr.version && vv.Checksum == cr.checksum
+}
+
+/*
+ Purpose: Removes owners that failed verification, unless the chunk was rewritten since the snapshot
+ Params: cr - snapshot of the chunk version; valid - owners that passed verification
+ Returns: false if the chunk version changed since the snapshot
+ Throws:
+*/
+func pruneOwners(cr chunkRecord, valid []UserInfo) bool {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	fvo := currentChunk(cr)
+	if fvo == nil {
+		return false
+	}
+
+	owners := make([]UserInfo, 0)
+	for _, owner := range fvo.owners {
+		if containsUser(owner, valid) || !containsUser(owner, cr.owners) {
+			owners = append(owners, owner)
+		}
+	}
+	fvo.owners = owners
+	return true
+}
+
+/*
+ Purpose: Looks up a chunk version recorded by the scrubber
+ Params: cr - snapshot of the chunk version
+ Returns: The chunk's version and owners, or nil if the file was removed or the chunk rewritten since
+ Throws:
+ Note: Callers must hold stateLock
+*/
+func currentChunk(cr chunkRecord) *FileVersionOwners {
+	fs := files[cr.fname]
+	if fs == nil || fs.generation != cr.generation {
+		return nil
+	}
+
+	fvo := fs.chunkVersion[cr.chunkNum]
+	if fvo == nil || fvo.version != cr.version {
+		return nil
+	}
+	return fvo
+}
+
+/*
+ Purpose: Copies a chunk version from a valid owner to other live clients until replicationFactor is reached
+ Params: cr - snapshot of the chunk version; valid - owners that passed verification
+ Returns
+ Throws:
+*/
+func replicate(cr chunkRecord, valid []UserInfo, limiter <-chan time.Time) {
+	var data []byte
+	for _, owner := range valid {
+		<-limiter
+		d, err := retrieveLatestChunk(context.Background(), ReadInfo{User: owner, Fname: cr.fname, ChunkNum: cr.chunkNum, Sealed: cr.sealed, Trace: cr.trace})
+		if err == nil && sha256.Sum256(d) == cr.checksum {
+			data = d
+			break
+		}
+	}
+	if data == nil {
+		return
+	}
+
+	stateLock.Lock()
+	candidates := make([]UserInfo, 0)
+	for _, user := range registeredUsers {
+		if !containsUser(user, valid) && clientConns[user] != nil && hasPermission(cr.fname, user, PermRead) {
+			candidates = append(candidates, user)
+		}
+	}
+	stateLock.Unlock()
+
+	numOwners := len(valid)
+	for _, user := range candidates {
+		if numOwners >= replicationFactor {
+			break
+		}
+
+		<-limiter
+		if storeReplica(user, cr, data) {
+			numOwners++
+		}
+	}
+}
+
+/*
+ Purpose: Pushes a chunk version to a client and records it as an owner
+ Params: user - the receiving client; cr - the chunk version; data - its stored contents
+ Returns: true if the client stored the chunk and was recorded as an owner
+ Throws:
+*/
+func storeReplica(user UserInfo, cr chunkRecord, data []byte) bool {
+	stateLock.Lock()
+	connToClient := clientConns[user]
+	// The file's ACL may have changed since the user was chosen
+	allowed := hasPermission(cr.fname, user, PermRead)
+	stateLock.Unlock()
+
+	if connToClient == nil || !allowed {
+		return false
+	}
+
+	span := tracer.Start("server.StoreChunk", tracing.KindClient, cr.trace, tracing.A(logging.KeyUser, user))
+	defer span.End()
+
+	reply := false
+	ri := ReplicaInfo{Fname: cr.fname, Generation: cr.generation, ChunkNum: cr.chunkNum, Version: cr.version, Sealed: cr.sealed, Data: data,
+		Trace: span.Context()}
+	err := callClient(context.Background(), connToClient, "ClientRPC.StoreChunk", ri, &reply)
+	if err != nil || !reply {
+		span.SetError(err)
+		return false
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	fvo := currentChunk(cr)
+	if fvo == nil {
+		return false
+	}
+	if !containsUser(user, fvo.owners) {
+		fvo.owners = append(fvo.owners, user)
+	}
+	logger.Log(logging.Info, "Replicated chunk", logging.F(logging.KeyUser, user), logging.F(logging.KeyFile, cr.fname), logging.F(logging.KeyChunk, cr.chunkNum),
+		logging.F(logging.KeyVersion, cr.version))
+	return true
+}
+
+//==================================================================
+// Server interface
+//==================================================================
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (s *ServerRPC) Ping(stub int, reply *bool) (err error) {
+	defer observeRPC("Ping", time.Now(), &err)
+
+	logger.Log(logging.Debug, "Received ping from client")
+	return nil
+}
+
+/*
+ Purpose: Registers a user and agrees its heartbeat interval
+ Params: ri - the user, and the interval it asks for or 0 for the server's
+ Returns: rv - the interval, clamped to between minHeartbeat and maxHeartbeat
+ Throws: UserRegistrationError if the user, or over TLS the caller's certificate,
+         is already registered
+*/
+func (s *ServerRPC) Register(ri RegisterInfo, rv *RegisterValue) (err error) {
+	defer observeRPC("Register", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	user := ri.User
+	principal := s.identity(user)
+	if sessions[principal] != nil {
+		// Over TLS a certificate holds one session, whatever UserInfo it reports
+		return UserRegistrationError(principal)
+	}
+
+	if !containsUser(user, registeredUsers) {
+		interval := heartbeatInterval
+		if ri.HeartbeatInterval > 0 {
+			interval = ri.HeartbeatInterval
+			if interval < minHeartbeat*time.Millisecond {
+				interval = minHeartbeat * time.Millisecond
+			} else if interval > maxHeartbeat*time.Millisecond {
+				interval = maxHeartbeat * time.Millisecond
+			}
+		}
+		session, err := startSession(user, principal, interval)
+		if err != nil {
+			return err
+		}
+		registeredUsers = append(registeredUsers, user)
+		principals[user] = principal
+		logger.Log(logging.Info, "Registered user", logging.F(logging.KeyUser, user), logging.F("principal", principals[user]),
+			logging.F("session", session.id), logging.F("heartbeat", interval))
+		rv.Session = session.id
+		rv.HeartbeatInterval = interval
+		return nil
+	}
+
+	return UserRegistrationError(user.LocalIP + " @ path " + user.LocalPath)
+}
+
+/*
+ Purpose: Ends the user's session at its request, as a reap would
+ Params: user - the user
+ Returns
+ Throws: AuthenticationError if the caller is not the user
+*/
+func (s *ServerRPC) Unregister(user UserInfo, reply *bool) (err error) {
+	defer observeRPC("Unregister", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(user)
+	if err != nil {
+		return err
+	}
+
+	logger.Log(logging.Info, "Removing requested user", logging.F(logging.KeyUser, user))
+	endSession(user)
+	logger.Log(logging.Debug, "Registered users", logging.F("users", registeredUsers))
+	return nil
+}
+
+/*
+ Purpose: Keeps a user's session alive
+ Params: hi - the user and its session ID
+ Returns
+ Throws: HeartbeatRegistrationError if the user is not registered, or
+         SessionExpiredError if the session has ended since the user registered again
+*/
+func (s *ServerRPC) SendHeartbeat(hi HeartbeatInfo, reply *bool) (err error) {
+	defer observeRPC("SendHeartbeat", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	user := hi.User
+	if !containsUser(user, registeredUsers) {
+		*reply = false
+		return HeartbeatRegistrationError(user.LocalIP + " @ path " + user.LocalPath)
+	}
+
+	err = s.authenticate(user)
+	if err != nil {
+		*reply = false
+		return err
+	}
+
+	session := sessions[principals[user]]
+	if session.id != hi.Session {
+		*reply = false
+		return SessionExpiredError(hi.Session)
+	}
+
+	logger.Log(logging.Debug, "Received heartbeat", logging.F(logging.KeyUser, user))
+	heartbeats.Inc()
+	if !session.suspectedAt.IsZero() {
+		logger.Log(logging.Info, "No longer suspect user", logging.F(logging.KeyUser, user), logging.F("silent", clk.Since(session.last)))
+	}
+	session.heartbeat(clk.Now())
+	*reply = true
+	return nil
+}
+
+/*
+ Purpose: Dials back to a registered user, or opens a stream to it over its
+          multiplexed connection, and pings it, keeping the connection for
+          calls to the user only once the ping succeeds
+ Params: user - the user, whose LocalIP it listens on unless multiplexed
+ Returns
+ Throws: AuthenticationError, UnregisteredUserError, or any error connecting to or pinging the user
+*/
+func (s *ServerRPC) EstablishReverseRPC(user UserInfo, reply *bool) (err error) {
+	defer observeRPC("EstablishReverseRPC", time.Now(), &err)
+
+	stateLock.Lock()
+	err = s.authenticate(user)
+	session := sessions[principals[user]]
+	stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		return UnregisteredUserError(user.LocalIP + " @ path " + user.LocalPath)
+	}
+
+	var connToClient *rpc.Client
+	if s.session != nil {
+		stream, err := s.session.Open()
+		if err != nil {
+			return err
+		}
+		connToClient = rpc.NewClient(stream)
+	} else {
+		connToClient, err = dialClient(user, s.principal)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The session ID shows the client that the caller is the server
 	r := false
-	clientConns[user].Call("ClientRPC.Ping", 0, &r)
+	err = callClient(context.Background(), connToClient, "ClientRPC.Ping", session.id, &r)
+	if err != nil {
+		connToClient.Close()
+		return err
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if !containsUser(user, registeredUsers) {
+		// The session ended while dialing
+		connToClient.Close()
+		return UnregisteredUserError(user.LocalIP + " @ path " + user.LocalPath)
+	}
+	if clientConns[user] != nil {
+		clientConns[user].Close()
+	}
+	clientConns[user] = connToClient
+	multiplexed[user] = s.session != nil
+	return nil
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (s *ServerRPC) FileExists(fname string, reply *bool) (err error) {
+	defer observeRPC("FileExists", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
 
+	fs := files[fname]
+	if fs == nil {
+		*reply = false
+	} else {
+		logger.Log(logging.Debug, "File existence", logging.F(logging.KeyFile, fname), logging.F("exists", fs.fileExists))
+		*reply = fs.fileExists
+	}
 	return nil
 }
 
 /*
- Purpose:
- Params:
+ Purpose:
+ Params:
+ Returns: The file's generation
+ Throws:
+*/
+func (s *ServerRPC) RegisterFile(fi FileInfo, rv *RegisterFileValue) (err error) {
+	defer observeRPC("RegisterFile", time.Now(), &err)
+	span := tracer.Start("server.RegisterFile", tracing.KindServer, fi.Trace,
+		tracing.A(logging.KeyUser, fi.User), tracing.A(logging.KeyFile, fi.Name), tracing.A("mode", int(fi.Fmode)))
+	defer span.Finish(&err)
+
+	start := time.Now()
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	waited := time.Since(start)
+
+	err = s.authenticate(fi.User)
+	if err != nil {
+		return err
+	}
+
+	createFileIfNotExist(fi)
+
+	if files[fi.Name].sealed != fi.Sealed {
+		return EncryptionModeError(fi.Name)
+	}
+
+	perm := PermRead
+	if fi.Fmode == WRITE {
+		perm = PermWrite
+	}
+	if !hasPermission(fi.Name, fi.User, perm) {
+		return PermissionDeniedError(fi.Name)
+	}
+
+	err = configureWriteAccess(fi, waited)
+	if err != nil {
+		return err
+	}
+
+	updateOpenedFiles(fi)
+	rv.Generation = files[fi.Name].generation
+	return nil
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (s *ServerRPC) WriteFile(wi WriteInfo, wv *WriteValue) (err error) {
+	defer observeRPC("WriteFile", time.Now(), &err)
+	span := tracer.Start("server.WriteFile", tracing.KindServer, wi.Trace,
+		tracing.A(logging.KeyUser, wi.User), tracing.A(logging.KeyFile, wi.Fname), tracing.A(logging.KeyChunk, wi.ChunkNum))
+	defer span.Finish(&err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(wi.User)
+	if err != nil {
+		return err
+	}
+
+	if files[wi.Fname] == nil {
+		return FileUnavailableError(wi.Fname)
+	}
+	if !hasPermission(wi.Fname, wi.User, PermWrite) {
+		return PermissionDeniedError(wi.Fname)
+	}
+
+	fs := files[wi.Fname]
+	if !fs.isLockedForWrite || !userEquals(fs.writer, wi.User) {
+		return WriteModeTimeoutError(wi.Fname)
+	}
+
+	fvo := chunkOwners(wi.Fname, wi.ChunkNum)
+	if wi.Version != 0 && wi.Version != fvo.version+1 {
+		return ChunkVersionError(wi.Fname)
+	}
+	if fvo.version == 0 {
+		// Space is consumed the first time a chunk is written
+		err = chargeQuota(fs, chunkBytes(fs))
+		if err != nil {
+			return err
+		}
+	}
+
+	wv.GlobalChunkVer = writeChunk(wi.User, wi.Fname, wi.ChunkNum, wi.Checksum)
+	return nil
+}
+
+/*
+ Purpose: Writes many chunks of a file in one call, as WriteFile does for each, in order
+ Params: wci - the writer, the file, and the chunks with the checksum of each
+ Returns: wcv.GlobalChunkVers holds the new version of each of wci.ChunkNums
+ Throws: FileUnavailableError, PermissionDeniedError, WriteModeTimeoutError, QuotaExceededError,
+         ChunkVersionError; no chunk is written if any is refused
+*/
+func (s *ServerRPC) WriteChunks(wci WriteChunksInfo, wcv *WriteChunksValue) (err error) {
+	defer observeRPC("WriteChunks", time.Now(), &err)
+	span := tracer.Start("server.WriteChunks", tracing.KindServer, wci.Trace,
+		tracing.A(logging.KeyUser, wci.User), tracing.A(logging.KeyFile, wci.Fname), tracing.A("chunks", len(wci.ChunkNums)))
+	defer span.Finish(&err)
+
+	if len(wci.Checksums) != len(wci.ChunkNums) {
+		return fmt.Errorf("server: %d checksums for %d chunks", len(wci.Checksums), len(wci.ChunkNums))
+	}
+	if wci.Versions != nil && len(wci.Versions) != len(wci.ChunkNums) {
+		return fmt.Errorf("server: %d versions for %d chunks", len(wci.Versions), len(wci.ChunkNums))
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(wci.User)
+	if err != nil {
+		return err
+	}
+
+	if files[wci.Fname] == nil {
+		return FileUnavailableError(wci.Fname)
+	}
+	if !hasPermission(wci.Fname, wci.User, PermWrite) {
+		return PermissionDeniedError(wci.Fname)
+	}
+
+	fs := files[wci.Fname]
+	if !fs.isLockedForWrite || !userEquals(fs.writer, wci.User) {
+		return WriteModeTimeoutError(wci.Fname)
+	}
+
+	// Each sealed chunk must be bound to the version it will have once
+	// the chunks before it are written
+	var written [256]int
+	for i, chunkNum := range wci.ChunkNums {
+		written[chunkNum]++
+		if wci.Versions != nil && wci.Versions[i] != 0 && wci.Versions[i] != chunkOwners(wci.Fname, chunkNum).version+written[chunkNum] {
+			return ChunkVersionError(wci.Fname)
+		}
+	}
+
+	// Space for every chunk written for the first time is charged at once
+	var unwritten [256]bool
+	newChunks := 0
+	for _, chunkNum := range wci.ChunkNums {
+		if chunkOwners(wci.Fname, chunkNum).version == 0 && !unwritten[chunkNum] {
+			unwritten[chunkNum] = true
+			newChunks++
+		}
+	}
+	if newChunks > 0 {
+		err = chargeQuota(fs, int64(newChunks)*chunkBytes(fs))
+		if err != nil {
+			return err
+		}
+	}
+
+	wcv.GlobalChunkVers = make([]int, len(wci.ChunkNums))
+	for i, chunkNum := range wci.ChunkNums {
+		wcv.GlobalChunkVers[i] = writeChunk(wci.User, wci.Fname, chunkNum, wci.Checksums[i])
+	}
+	return nil
+}
+
+/*
+ Purpose: Records a new version of a chunk held only by its writer, and notifies watchers
+ Params: user - the writer; fname - the file; chunkNum - the chunk; checksum - of the stored bytes
+ Returns: The new version
+ Throws:
+ Note: Callers must hold stateLock, and have checked the write lock and quota
+*/
+func writeChunk(user UserInfo, fname string, chunkNum uint8, checksum [sha256.Size]byte) int {
+	fvo := chunkOwners(fname, chunkNum)
+	fvo.version++
+	fvo.checksum = checksum
+	fvo.owners = make([]UserInfo, 0)
+	fvo.owners = append(fvo.owners, user)
+
+	notifyWatchers(FileEvent{Fname: fname, ChunkNum: chunkNum, Version: fvo.version})
+	return fvo.version
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (s *ServerRPC) ReadFile(ri ReadInfo, rv *ReadValue) (err error) {
+	defer observeRPC("ReadFile", time.Now(), &err)
+	span := tracer.Start("server.ReadFile", tracing.KindServer, ri.Trace,
+		tracing.A(logging.KeyUser, ri.User), tracing.A(logging.KeyFile, ri.Fname), tracing.A(logging.KeyChunk, ri.ChunkNum))
+	defer span.Finish(&err)
+
+	stateLock.Lock()
+	err = s.checkRead(ri.User, ri.Fname)
+	stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := readerContext(ri.Deadline)
+	defer cancel()
+	return s.readChunk(ctx, ri, rv, nil, span)
+}
+
+/*
+ Purpose: Reads many chunks of a file in one call, as ReadFile does for each
+ Params: rci - the reader, the file, and the chunks with the reader's cached version of each
+ Returns: rcv.Chunks holds a ReadValue for each of rci.ChunkNums, in order, Unavailable
+          for each chunk ReadFile would have failed with ChunkUnavailableError
+ Throws: FileUnavailableError, PermissionDeniedError, or the reader's context error
+*/
+func (s *ServerRPC) ReadChunks(rci ReadChunksInfo, rcv *ReadChunksValue) (err error) {
+	defer observeRPC("ReadChunks", time.Now(), &err)
+	span := tracer.Start("server.ReadChunks", tracing.KindServer, rci.Trace,
+		tracing.A(logging.KeyUser, rci.User), tracing.A(logging.KeyFile, rci.Fname), tracing.A("chunks", len(rci.ChunkNums)))
+	defer span.Finish(&err)
+
+	stateLock.Lock()
+	err = s.checkRead(rci.User, rci.Fname)
+	stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := readerContext(rci.Deadline)
+	defer cancel()
+
+	// Each owner first serves all the stale chunks it ranks fastest for in one
+	// call. The rest are fetched concurrently, and hedged, as for ReadFile.
+	batched := fetchChunkBatches(ctx, rci, span.Context())
+
+	rcv.Chunks = make([]ReadValue, len(rci.ChunkNums))
+	errs := make([]error, len(rci.ChunkNums))
+	var wg sync.WaitGroup
+	for i, chunkNum := range rci.ChunkNums {
+		ri := ReadInfo{User: rci.User, Fname: rci.Fname, ChunkNum: chunkNum, Sealed: rci.Sealed, Direct: rci.Direct}
+		if i < len(rci.LocalChunkVers) {
+			ri.LocalChunkVer = rci.LocalChunkVers[i]
+		}
+
+		wg.Add(1)
+		go func(i int, ri ReadInfo) {
+			defer wg.Done()
+			chunkSpan := tracer.Start("server.ReadChunk", tracing.KindInternal, span.Context(), tracing.A(logging.KeyChunk, ri.ChunkNum))
+			errs[i] = s.readChunk(ctx, ri, &rcv.Chunks[i], batched[ri.ChunkNum], chunkSpan)
+			chunkSpan.Finish(&errs[i])
+		}(i, ri)
+	}
+	wg.Wait()
+
+	// One unavailable chunk does not fail the others
+	for i, err := range errs {
+		if _, ok := err.(ChunkUnavailableError); ok {
+			rcv.Chunks[i] = ReadValue{Unavailable: true}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ Purpose: Checks that a registered user may read a file. Must be called under stateLock.
+ Params: user - the reader; fname - the file
+ Returns
+ Throws: AuthenticationError, FileUnavailableError, PermissionDeniedError
+*/
+func (s *ServerRPC) checkRead(user UserInfo, fname string) error {
+	err := s.authenticate(user)
+	if err != nil {
+		return err
+	}
+
+	if files[fname] == nil {
+		return FileUnavailableError(fname)
+	}
+	if !hasPermission(fname, user, PermRead) {
+		return PermissionDeniedError(fname)
+	}
+	return nil
+}
+
+// readerContext bounds work on a reader's behalf by the reader's deadline, if any
+func readerContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+/*
+ Purpose: Reads one chunk for a reader already checked by checkRead, fetching it from
+          an owner if the reader's copy is stale, or naming the owners for a Direct read
+ Params: ctx - the reader's context; ri - the read; rv - the reply;
+         batched - the chunk's bytes if already fetched in a batch, else nil; span - records the outcome
+ Returns
+ Throws: FileUnavailableError, ChunkUnavailableError if no owner can serve the latest
+         version, or ctx.Err() if the reader gave up
+*/
+func (s *ServerRPC) readChunk(ctx context.Context, ri ReadInfo, rv *ReadValue, batched []byte, span *tracing.Span) (err error) {
+	stateLock.Lock()
+	if files[ri.Fname] == nil {
+		stateLock.Unlock()
+		return FileUnavailableError(ri.Fname)
+	}
+
+	fvo := chunkOwners(ri.Fname, ri.ChunkNum)
+	version := fvo.version
+	checksum := fvo.checksum
+	owners := append([]UserInfo(nil), fvo.owners...)
+	peers := reachableOwners(owners)
+	sealed := files[ri.Fname].sealed
+	stateLock.Unlock()
+
+	// Owners only serve chunks for a grant over TLS, so without it the server relays.
+	// A copy newer than the latest version was cached of a removed file of the same name.
+	hasLatest := ri.LocalChunkVer == version
+	if !hasLatest && ri.Direct && tlsConfig != nil && len(peers) > 0 {
+		// The reader fetches the chunk itself and confirms it with ConfirmChunk
+		rv.Peers = rankOwners(peers)
+		rv.GlobalChunkVer = version
+		rv.Checksum = checksum
+		rv.Grant, err = signGrant(ChunkGrant{Reader: s.principal, Fname: ri.Fname, ChunkNum: ri.ChunkNum, Version: version,
+			Expires: time.Now().Add(grantLifetime * time.Millisecond)})
+		if err != nil {
+			return err
+		}
+		directReads.Inc()
+		span.SetAttribute("direct", true)
+		return nil
+	}
+
+	if !hasLatest && batched != nil && sha256.Sum256(batched) == checksum {
+		rv.Data = batched
+		rv.GlobalChunkVer = version
+		rv.IsNew = true
+		hasLatest = true
+		span.SetAttribute("batched", true)
+	} else if !hasLatest {
+		attempts := 0
+		defer func() {
+			outcome := "served"
+			if !hasLatest {
+				outcome = "unavailable"
+			}
+			fetchFanout.Observe(float64(attempts), outcome)
+			span.SetAttribute("owners_tried", attempts)
+		}()
+
+		readInfoForRetrievingChunk := ReadInfo{Fname: ri.Fname, ChunkNum: ri.ChunkNum, Sealed: sealed, Trace: span.Context()}
+		for {
+			newChunk, tried, err := fetchChunk(ctx, readInfoForRetrievingChunk, owners, checksum)
+			attempts += tried
+			if err == nil {
+				rv.Data = newChunk
+				rv.GlobalChunkVer = version
+				rv.IsNew = true
+				hasLatest = true
+				break
+			}
+
+			// A write since the version was looked up replaces the owners'
+			// copies, so they no longer match; fetch the newer version instead
+			newer := false
+			stateLock.Lock()
+			if files[ri.Fname] != nil {
+				fvo = chunkOwners(ri.Fname, ri.ChunkNum)
+				newer = fvo.version != version
+				version, checksum = fvo.version, fvo.checksum
+				owners = append([]UserInfo(nil), fvo.owners...)
+			}
+			stateLock.Unlock()
+			if !newer || ctx.Err() != nil {
+				break
+			}
+		}
+	} else {
+		rv.IsNew = false
+	}
+
+	// A reader past its deadline has abandoned the call and will not cache the chunk
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Serving the reader's stale copy instead would break the read's promise
+	// of the latest version
+	if !hasLatest {
+		return ChunkUnavailableError(ri.ChunkNum)
+	}
+
+	// Only a reader that now holds the latest version may serve it to others
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if hasLatest && fvo.version == version && !containsUser(ri.User, fvo.owners) {
+		fvo.owners = append(fvo.owners, ri.User)
+	}
+
+	return nil
+}
+
+/*
+ Purpose: Records a reader that fetched a chunk version directly from an owner as an owner itself,
+          once the reader shows it holds that version with the recorded checksum
+ Params: cr - the reader, the chunk version, and the owner that served it and how fast
+ Returns: reply is false if the chunk has since been rewritten or the reader does not hold it
+ Throws: FileUnavailableError, PermissionDeniedError
+*/
+func (s *ServerRPC) ConfirmChunk(cr ChunkReceipt, reply *bool) (err error) {
+	defer observeRPC("ConfirmChunk", time.Now(), &err)
+	span := tracer.Start("server.ConfirmChunk", tracing.KindServer, cr.Trace,
+		tracing.A(logging.KeyUser, cr.User), tracing.A(logging.KeyFile, cr.Fname), tracing.A(logging.KeyChunk, cr.ChunkNum))
+	defer span.Finish(&err)
+
+	stateLock.Lock()
+	err = s.authenticate(cr.User)
+	if err != nil {
+		stateLock.Unlock()
+		return err
+	}
+	if files[cr.Fname] == nil {
+		stateLock.Unlock()
+		return FileUnavailableError(cr.Fname)
+	}
+	if !hasPermission(cr.Fname, cr.User, PermRead) {
+		stateLock.Unlock()
+		return PermissionDeniedError(cr.Fname)
+	}
+	fvo := chunkOwners(cr.Fname, cr.ChunkNum)
+	record := chunkRecord{fname: cr.Fname, generation: files[cr.Fname].generation, sealed: files[cr.Fname].sealed, chunkNum: cr.ChunkNum,
+		version: fvo.version, checksum: fvo.checksum, trace: span.Context()}
+	stateLock.Unlock()
+
+	// The receipt is only the reader's claim, so ask the reader for the chunk's
+	// checksum as the scrubber would before listing it as an owner
+	if record.version != cr.Version || !verifyOwner(cr.User, record) {
+		*reply = false
+		return nil
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if files[cr.Fname] == nil {
+		return FileUnavailableError(cr.Fname)
+	}
+	// The file may have been removed and created again meanwhile
+	fvo = currentChunk(record)
+	if fvo == nil {
+		*reply = false
+		return nil
+	}
+
+	if containsUser(cr.Owner, fvo.owners) {
+		recordLatency(cr.Owner, cr.Latency, true)
+	}
+	if !containsUser(cr.User, fvo.owners) {
+		fvo.owners = append(fvo.owners, cr.User)
+	}
+	*reply = true
+	return nil
+}
+
+/*
+ Purpose:
+ Params:
+ Returns
+ Throws:
+*/
+func (s *ServerRPC) CloseFile(fi FileInfo, reply *bool) (err error) {
+	defer observeRPC("CloseFile", time.Now(), &err)
+	span := tracer.Start("server.CloseFile", tracing.KindServer, fi.Trace,
+		tracing.A(logging.KeyUser, fi.User), tracing.A(logging.KeyFile, fi.Name))
+	defer span.Finish(&err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(fi.User)
+	if err != nil {
+		return err
+	}
+
+	fs := files[fi.Name]
+	if fs != nil && fi.Fmode == WRITE && fs.isLockedForWrite && userEquals(fs.writer, fi.User) {
+		releaseWriteAccess(fs)
+	}
+	if filesOpened[fi.User] != nil {
+		delete(filesOpened[fi.User], fi.Name)
+	}
+	*reply = true
+	return nil
+}
+
+/*
+ Purpose: Replaces the ACL entries of a file
+ Params: ai - the requesting user, the file, and the new entries; ai.ACL.Owner is ignored
+ Returns
+ Throws: FileUnavailableError if the file does not exist; PermissionDeniedError
+         unless the user owns the file or holds PermAdmin
+*/
+func (s *ServerRPC) SetACL(ai ACLInfo, reply *bool) (err error) {
+	defer observeRPC("SetACL", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(ai.User)
+	if err != nil {
+		return err
+	}
+
+	fs := files[ai.Fname]
+	if fs == nil {
+		return FileUnavailableError(ai.Fname)
+	}
+	if !hasPermission(ai.Fname, ai.User, PermAdmin) {
+		return PermissionDeniedError(ai.Fname)
+	}
+
+	fs.acl = make(map[string]Permission, len(ai.ACL.Entries))
+	for principal, perm := range ai.ACL.Entries {
+		fs.acl[principal] = perm
+	}
+
+	*reply = true
+	return nil
+}
+
+/*
+ Purpose: Looks up the owner and ACL entries of a file
+ Params: ai - the requesting user and the file
+ Returns: acl - the file's owner and entries
+ Throws: FileUnavailableError if the file does not exist; PermissionDeniedError
+         unless the user may read the file
+*/
+func (s *ServerRPC) GetACL(ai ACLInfo, acl *ACL) (err error) {
+	defer observeRPC("GetACL", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(ai.User)
+	if err != nil {
+		return err
+	}
+
+	fs := files[ai.Fname]
+	if fs == nil {
+		return FileUnavailableError(ai.Fname)
+	}
+	if !hasPermission(ai.Fname, ai.User, PermRead) {
+		return PermissionDeniedError(ai.Fname)
+	}
+
+	acl.Owner = fs.owner
+	acl.Entries = make(map[string]Permission, len(fs.acl))
+	for principal, perm := range fs.acl {
+		acl.Entries[principal] = perm
+	}
+	return nil
+}
+
+/*
+ Purpose: Lists the files a user may read
+ Params: user - the calling user
+ Returns: fnames - the readable file names
+ Throws:
+*/
+func (s *ServerRPC) ListFiles(user UserInfo, fnames *[]string) (err error) {
+	defer observeRPC("ListFiles", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(user)
+	if err != nil {
+		return err
+	}
+
+	*fnames = make([]string, 0)
+	for fname := range files {
+		if hasPermission(fname, user, PermRead) {
+			*fnames = append(*fnames, fname)
+		}
+	}
+	return nil
+}
+
+/*
+ Purpose: Describes a file's owner, encryption, write lock and chunk versions
+ Params: fi - the calling user and the file
+ Returns: stat - the file's metadata
+ Throws: FileUnavailableError; PermissionDeniedError unless the user may read the file
+*/
+func (s *ServerRPC) StatFile(fi FileInfo, stat *FileStat) (err error) {
+	defer observeRPC("StatFile", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(fi.User)
+	if err != nil {
+		return err
+	}
+
+	fs := files[fi.Name]
+	if fs == nil {
+		return FileUnavailableError(fi.Name)
+	}
+	if !hasPermission(fi.Name, fi.User, PermRead) {
+		return PermissionDeniedError(fi.Name)
+	}
+
+	stat.Name = fi.Name
+	stat.Owner = fs.owner
+	stat.Sealed = fs.sealed
+	stat.IsLockedForWrite = fs.isLockedForWrite
+	for i, fvo := range fs.chunkVersion {
+		if fvo != nil {
+			stat.Versions[i] = fvo.version
+			stat.Owners[i] = len(fvo.owners)
+		}
+	}
+	return nil
+}
+
+/*
+ Purpose: Deletes a file that no user has open, releasing its quota
+ Params: fi - the calling user and the file
+ Returns
+ Throws: FileUnavailableError; PermissionDeniedError unless the user owns the file or
+         holds PermAdmin; FileInUseError if any user has the file open
+*/
+func (s *ServerRPC) RemoveFile(fi FileInfo, reply *bool) (err error) {
+	defer observeRPC("RemoveFile", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(fi.User)
+	if err != nil {
+		return err
+	}
+
+	fs := files[fi.Name]
+	if fs == nil {
+		return FileUnavailableError(fi.Name)
+	}
+	if !hasPermission(fi.Name, fi.User, PermAdmin) {
+		return PermissionDeniedError(fi.Name)
+	}
+	for _, opened := range filesOpened {
+		if _, ok := opened[fi.Name]; ok {
+			return FileInUseError(fi.Name)
+		}
+	}
+
+	for _, fvo := range fs.chunkVersion {
+		if fvo != nil && fvo.version > 0 {
+			ownerUsage[fs.owner] -= chunkBytes(fs)
+			if fs.namespace != "" {
+				namespaceUsage[fs.namespace] -= chunkBytes(fs)
+			}
+		}
+	}
+
+	delete(files, fi.Name)
+	notifyWatchers(FileEvent{Fname: fi.Name, Removed: true})
+	delete(watchers, fi.Name)
+
+	logger.Log(logging.Info, "Removed file", logging.F(logging.KeyUser, fi.User), logging.F(logging.KeyFile, fi.Name))
+	*reply = true
+	return nil
+}
+
+/*
+ Purpose: Subscribes a user to FileEvents for a file until it is removed or the user unregisters
+ Params: fi - the calling user and the file
+ Returns
+ Throws: FileUnavailableError; PermissionDeniedError unless the user may read the file
+*/
+func (s *ServerRPC) WatchFile(fi FileInfo, reply *bool) (err error) {
+	defer observeRPC("WatchFile", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(fi.User)
+	if err != nil {
+		return err
+	}
+
+	if files[fi.Name] == nil {
+		return FileUnavailableError(fi.Name)
+	}
+	if !hasPermission(fi.Name, fi.User, PermRead) {
+		return PermissionDeniedError(fi.Name)
+	}
+
+	if !containsUser(fi.User, watchers[fi.Name]) {
+		watchers[fi.Name] = append(watchers[fi.Name], fi.User)
+	}
+	*reply = true
+	return nil
+}
+
+/*
+ Purpose: Reports the bytes stored in files owned by the caller
+ Params: user - the calling user
+ Returns: usage - the caller's principal, bytes stored, and limit
+ Throws:
+*/
+func (s *ServerRPC) Usage(user UserInfo, usage *Usage) (err error) {
+	defer observeRPC("Usage", time.Now(), &err)
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	err = s.authenticate(user)
+	if err != nil {
+		return err
+	}
+
+	principal := principals[user]
+	*usage = Usage{Name: principal, Bytes: ownerUsage[principal], Limit: userQuota(principal)}
+	return nil
+}
+
+/*
+ Purpose: Reports the bytes stored by every owner and namespace
+ Params:
+ Returns: report - usage and limits per owner and per configured namespace
+ Throws: AdminAccessError unless the caller is an admin
+*/
+func (s *ServerRPC) AdminUsage(stub int, report *UsageReport) (err error) {
+	defer observeRPC("AdminUsage", time.Now(), &err)
+
+	if !s.isAdmin() {
+		return AdminAccessError(s.principal)
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	for owner, bytes := range ownerUsage {
+		report.Users = append(report.Users, Usage{Name: owner, Bytes: bytes, Limit: userQuota(owner)})
+	}
+	for namespace, limit := range quotas.Namespaces {
+		report.Namespaces = append(report.Namespaces, Usage{Name: namespace, Bytes: namespaceUsage[namespace], Limit: limit})
+	}
+	return nil
+}
+
+/*
+ Purpose: Lists registered users with their last heartbeat
+ Params:
+ Returns: users - the status of every registered user
+ Throws: AdminAccessError unless the caller is an admin
+*/
+func (s *ServerRPC) AdminListUsers(stub int, users *[]UserStatus) (err error) {
+	defer observeRPC("AdminListUsers", time.Now(), &err)
+
+	if !s.isAdmin() {
+		return AdminAccessError(s.principal)
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	*users = make([]UserStatus, 0, len(registeredUsers))
+	for _, user := range registeredUsers {
+		*users = append(*users, UserStatus{User: user,
+			Principal:     principals[user],
+			LastHeartbeat: sessions[principals[user]].last,
+			Suspected:     !sessions[principals[user]].suspectedAt.IsZero(),
+			Connected:     clientConns[user] != nil})
+	}
+	return nil
+}
+
+/*
+ Purpose: Lists every file with its writer, the users that have it open, and its chunk versions and owners
+ Params:
+ Returns: fileStatuses - the status of every file
+ Throws: AdminAccessError unless the caller is an admin
+*/
+func (s *ServerRPC) AdminListFiles(stub int, fileStatuses *[]FileStatus) (err error) {
+	defer observeRPC("AdminListFiles", time.Now(), &err)
+
+	if !s.isAdmin() {
+		return AdminAccessError(s.principal)
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	*fileStatuses = make([]FileStatus, 0, len(files))
+	for fname, fs := range files {
+		status := FileStatus{Name: fname,
+			Owner:            fs.owner,
+			IsLockedForWrite: fs.isLockedForWrite,
+			Writer:           fs.writer}
+
+		for user, opened := range filesOpened {
+			if fmode, ok := opened[fname]; ok {
+				status.OpenedBy = append(status.OpenedBy, OpenStatus{User: user, Fmode: fmode})
+			}
+		}
+
+		for i, fvo := range fs.chunkVersion {
+			if fvo != nil && fvo.version > 0 {
+				status.Chunks = append(status.Chunks, ChunkStatus{ChunkNum: uint8(i),
+					Version: fvo.version,
+					Owners:  append([]UserInfo(nil), fvo.owners...)})
+			}
+		}
+
+		*fileStatuses = append(*fileStatuses, status)
+	}
+	return nil
+}
+
+/*
+ Purpose: Closes a file on behalf of a user, releasing its write lock if the user holds it
+ Params: ai - the user and the file
+ Returns
+ Throws: AdminAccessError unless the caller is an admin; FileUnavailableError
+*/
+func (s *ServerRPC) AdminCloseFile(ai AdminInfo, reply *bool) (err error) {
+	defer observeRPC("AdminCloseFile", time.Now(), &err)
+
+	if !s.isAdmin() {
+		return AdminAccessError(s.principal)
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	fs := files[ai.Fname]
+	if fs == nil {
+		return FileUnavailableError(ai.Fname)
+	}
+
+	if fs.isLockedForWrite && userEquals(fs.writer, ai.User) {
+		releaseWriteAccess(fs)
+	}
+	if filesOpened[ai.User] != nil {
+		delete(filesOpened[ai.User], ai.Fname)
+	}
+
+	logger.Log(logging.Info, "Admin closed file", logging.F("admin", s.principal), logging.F(logging.KeyFile, ai.Fname), logging.F(logging.KeyUser, ai.User))
+	*reply = true
+	return nil
+}
+
+/*
+ Purpose: Releases the write lock on a file; the writer's later writes fail
+ Params: fname - the file
+ Returns
+ Throws: AdminAccessError unless the caller is an admin; FileUnavailableError
+*/
+func (s *ServerRPC) AdminRevokeWriteLock(fname string, reply *bool) (err error) {
+	defer observeRPC("AdminRevokeWriteLock", time.Now(), &err)
+
+	if !s.isAdmin() {
+		return AdminAccessError(s.principal)
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	fs := files[fname]
+	if fs == nil {
+		return FileUnavailableError(fname)
+	}
+
+	if fs.isLockedForWrite {
+		logger.Log(logging.Info, "Admin revoked write lock", logging.F("admin", s.principal), logging.F(logging.KeyFile, fname), logging.F(logging.KeyUser, fs.writer))
+		releaseWriteAccess(fs)
+	}
+	*reply = true
+	return nil
+}
+
+/*
+ Purpose: Disconnects a user as if it had missed its heartbeat
+ Params: user - the user to evict
+ Returns
+ Throws: AdminAccessError unless the caller is an admin
+*/
+func (s *ServerRPC) AdminEvictUser(user UserInfo, reply *bool) (err error) {
+	defer observeRPC("AdminEvictUser", time.Now(), &err)
+
+	if !s.isAdmin() {
+		return AdminAccessError(s.principal)
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	logger.Log(logging.Info, "Admin evicted user", logging.F("admin", s.principal), logging.F(logging.KeyUser, user))
+	endSession(user)
+
+	*reply = true
+	return nil
+}
+
+//==================================================================
+// Helper Functions
+//==================================================================
+
+/*
+ Purpose: Records the latency and outcome of a ServerRPC call
+ Params: method - the RPC name; start - when the call began; err - the call's result once it returns
+ Returns
+ Throws:
+*/
+func observeRPC(method string, start time.Time, err *error) {
+	outcome := "ok"
+	if *err != nil {
+		outcome = "error"
+	}
+	latency := time.Since(start)
+	rpcRequests.Inc(method, outcome)
+	rpcDuration.Observe(latency.Seconds(), method)
+	logger.Log(logging.Debug, "Served RPC", logging.F(logging.KeyMethod, method), logging.F(logging.KeyLatency, latency), logging.F(logging.KeyError, *err))
+}
+
+/*
+ Purpose: Checks whether this connection may call the Admin RPCs
+ Params:
+ Returns: true if the connection's principal is listed in -admins, or TLS is off
+          and the server was started with -insecure-admin
+ Throws:
+*/
+func (s *ServerRPC) isAdmin() bool {
+	if tlsConfig == nil {
+		return insecureAdmin
+	}
+
+	for _, admin := range admins {
+		if admin == s.principal {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ Purpose: Gives the bytes stored per chunk of a file
+ Params: fs - the file
  Returns
  Throws:
 */
-func (s *ServerRPC) FileExists(fname string, reply *bool) (err error) {
-	fs := files[fname]
-	if fs == nil {
-		*reply = false
-	} else {
-		fmt.Println("server: File existence - ", fs.fileExists)
-		*reply = fs.fileExists
+func chunkBytes(fs *FileState) int64 {
+	if fs.sealed {
+		return sealedChunkSize
 	}
-	return nil
+	return chunkSize
 }
 
 /*
- Purpose:
- Params:
- Returns
+ Purpose: Looks up the byte limit of a file owner
+ Params: owner - the owner's principal
+ Returns: The limit, or 0 if unlimited
  Throws:
+ Note: Callers must hold stateLock
 */
-func (s *ServerRPC) RegisterFile(fi FileInfo, reply *bool) (err error) {
-	createFileIfNotExist(fi)
-
-	err = configureWriteAccess(fi)
-	if err != nil {
-		return err
+func userQuota(owner string) int64 {
+	if limit, ok := quotas.Users[owner]; ok {
+		return limit
 	}
-
-	updateOpenedFiles(fi)
-	return nil
+	return quotas.Users[anyPrincipal]
 }
 
 /*
- Purpose:
- Params:
- Returns
+ Purpose: Finds the namespace a file belongs to
+ Params: fname - the file name
+ Returns: The longest configured namespace prefixing fname, or "" if none does
  Throws:
 */
-func (s *ServerRPC) WriteFile(wi WriteInfo, reply *bool) (err error) {
-	fs := files[wi.Fname]
-	cv := fs.chunkVersion
-	fvo := cv[wi.ChunkNum]
+func namespaceOf(fname string) string {
+	namespace := ""
+	for prefix := range quotas.Namespaces {
+		if strings.HasPrefix(fname, prefix) && len(prefix) > len(namespace) {
+			namespace = prefix
+		}
+	}
+	return namespace
+}
 
-	if fvo == nil {
-		fvo = &FileVersionOwners{version: 0, owners: make([]UserInfo, 0)}
-		cv[wi.ChunkNum] = fvo
+/*
+ Purpose: Accounts new chunk data to a file's owner and namespace
+ Params: fs - the file; bytes - the bytes being added
+ Returns
+ Throws: QuotaExceededError if either limit would be exceeded; nothing is charged then
+ Note: Callers must hold stateLock
+*/
+func chargeQuota(fs *FileState, bytes int64) error {
+	limit := userQuota(fs.owner)
+	if limit > 0 && ownerUsage[fs.owner]+bytes > limit {
+		return QuotaExceededError(fs.owner)
 	}
 
-	fvo.version++
-	fvo.owners = make([]UserInfo, 0)
-	fvo.owners = append(fvo.owners, wi.User)
+	if fs.namespace != "" {
+		limit = quotas.Namespaces[fs.namespace]
+		if limit > 0 && namespaceUsage[fs.namespace]+bytes > limit {
+			return QuotaExceededError(fs.namespace)
+		}
+		namespaceUsage[fs.namespace] += bytes
+	}
 
-	*reply = true
+	ownerUsage[fs.owner] += bytes
 	return nil
 }
 
 /*
- Purpose:
- Params:
- Returns
+ Purpose: Checks whether a user's principal is granted a permission on a file
+ Params: fname - the file; user - the user; perm - the permission required
+ Returns: true if the user owns the file or an ACL entry for the user, one of its
+          groups, or anyPrincipal grants perm
  Throws:
+ Note: Callers must hold stateLock
 */
-func (s *ServerRPC) ReadFile(ri ReadInfo, rv *ReadValue) (err error) {
-	fs := files[ri.Fname]
-	cv := fs.chunkVersion
-	fvo := cv[ri.ChunkNum]
+func hasPermission(fname string, user UserInfo, perm Permission) bool {
+	fs := files[fname]
+	principal, ok := principals[user]
+	if fs == nil || !ok {
+		return false
+	}
 
-	if fvo == nil {
-		fvo = &FileVersionOwners{version: 0, owners: make([]UserInfo, 0)}
-		cv[ri.ChunkNum] = fvo
+	if principal == fs.owner {
+		return true
 	}
 
-	if ri.LocalChunkVer < fvo.version {
-		for _, user := range fvo.owners {
-			readInfoForRetrievingChunk := ReadInfo{User: user, Fname: ri.Fname, ChunkNum: ri.ChunkNum}
-			newChunk, err := retrieveLatestChunk(readInfoForRetrievingChunk)
-			if err != nil {
-				continue
-			} else {
-				rv.Chnk = newChunk
-				rv.globalChunkVer = fvo.version
-				rv.IsNew = true
-				break
+	granted := fs.acl[anyPrincipal] | fs.acl[principal]
+	for group, members := range groups {
+		for _, member := range members {
+			if member == principal {
+				granted |= fs.acl[groupPrefix+group]
 			}
 		}
-	} else {
-		rv.IsNew = false
 	}
 
-	if !containsUser(ri.User, fvo.owners) {
-		fvo.owners = append(fvo.owners, ri.User)
-	}
+	return granted&perm == perm
+}
 
-	return nil
+// identity returns the principal a user registering over this connection is
+// known by: the common name of its certificate, or without TLS what it reports
+func (s *ServerRPC) identity(user UserInfo) string {
+	if tlsConfig == nil {
+		return user.LocalIP + " @ path " + user.LocalPath
+	}
+	return s.principal
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Checks that a user named in a request was registered over this connection's identity
+ Params: user - the user named in the request
  Returns
- Throws:
+ Throws: AuthenticationError if the user is bound to a different certificate
+ Note: Callers must hold stateLock
 */
-func (s *ServerRPC) CloseFile(fi FileInfo, reply *bool) (err error) {
-	if fi.Fmode == WRITE {
-		fs := files[fi.Name]
-		fs.isLockedForWrite = false
-		fs.writeAccess.Unlock()
+func (s *ServerRPC) authenticate(user UserInfo) error {
+	if tlsConfig == nil {
+		return nil
+	}
+
+	principal, ok := principals[user]
+	if !ok || principal != s.principal {
+		return AuthenticationError(s.principal)
 	}
-	*reply = true
 	return nil
 }
 
-//==================================================================
-// Helper Functions
-//==================================================================
-
 /*
  Purpose:
  Params:
@@ -377,6 +2667,17 @@ func containsUser(user UserInfo, regUsers []UserInfo) bool {
 	return false
 }
 
+// withoutUser returns a copy of users without user
+func withoutUser(users []UserInfo, user UserInfo) []UserInfo {
+	kept := make([]UserInfo, 0, len(users))
+	for _, u := range users {
+		if !userEquals(u, user) {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
 /*
  Purpose:
  Params:
@@ -384,6 +2685,12 @@ func containsUser(user UserInfo, regUsers []UserInfo) bool {
  Throws:
 */
 func removeUser(user UserInfo) {
+	if s := sessions[principals[user]]; s != nil {
+		heap.Remove(&reaperQueue, s.index)
+		delete(sessions, principals[user])
+	}
+	delete(principals, user)
+	forgetLatency(user)
 	arrLen := len(registeredUsers)
 
 	for i, regUser := range registeredUsers {
@@ -418,33 +2725,60 @@ func userEquals(u, ru UserInfo) bool {
 */
 func createFileIfNotExist(fi FileInfo) {
 	if files[fi.Name] == nil {
+		// New files stay open to every user until the owner restricts them
 		fs := FileState{fileExists: true,
+			sealed:           fi.Sealed,
+			owner:            principals[fi.User],
+			namespace:        namespaceOf(fi.Name),
+			acl:              map[string]Permission{anyPrincipal: PermRead | PermWrite},
 			isLockedForWrite: false,
 			writeAccess:      &sync.Mutex{},
 			chunkVersion:     make([]*FileVersionOwners, 256)}
+		lastGeneration++
+		fs.generation = lastGeneration
 
 		files[fi.Name] = &fs
 	}
 }
 
 /*
- Purpose:
- Params:
+ Purpose: Takes the write lock on a file for a WRITE open
+ Params: fi - the open; waited - how long the open waited for stateLock
  Returns
- Throws:
+ Throws: OpenWriteConflictError if another user holds the write lock
+ Note: Writers never queue for the lock, so the only wait is for stateLock
 */
-func configureWriteAccess(fi FileInfo) error {
+func configureWriteAccess(fi FileInfo, waited time.Duration) error {
 	if fi.Fmode == WRITE {
 		if files[fi.Name].isLockedForWrite == true {
+			writeConflicts.Inc()
+			writeLockWait.Observe(waited.Seconds(), "conflict")
 			return OpenWriteConflictError(fi.Name)
 		}
+		writeLockWait.Observe(waited.Seconds(), "granted")
 		files[fi.Name].isLockedForWrite = true
+		files[fi.Name].writer = fi.User
+		files[fi.Name].lockedAt = clk.Now()
 		files[fi.Name].writeAccess.Lock()
 	}
 
 	return nil
 }
 
+/*
+ Purpose: Releases the write lock on a file
+ Params: fs - a file that is locked for writing
+ Returns
+ Throws:
+ Note: Callers must hold stateLock
+*/
+func releaseWriteAccess(fs *FileState) {
+	writeLockHeld.Observe(clk.Since(fs.lockedAt).Seconds())
+	fs.isLockedForWrite = false
+	fs.writer = UserInfo{}
+	fs.writeAccess.Unlock()
+}
+
 /*
  Purpose:
  Params:
@@ -459,27 +2793,407 @@ func updateOpenedFiles(fi FileInfo) {
 	filesOpened[fi.User][fi.Name] = fi.Fmode
 }
 
+/*
+ Purpose: Pushes an event to every watcher of a file without waiting for delivery
+ Params: ev - the event
+ Returns
+ Throws:
+ Note: Callers must hold stateLock
+*/
+func notifyWatchers(ev FileEvent) {
+	conns := make([]*rpc.Client, 0)
+	for _, user := range watchers[ev.Fname] {
+		if clientConns[user] != nil {
+			conns = append(conns, clientConns[user])
+		}
+	}
+
+	go func() {
+		for _, connToClient := range conns {
+			reply := false
+			callClient(context.Background(), connToClient, "ClientRPC.NotifyFileEvent", ev, &reply)
+		}
+	}()
+}
+
+/*
+ Purpose: Looks up the version and owners of a chunk, creating them at version 0 if absent
+ Params: fname - the file name; chunkNum - the chunk within the file
+ Returns: The chunk's version and owners
+ Throws:
+*/
+func chunkOwners(fname string, chunkNum uint8) *FileVersionOwners {
+	cv := files[fname].chunkVersion
+	fvo := cv[chunkNum]
+
+	if fvo == nil {
+		fvo = &FileVersionOwners{version: 0, owners: make([]UserInfo, 0)}
+		cv[chunkNum] = fvo
+	}
+
+	return fvo
+}
+
 /*
  Purpose:
  Params:
  Returns
  Throws:
 */
-func retrieveLatestChunk(ri ReadInfo) (c Chunk, err error) {
+func retrieveLatestChunk(ctx context.Context, ri ReadInfo) (c []byte, err error) {
+	span := tracer.Start("server.RetrieveLatestChunk", tracing.KindClient, ri.Trace,
+		tracing.A("owner", ri.User), tracing.A(logging.KeyFile, ri.Fname), tracing.A(logging.KeyChunk, ri.ChunkNum))
+	defer span.Finish(&err)
+	ri.Trace = span.Context()
+
+	stateLock.Lock()
 	connToClient := clientConns[ri.User]
+	isRegistered := containsUser(ri.User, registeredUsers)
+	stateLock.Unlock()
 
-	if containsUser(ri.User, registeredUsers) && connToClient != nil {
-		err = connToClient.Call("ClientRPC.RetrieveLatestChunk", ri, &c)
-		if err != nil {
+	if isRegistered && connToClient != nil {
+		err = callClient(ctx, connToClient, "ClientRPC.RetrieveLatestChunk", ri, &c)
+		if err == context.DeadlineExceeded {
+			fetchAttempts.Inc("timeout")
+			return c, ChunkUnavailableError(ri.ChunkNum)
+		} else if err == context.Canceled {
+			fetchAttempts.Inc("abandoned")
+			return c, ChunkUnavailableError(ri.ChunkNum)
+		} else if err != nil {
+			fetchAttempts.Inc("error")
 			return c, ChunkUnavailableError(ri.ChunkNum)
 		}
 	} else {
+		fetchAttempts.Inc("unreachable")
 		return c, ChunkUnavailableError(ri.ChunkNum)
 	}
 
+	fetchAttempts.Inc("ok")
 	return c, nil
 }
 
+/*
+ Purpose: Fetches the stale chunks of a ReadChunks call in batches, asking each owner
+          with ClientRPC.RetrieveLatestChunks for every chunk it ranks first for
+ Params: ctx - the reader's context; rci - the read; trace - the caller's span
+ Returns: The bytes each owner returned, by chunk; chunks missing or failing their
+          checksum are left for fetchChunk
+ Throws:
+*/
+func fetchChunkBatches(ctx context.Context, rci ReadChunksInfo, trace tracing.SpanContext) map[uint8][]byte {
+	if rci.Direct && tlsConfig != nil {
+		return nil
+	}
+
+	stateLock.Lock()
+	if files[rci.Fname] == nil {
+		stateLock.Unlock()
+		return nil
+	}
+	stale := make(map[uint8][]UserInfo)
+	for i, chunkNum := range rci.ChunkNums {
+		localVer := 0
+		if i < len(rci.LocalChunkVers) {
+			localVer = rci.LocalChunkVers[i]
+		}
+		fvo := chunkOwners(rci.Fname, chunkNum)
+		if localVer != fvo.version && len(fvo.owners) > 0 {
+			stale[chunkNum] = append([]UserInfo(nil), fvo.owners...)
+		}
+	}
+	sealed := files[rci.Fname].sealed
+	stateLock.Unlock()
+
+	batches := make(map[UserInfo][]uint8)
+	for chunkNum, owners := range stale {
+		first := rankOwners(owners)[0]
+		batches[first] = append(batches[first], chunkNum)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	fetched := make(map[uint8][]byte)
+	for owner, chunkNums := range batches {
+		// A lone chunk gains nothing from batching and is better hedged
+		if len(chunkNums) < 2 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(owner UserInfo, chunkNums []uint8) {
+			defer wg.Done()
+			ri := ReadChunksInfo{User: owner, Fname: rci.Fname, ChunkNums: chunkNums, Sealed: sealed, Trace: trace}
+			data, err := retrieveLatestChunks(ctx, ri)
+			if err != nil {
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			for i, chunkNum := range chunkNums {
+				if i < len(data) && data[i] != nil {
+					fetched[chunkNum] = data[i]
+				}
+			}
+		}(owner, chunkNums)
+	}
+	wg.Wait()
+
+	return fetched
+}
+
+/*
+ Purpose: Asks one owner for many chunks of a file in a single call
+ Params: ctx - the reader's context; ri - the owner as User, the file, and the chunks
+ Returns: The stored bytes of each chunk, nil for any the owner does not hold
+ Throws: ChunkUnavailableError if the owner cannot be reached or fails
+*/
+func retrieveLatestChunks(ctx context.Context, ri ReadChunksInfo) (data [][]byte, err error) {
+	span := tracer.Start("server.RetrieveLatestChunks", tracing.KindClient, ri.Trace,
+		tracing.A("owner", ri.User), tracing.A(logging.KeyFile, ri.Fname), tracing.A("chunks", len(ri.ChunkNums)))
+	defer span.Finish(&err)
+	ri.Trace = span.Context()
+
+	stateLock.Lock()
+	connToClient := clientConns[ri.User]
+	isRegistered := containsUser(ri.User, registeredUsers)
+	stateLock.Unlock()
+
+	if !isRegistered || connToClient == nil {
+		batchFetches.Add(float64(len(ri.ChunkNums)), "unreachable")
+		return nil, ChunkUnavailableError(ri.ChunkNums[0])
+	}
+
+	start := time.Now()
+	err = callClient(ctx, connToClient, "ClientRPC.RetrieveLatestChunks", ri, &data)
+	if err != nil {
+		// Only failures affect the owner's ranking, as a batch takes longer than one chunk
+		recordLatency(ri.User, time.Since(start), false)
+		batchFetches.Add(float64(len(ri.ChunkNums)), "error")
+		return nil, ChunkUnavailableError(ri.ChunkNums[0])
+	}
+
+	for _, d := range data {
+		if d != nil {
+			batchFetches.Inc("ok")
+		} else {
+			batchFetches.Inc("missing")
+		}
+	}
+	return data, nil
+}
+
+//==================================================================
+// Owner selection
+//==================================================================
+
+type fetchResult struct {
+	data []byte
+	err  error
+}
+
+/*
+ Purpose: Fetches a chunk version from its owners, fastest first, hedging slow owners
+ Params: ctx - bounds the whole fetch; ri - the chunk, with User set per owner;
+         owners - users recorded as holding the version; checksum - of the version's stored bytes
+ Returns: The first owner's copy matching checksum, and the number of owners asked
+ Throws: ChunkUnavailableError if every owner fails, ctx.Err() if ctx is done first
+*/
+func fetchChunk(ctx context.Context, ri ReadInfo, owners []UserInfo, checksum [sha256.Size]byte) (data []byte, attempts int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // abandons owners still fetching once one has answered
+
+	ranked := rankOwners(owners)
+	results := make(chan fetchResult, len(ranked))
+	launch := func() {
+		fetchInfo := ri
+		fetchInfo.User = ranked[attempts]
+		attempts++
+		go func() {
+			start := time.Now()
+			d, err := retrieveLatestChunk(ctx, fetchInfo)
+			if err == nil && sha256.Sum256(d) != checksum {
+				err = ChunkUnavailableError(ri.ChunkNum)
+			}
+
+			elapsed := time.Since(start)
+			if err == nil {
+				recordLatency(fetchInfo.User, elapsed, true)
+			} else if ctx.Err() != nil {
+				// Abandoned, so its elapsed time is only a lower bound on its latency
+				recordLatency(fetchInfo.User, elapsed, false)
+			} else if elapsed < clientTimeout {
+				recordLatency(fetchInfo.User, clientTimeout, false)
+			} else {
+				recordLatency(fetchInfo.User, elapsed, false)
+			}
+			results <- fetchResult{data: d, err: err}
+		}()
+	}
+
+	delay := hedgeDelay()
+	pending := 0
+	for attempts < len(ranked) || pending > 0 {
+		if pending == 0 || (delay == 0 && attempts < len(ranked)) {
+			launch()
+			pending++
+			continue
+		}
+
+		hedge := time.NewTimer(delay)
+		if attempts == len(ranked) {
+			hedge.Stop() // no owner left to ask
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				hedge.Stop()
+				return r.data, attempts, nil
+			}
+			if attempts < len(ranked) {
+				launch()
+				pending++
+			}
+		case <-hedge.C:
+			fetchHedges.Inc()
+			launch()
+			pending++
+		case <-ctx.Done():
+			hedge.Stop()
+			return nil, attempts, ctx.Err()
+		}
+		hedge.Stop()
+	}
+
+	return nil, attempts, ChunkUnavailableError(ri.ChunkNum)
+}
+
+/*
+ Purpose: Filters out owners that peers cannot dial, whose calls are multiplexed over
+          their connection to the server
+ Params: owners - the candidates
+ Returns: The owners a reader may fetch from directly
+ Throws:
+ Note: Callers must hold stateLock
+*/
+func reachableOwners(owners []UserInfo) []UserInfo {
+	reachable := make([]UserInfo, 0, len(owners))
+	for _, owner := range owners {
+		if !multiplexed[owner] {
+			reachable = append(reachable, owner)
+		}
+	}
+	return reachable
+}
+
+/*
+ Purpose: Orders owners by their average fetch latency, untried owners first
+ Params: owners - the candidates
+ Returns: A sorted copy of owners
+ Throws:
+*/
+func rankOwners(owners []UserInfo) []UserInfo {
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+
+	ranked := append([]UserInfo(nil), owners...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ownerLatency[ranked[i]] < ownerLatency[ranked[j]]
+	})
+	return ranked
+}
+
+/*
+ Purpose: Folds a fetch latency into an owner's moving average
+ Params: owner - the owner asked; d - its latency; ok - true if it answered, so d also informs hedgeDelay
+ Returns
+ Throws:
+*/
+func recordLatency(owner UserInfo, d time.Duration, ok bool) {
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+
+	if avg, known := ownerLatency[owner]; known {
+		ownerLatency[owner] = avg + time.Duration(latencyWeight*float64(d-avg))
+	} else {
+		ownerLatency[owner] = d
+	}
+
+	if ok {
+		recentLatencies[numLatencies%latencySamples] = d
+		numLatencies++
+	}
+}
+
+/*
+ Purpose: Computes how long to wait on an owner before asking another
+ Params:
+ Returns: hedgePercentile of recent successful fetch latencies, at least minHedgeDelay,
+          clientTimeout before any samples exist, or 0 to ask every owner at once
+ Throws:
+*/
+func hedgeDelay() time.Duration {
+	if hedgePercentile <= 0 {
+		return 0
+	}
+
+	latencyLock.Lock()
+	n := numLatencies
+	if n > latencySamples {
+		n = latencySamples
+	}
+	samples := append([]time.Duration(nil), recentLatencies[:n]...)
+	latencyLock.Unlock()
+
+	if n == 0 {
+		return clientTimeout
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(float64(n-1) * hedgePercentile / 100)
+	if i >= n {
+		i = n - 1
+	}
+	if samples[i] < minHedgeDelay*time.Millisecond {
+		return minHedgeDelay * time.Millisecond
+	}
+	return samples[i]
+}
+
+func forgetLatency(user UserInfo) {
+	latencyLock.Lock()
+	delete(ownerLatency, user)
+	latencyLock.Unlock()
+}
+
+/*
+ Purpose: Calls a ClientRPC method, giving up after clientTimeout or when ctx is done
+ Params: ctx - the caller's bound, if any; connToClient - the client; method, args, reply - as for rpc.Client.Call
+ Returns
+ Throws: context.DeadlineExceeded or context.Canceled if abandoned, else any error from the call
+ Note: The reply is decoded into a copy and only stored in reply on success, since
+       an abandoned call may still be answered after this returns
+*/
+func callClient(ctx context.Context, connToClient *rpc.Client, method string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, clientTimeout)
+	defer cancel()
+
+	result := reflect.New(reflect.TypeOf(reply).Elem())
+	call := connToClient.Go(method, args, result.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+		reflect.ValueOf(reply).Elem().Set(result.Elem())
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 //==================================================================
 // Errors
 //==================================================================
@@ -504,9 +3218,85 @@ func (e HeartbeatRegistrationError) Error() string {
 	return fmt.Sprintf("server: The user [%s] sent a heartbeat, but is not registered\n", string(e))
 }
 
+type UnregisteredUserError string
+
+func (e UnregisteredUserError) Error() string {
+	return fmt.Sprintf("server: The user [%s] is not registered\n", string(e))
+}
+
+// Contains the session ID
+type SessionExpiredError string
+
+func (e SessionExpiredError) Error() string {
+	return fmt.Sprintf("DFS: Session [%s] has ended; remount to start another", string(e))
+}
+
 // Contains filename
 type OpenWriteConflictError string
 
 func (e OpenWriteConflictError) Error() string {
 	return fmt.Sprintf("DFS: Filename [%s] is opened for writing by another client", string(e))
 }
+
+// Contains the certificate identity of the connection
+type AuthenticationError string
+
+func (e AuthenticationError) Error() string {
+	return fmt.Sprintf("server: The connection authenticated as [%s] may not act for this user", string(e))
+}
+
+// Contains filename
+type PermissionDeniedError string
+
+func (e PermissionDeniedError) Error() string {
+	return fmt.Sprintf("DFS: Permission denied on filename [%s]", string(e))
+}
+
+// Contains filename
+type FileUnavailableError string
+
+func (e FileUnavailableError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] is unavailable", string(e))
+}
+
+// Contains filename
+type EncryptionModeError string
+
+func (e EncryptionModeError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] must be opened with the encryption mode it was created with", string(e))
+}
+
+// Contains filename
+type ChunkVersionError string
+
+func (e ChunkVersionError) Error() string {
+	return fmt.Sprintf("DFS: Chunks of filename [%s] were sealed for versions they are not at", string(e))
+}
+
+// Contains the owner or namespace whose quota is exhausted
+type QuotaExceededError string
+
+func (e QuotaExceededError) Error() string {
+	return fmt.Sprintf("DFS: Storage quota exceeded for [%s]", string(e))
+}
+
+// Contains the principal of the connection
+type AdminAccessError string
+
+func (e AdminAccessError) Error() string {
+	return fmt.Sprintf("server: Principal [%s] is not an administrator", string(e))
+}
+
+// Contains filename
+type WriteModeTimeoutError string
+
+func (e WriteModeTimeoutError) Error() string {
+	return fmt.Sprintf("DFS: Write access to filename [%s] has timed out; reopen the file", string(e))
+}
+
+// Contains filename
+type FileInUseError string
+
+func (e FileInUseError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] is open by a client", string(e))
+}
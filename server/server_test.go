@@ -0,0 +1,269 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"../clock"
+	"../dfslib"
+	"../harness"
+)
+
+const eventTimeout = 5000 // bounds the wait for each expected file event in milliseconds
+
+// eventRecorder stands in for a watcher's ClientRPC, recording the events it is sent
+type eventRecorder struct {
+	events chan FileEvent
+}
+
+func (r *eventRecorder) NotifyFileEvent(ev FileEvent, reply *bool) error {
+	r.events <- ev
+	*reply = true
+	return nil
+}
+
+// pipeClient returns an RPC client whose calls are served by rcvr as ClientRPC
+func pipeClient(rcvr interface{}) *rpc.Client {
+	server := rpc.NewServer()
+	server.RegisterName("ClientRPC", rcvr)
+	serverEnd, clientEnd := net.Pipe()
+	go server.ServeConn(serverEnd)
+	return rpc.NewClient(clientEnd)
+}
+
+func TestEndSessionFreesResources(t *testing.T) {
+	victim := UserInfo{LocalIP: "127.0.0.1:1", LocalPath: "/victim/"}
+	watcher := UserInfo{LocalIP: "127.0.0.1:2", LocalPath: "/watcher/"}
+	recorder := &eventRecorder{events: make(chan FileEvent, 8)}
+	victimConn := pipeClient(&eventRecorder{events: make(chan FileEvent, 8)})
+
+	clk = clock.NewFake(time.Now())
+	clientTimeout = time.Second
+	fs := &FileState{fileExists: true, writeAccess: &sync.Mutex{}, chunkVersion: make([]*FileVersionOwners, 256)}
+	fs.writeAccess.Lock()
+	fs.isLockedForWrite, fs.writer, fs.lockedAt = true, victim, clk.Now()
+	fs.chunkVersion[0] = &FileVersionOwners{version: 1, owners: []UserInfo{victim}}
+	fs.chunkVersion[1] = &FileVersionOwners{version: 2, owners: []UserInfo{victim, watcher}}
+	files = map[string]*FileState{"shared": fs}
+	filesOpened = map[UserInfo]map[string]FileMode{victim: {"shared": WRITE}, watcher: {"shared": READ}}
+	watchers = map[string][]UserInfo{"shared": {victim, watcher}}
+	clientConns = map[UserInfo]*rpc.Client{victim: victimConn, watcher: pipeClient(recorder)}
+	registeredUsers = []UserInfo{victim, watcher}
+	principals = map[UserInfo]string{}
+	sessions = map[string]*session{}
+
+	stateLock.Lock()
+	endSession(victim)
+	stateLock.Unlock()
+
+	if fs.isLockedForWrite {
+		t.Error("write lock still held")
+	}
+	if containsUser(victim, fs.chunkVersion[0].owners) || containsUser(victim, fs.chunkVersion[1].owners) {
+		t.Error("victim still listed as an owner")
+	}
+	if !containsUser(watcher, fs.chunkVersion[1].owners) {
+		t.Error("other owner pruned")
+	}
+	if filesOpened[victim] != nil {
+		t.Error("files opened by the victim not cleared")
+	}
+	if containsUser(victim, watchers["shared"]) {
+		t.Error("victim still watching")
+	}
+	if containsUser(victim, registeredUsers) {
+		t.Error("victim still registered")
+	}
+	if clientConns[victim] != nil {
+		t.Error("connection to the victim still listed")
+	}
+	if err := victimConn.Call("ClientRPC.NotifyFileEvent", FileEvent{}, new(bool)); err != rpc.ErrShutdown {
+		t.Errorf("connection to the victim not closed: %v", err)
+	}
+
+	// Only chunk 0 lost its last owner
+	want := map[FileEvent]bool{{Fname: "shared", Released: true}: true,
+		{Fname: "shared", ChunkNum: 0, Version: 1, Unavailable: true}: true}
+	for len(want) > 0 {
+		select {
+		case ev := <-recorder.events:
+			if !want[ev] {
+				t.Fatalf("unexpected event %+v", ev)
+			}
+			delete(want, ev)
+		case <-time.After(eventTimeout * time.Millisecond):
+			t.Fatalf("events not delivered: %v", want)
+		}
+	}
+}
+
+// Direct readers are never sent to a multiplexed owner, which they cannot dial
+func TestReachableOwners(t *testing.T) {
+	plain := UserInfo{LocalIP: "127.0.0.1:1", LocalPath: "/plain/"}
+	muxed := UserInfo{LocalIP: "127.0.0.1:2", LocalPath: "/muxed/"}
+	multiplexed = map[UserInfo]bool{plain: false, muxed: true}
+
+	peers := reachableOwners([]UserInfo{muxed, plain})
+	if len(peers) != 1 || !userEquals(peers[0], plain) {
+		t.Errorf("got %v, want only %v", peers, plain)
+	}
+	if peers := reachableOwners([]UserInfo{muxed}); len(peers) != 0 {
+		t.Errorf("got %v, want none", peers)
+	}
+}
+
+// Each way a session ends must free what the client held and tell the watchers
+func TestSessionTeardown(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts test clusters")
+	}
+
+	tests := []struct {
+		name     string
+		released bool // whether the session still held the write lock when it ended
+		end      func(c *harness.Cluster, victim *harness.Client, user UserInfo) error
+	}{
+		{"reap", true, func(c *harness.Cluster, victim *harness.Client, user UserInfo) error {
+			victim.Kill()
+			return c.Advance(30 * time.Second)
+		}},
+		// Unmounting closes the file, releasing the lock, before it unregisters
+		{"Unregister", false, func(c *harness.Cluster, victim *harness.Client, user UserInfo) error {
+			return victim.Unmount()
+		}},
+		{"evict", true, func(c *harness.Cluster, victim *harness.Client, user UserInfo) error {
+			return adminCall(c, "ServerRPC.AdminEvictUser", user, new(bool))
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := harness.NewCluster(2, harness.WithFakeClock(), harness.WithServerFlags("-insecure-admin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			victim, other := c.Clients[0], c.Clients[1]
+
+			f, err := victim.Open("shared", dfslib.WRITE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.Write(0, harness.ChunkOf("only copy"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = victim.Watch("shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := other.Watch("shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user := registeredUser(t, c, victim)
+			before := fileStatus(t, c, "shared")
+			if !before.IsLockedForWrite || len(before.Chunks) != 1 || !containsUser(user, before.Chunks[0].Owners) {
+				t.Fatalf("victim does not hold the file: %+v", before)
+			}
+			err = test.end(c, victim, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[dfslib.FileEvent]bool{{Fname: "shared", ChunkNum: 0, Version: 1, Unavailable: true}: true}
+			if test.released {
+				want[dfslib.FileEvent{Fname: "shared", Released: true}] = true
+			}
+			for len(want) > 0 {
+				ev, ok, err := w.Next(eventTimeout * time.Millisecond)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					t.Fatalf("events not delivered: %v", want)
+				}
+				delete(want, ev)
+			}
+
+			var users []UserStatus
+			err = adminCall(c, "ServerRPC.AdminListUsers", 0, &users)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range users {
+				if userEquals(u.User, user) {
+					t.Errorf("still registered: %+v", u)
+				}
+			}
+
+			after := fileStatus(t, c, "shared")
+			if after.IsLockedForWrite {
+				t.Errorf("still locked by %v", after.Writer)
+			}
+			for _, opened := range after.OpenedBy {
+				if userEquals(opened.User, user) {
+					t.Error("still open")
+				}
+			}
+			for _, chunk := range after.Chunks {
+				if containsUser(user, chunk.Owners) {
+					t.Errorf("still an owner of chunk %d", chunk.ChunkNum)
+				}
+			}
+
+			// The lock is free for the other client
+			g, err := other.Open("shared", dfslib.WRITE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.Close()
+		})
+	}
+}
+
+// adminCall calls an Admin RPC on the cluster's server, which must run with -insecure-admin
+func adminCall(c *harness.Cluster, method string, args interface{}, reply interface{}) error {
+	server, err := rpc.Dial("tcp", c.Server.Addr)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	return server.Call(method, args, reply)
+}
+
+// fileStatus returns the server's status of a file
+func fileStatus(t *testing.T, c *harness.Cluster, fname string) FileStatus {
+	var statuses []FileStatus
+	err := adminCall(c, "ServerRPC.AdminListFiles", 0, &statuses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range statuses {
+		if fs.Name == fname {
+			return fs
+		}
+	}
+	t.Fatalf("no file %s", fname)
+	return FileStatus{}
+}
+
+// registeredUser finds the UserInfo the server holds for a client
+func registeredUser(t *testing.T, c *harness.Cluster, client *harness.Client) UserInfo {
+	var users []UserStatus
+	err := adminCall(c, "ServerRPC.AdminListUsers", 0, &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range users {
+		if u.User.LocalPath == client.Path {
+			return u.User
+		}
+	}
+	t.Fatalf("%s is not registered", client.Name())
+	return UserInfo{}
+}
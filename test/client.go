@@ -26,6 +26,21 @@ type UserInfo struct {
 	LocalPath string
 }
 
+type RegisterInfo struct {
+	User              UserInfo
+	HeartbeatInterval time.Duration
+}
+
+type RegisterValue struct {
+	Session           string
+	HeartbeatInterval time.Duration
+}
+
+type HeartbeatInfo struct {
+	User    UserInfo
+	Session string
+}
+
 func main() {
 	args := os.Args[1:]
 	clientIPPort = args[0]
@@ -46,8 +61,8 @@ func main() {
 		fmt.Println("client: Failed to ping server")
 	}
 
-	var reply2 bool
-	err = client.Call("ServerRPC.Register", myUser, &reply2)
+	var reply2 RegisterValue
+	err = client.Call("ServerRPC.Register", RegisterInfo{User: myUser}, &reply2)
 	// err = client.Call("ServerRPC.Register", myUser, &reply2)
 	// if err != nil {
 	// 	fmt.Println("client: Failed to register with server")
@@ -56,7 +71,7 @@ func main() {
 	for {
 		var reply3 bool
 		fmt.Println("@@")
-		err = client.Call("ServerRPC.SendHeartbeat", myUser, &reply3)
+		err = client.Call("ServerRPC.SendHeartbeat", HeartbeatInfo{User: myUser, Session: reply2.Session}, &reply3)
 		fmt.Println("##")
 		if err != nil {
 			fmt.Println(err.Error()) // failure detector on client side
@@ -0,0 +1,262 @@
+// Package tracing records spans across the client, the server and peers
+// serving chunks, and exports them in the OpenTelemetry (OTLP) JSON
+// encoding to a collector or a file. Span contexts travel inside RPC
+// arguments, so any hop may start a child of the caller's span.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	batchSize     = 64
+	flushInterval = 1000 // milliseconds
+)
+
+// A SpanContext identifies a span within a trace. The zero value means
+// the caller is not tracing.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats the context as a W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]))
+}
+
+type SpanKind int
+
+// Values match the OTLP SpanKind enum
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// An Attribute is a key and value attached to a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func A(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanData is a finished span as handed to an Exporter
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanContext
+	Start, End time.Time
+	Attributes []Attribute
+	Err        string // empty unless the span failed
+}
+
+// An Exporter delivers finished spans, tagged with the service that recorded them
+type Exporter interface {
+	Export(service string, spans []SpanData) error
+	Shutdown() error
+}
+
+// A Tracer starts spans for one service and exports them in batches.
+// A nil *Tracer is valid and records nothing.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	lock     sync.Mutex
+	pending  []SpanData
+	closed   bool           // set by Shutdown, after which spans are dropped
+	flushes  sync.WaitGroup // flushes started by record, which Shutdown waits for
+	done     chan struct{}
+	stopped  chan struct{}
+
+	shutdown    sync.Once
+	shutdownErr error
+}
+
+// A Span is an operation in progress. A nil *Span is valid and records nothing.
+type Span struct {
+	tracer *Tracer
+	lock   sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+/*
+ Purpose: Creates a tracer that exports its spans through e
+ Params: service - reported as the OTLP service.name, e.g. "dfs-server"; e - the exporter
+ Returns: The tracer, flushing batches in the background until Shutdown
+ Throws:
+*/
+func NewTracer(service string, e Exporter) *Tracer {
+	t := &Tracer{service: service, exporter: e, done: make(chan struct{}), stopped: make(chan struct{})}
+	go t.flushPeriodically()
+	return t
+}
+
+/*
+ Purpose: Starts a span
+ Params: name - the operation; kind - its role in the call; parent - the caller's context, or zero to start a trace; attrs - initial attributes
+ Returns: The span, which the caller must End
+ Throws:
+*/
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext, attrs ...Attribute) *Span {
+	if t == nil {
+		return nil
+	}
+
+	sc := SpanContext{TraceID: parent.TraceID}
+	if !parent.IsValid() {
+		rand.Read(sc.TraceID[:])
+		parent = SpanContext{}
+	}
+	rand.Read(sc.SpanID[:])
+
+	return &Span{tracer: t, data: SpanData{Name: name, Kind: kind, Context: sc, Parent: parent,
+		Start: time.Now(), Attributes: attrs}}
+}
+
+/*
+ Purpose: Exports any pending spans and stops the exporter. Spans that end
+          afterwards are dropped, and later calls do nothing.
+ Params:
+ Returns
+ Throws: Any error from the final export or the exporter's shutdown
+*/
+func (t *Tracer) Shutdown() error {
+	if t == nil {
+		return nil
+	}
+
+	t.shutdown.Do(func() {
+		t.lock.Lock()
+		t.closed = true
+		t.lock.Unlock()
+
+		close(t.done)
+		<-t.stopped
+		t.flushes.Wait()
+		err := t.flush()
+		if shutdownErr := t.exporter.Shutdown(); err == nil {
+			err = shutdownErr
+		}
+		t.shutdownErr = err
+	})
+	return t.shutdownErr
+}
+
+func (t *Tracer) flushPeriodically() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(flushInterval * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *Tracer) flush() error {
+	t.lock.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.exporter.Export(t.service, spans)
+}
+
+func (t *Tracer) record(sd SpanData) {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	t.pending = append(t.pending, sd)
+	full := len(t.pending) >= batchSize
+	if full {
+		t.flushes.Add(1)
+	}
+	t.lock.Unlock()
+
+	if full {
+		go func() {
+			defer t.flushes.Done()
+			t.flush()
+		}()
+	}
+}
+
+// Context returns the span's context, to be sent to the callee. It is
+// zero for a nil span, so callees start no children.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.data.Attributes = append(s.data.Attributes, A(key, value))
+	s.lock.Unlock()
+}
+
+// SetError marks the span failed if err is not nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	s.data.Err = err.Error()
+	s.lock.Unlock()
+}
+
+// Finish records *err, if set, and ends the span. It suits deferring
+// from functions with a named error result.
+func (s *Span) Finish(err *error) {
+	if s == nil {
+		return
+	}
+	s.SetError(*err)
+	s.End()
+}
+
+// End finishes the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	sd := s.data
+	s.lock.Unlock()
+
+	s.tracer.record(sd)
+}
@@ -0,0 +1,503 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout   = 3000      // bounds the proxy's dial onwards, and a dial held by a partition, in milliseconds
+	maxHeader     = 512       // defines the longest header line exchanged with the proxy in bytes
+	segmentSize   = 32 * 1024 // defines the most bytes forwarded as one delivery
+	segmentBuffer = 64        // defines the deliveries queued per direction of a connection
+)
+
+// A DialRefusedError is returned by a ViaProxy dial the proxy refused,
+// because of a fault or because it could not reach the address
+type DialRefusedError string
+
+func (e DialRefusedError) Error() string {
+	return fmt.Sprintf("transport: Dial refused by fault proxy: %s", string(e))
+}
+
+//==================================================================
+// ViaProxy
+//==================================================================
+
+type viaProxy struct {
+	proxyAddr string
+	self      string
+}
+
+// ViaProxy returns the Network of node self, whose dials all go through
+// the Proxy at proxyAddr. It listens on the real network; the proxy makes
+// the connections that other nodes dial through it.
+func ViaProxy(proxyAddr, self string) Network {
+	return viaProxy{proxyAddr: proxyAddr, self: self}
+}
+
+/*
+ Purpose: Dials addr through the proxy, which applies the faults on the link
+          between this node and the node listening at addr
+ Params: ctx - bounds the dial, including any time a partition holds it; addr - ip:port
+ Returns: The connection, once the proxy has connected onwards
+ Throws: DialRefusedError, ctx.Err(), or any error reaching the proxy
+*/
+func (v viaProxy) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := TCP{}.DialContext(ctx, v.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	_, err = fmt.Fprintf(conn, "%s %s\n", v.self, addr)
+	var reply string
+	if err == nil {
+		reply, err = readLine(conn)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply != "ok" {
+		conn.Close()
+		return nil, DialRefusedError(reply)
+	}
+	return conn, nil
+}
+
+func (v viaProxy) Listen(addr string) (net.Listener, error) {
+	return TCP{}.Listen(addr)
+}
+
+// readLine reads up to a newline one byte at a time, so that nothing
+// after it is consumed from conn
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxHeader {
+		_, err := conn.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", DialRefusedError("header too long")
+}
+
+//==================================================================
+// Proxy
+//==================================================================
+
+// A Proxy relays connections between nodes that dial through it with
+// ViaProxy, applying the faults set on the Link between each pair. A test
+// runs one Proxy and gives each node a Network from it.
+type Proxy struct {
+	Addr string
+
+	listener net.Listener
+	lock     sync.Mutex
+	names    map[string]string // node name by listening address
+	links    map[[2]string]*Link
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+/*
+ Purpose: Starts a proxy on a free loopback port
+ Params: seed - seeds the random delays and drops, so a run can be repeated
+ Returns: The running proxy
+ Throws: Any error binding the port
+*/
+func NewProxy(seed int64) (*Proxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{Addr: l.Addr().String(), listener: l, names: make(map[string]string),
+		links: make(map[[2]string]*Link), rand: rand.New(rand.NewSource(seed))}
+	go p.serve()
+	return p, nil
+}
+
+// Network returns the Network of node self, dialing through p
+func (p *Proxy) Network(self string) Network {
+	return ViaProxy(p.Addr, self)
+}
+
+// Name records that node listens at addr, so dials to addr are subject
+// to node's links. A node without a name is known by its address.
+func (p *Proxy) Name(addr, node string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.names[addr] = node
+}
+
+// Link returns the faults between nodes a and b. They apply in both
+// directions to every connection between the two, whichever dialed.
+func (p *Proxy) Link(a, b string) *Link {
+	if b < a {
+		a, b = b, a
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	l := p.links[[2]string{a, b}]
+	if l == nil {
+		l = &Link{proxy: p, healed: make(chan struct{}), conns: make(map[*proxyConn]bool)}
+		close(l.healed)
+		p.links[[2]string{a, b}] = l
+	}
+	return l
+}
+
+// Close stops accepting dials and cuts every connection
+func (p *Proxy) Close() error {
+	err := p.listener.Close()
+
+	p.lock.Lock()
+	links := make([]*Link, 0, len(p.links))
+	for _, l := range p.links {
+		links = append(links, l)
+	}
+	p.lock.Unlock()
+
+	for _, l := range links {
+		l.Cut()
+	}
+	return err
+}
+
+func (p *Proxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.relay(conn)
+	}
+}
+
+/*
+ Purpose: Reads a dial's header, connects onwards unless the link refuses,
+          then forwards the connection in both directions
+ Params: conn - the connection from the dialing node
+ Returns
+ Throws:
+*/
+func (p *Proxy) relay(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(dialTimeout * time.Millisecond))
+	header, err := readLine(conn)
+	fields := strings.Fields(header)
+	if err != nil || len(fields) != 2 {
+		conn.Close()
+		return
+	}
+
+	from, addr := fields[0], fields[1]
+	p.lock.Lock()
+	to, ok := p.names[addr]
+	p.lock.Unlock()
+	if !ok {
+		to = addr
+	}
+	link := p.Link(from, to)
+
+	// A dial across a partition is held, as TCP retries its SYN, until
+	// the link heals or the dial times out
+	refusal := ""
+	if !link.wait(nil, dialTimeout*time.Millisecond) {
+		refusal = "partitioned from " + to
+	} else if p.chance(link.dropRate()) {
+		refusal = "dropped by link to " + to
+	}
+
+	var target net.Conn
+	if refusal == "" {
+		target, err = net.DialTimeout("tcp", addr, dialTimeout*time.Millisecond)
+		if err != nil {
+			refusal = err.Error()
+		}
+	}
+	if refusal != "" {
+		fmt.Fprintf(conn, "%s\n", refusal)
+		conn.Close()
+		return
+	}
+
+	_, err = io.WriteString(conn, "ok\n")
+	if err != nil {
+		conn.Close()
+		target.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	pc := &proxyConn{link: link, a: conn, b: target, done: make(chan struct{})}
+	link.add(pc)
+	pc.open.Add(2)
+	go pc.forward(conn, target)
+	go pc.forward(target, conn)
+}
+
+// chance returns true with probability rate
+func (p *Proxy) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	p.randLock.Lock()
+	defer p.randLock.Unlock()
+	return p.rand.Float64() < rate
+}
+
+// spread returns a random duration in [0, d)
+func (p *Proxy) spread(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	p.randLock.Lock()
+	defer p.randLock.Unlock()
+	return time.Duration(p.rand.Int63n(int64(d)))
+}
+
+//==================================================================
+// Link
+//==================================================================
+
+// A Link holds the faults between two nodes. All are off until set.
+type Link struct {
+	proxy  *Proxy
+	lock   sync.Mutex
+	healed chan struct{} // closed unless partitioned
+	delay  time.Duration
+	jitter time.Duration
+	drop   float64
+	conns  map[*proxyConn]bool
+}
+
+// Partition stops traffic between the nodes without closing their
+// connections, as a network partition would. Bytes in flight are held
+// and new dials wait until Heal, or are refused after a timeout.
+func (l *Link) Partition() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.healed:
+		l.healed = make(chan struct{})
+	default:
+	}
+}
+
+// Heal ends a partition, delivering the bytes it held
+func (l *Link) Heal() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.healed:
+	default:
+		close(l.healed)
+	}
+}
+
+// Delay holds each delivery between the nodes for delay plus a random
+// part of jitter. Bytes on one connection stay in order, as over TCP, but
+// jitter reorders deliveries on different connections, such as a
+// heartbeat overtaking an RPC sent before it.
+func (l *Link) Delay(delay, jitter time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.delay = delay
+	l.jitter = jitter
+}
+
+// Drop refuses each new dial between the nodes, and cuts the connection
+// at each delivery, with probability rate
+func (l *Link) Drop(rate float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drop = rate
+}
+
+// Cut closes every connection now open between the nodes
+func (l *Link) Cut() {
+	l.lock.Lock()
+	conns := make([]*proxyConn, 0, len(l.conns))
+	for pc := range l.conns {
+		conns = append(conns, pc)
+	}
+	l.lock.Unlock()
+
+	for _, pc := range conns {
+		pc.close()
+	}
+}
+
+// Clear turns off every fault
+func (l *Link) Clear() {
+	l.Heal()
+	l.Delay(0, 0)
+	l.Drop(0)
+}
+
+// wait blocks while the link is partitioned, returning false if done is
+// closed or timeout passes first. A timeout of 0 waits indefinitely.
+func (l *Link) wait(done <-chan struct{}, timeout time.Duration) bool {
+	l.lock.Lock()
+	healed := l.healed
+	l.lock.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-healed:
+		return true
+	case <-done:
+		return false
+	case <-expired:
+		return false
+	}
+}
+
+func (l *Link) dropRate() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.drop
+}
+
+func (l *Link) latency() time.Duration {
+	l.lock.Lock()
+	delay, jitter := l.delay, l.jitter
+	l.lock.Unlock()
+	return delay + l.proxy.spread(jitter)
+}
+
+func (l *Link) add(pc *proxyConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.conns[pc] = true
+}
+
+func (l *Link) remove(pc *proxyConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.conns, pc)
+}
+
+//==================================================================
+// Forwarding
+//==================================================================
+
+// A proxyConn is one relayed connection between a and b
+type proxyConn struct {
+	link *Link
+	a, b net.Conn
+	open sync.WaitGroup // directions still forwarding
+	once sync.Once
+	done chan struct{} // closed once the connection is closed
+}
+
+type segment struct {
+	data []byte
+	due  time.Time
+}
+
+/*
+ Purpose: Copies src to dst, holding each delivery for the link's delay and
+          while it is partitioned, and cutting the connection if the link
+          drops it. At EOF, dst is closed for writing once all is delivered.
+ Params: src, dst - the two ends
+ Returns
+ Throws:
+*/
+func (pc *proxyConn) forward(src, dst net.Conn) {
+	segments := make(chan segment, segmentBuffer)
+	var readErr error
+	go func() {
+		defer close(segments)
+		for {
+			buf := make([]byte, segmentSize)
+			n, err := src.Read(buf)
+			if n > 0 {
+				segments <- segment{data: buf[:n], due: time.Now().Add(pc.link.latency())}
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+
+	ok := true
+	for s := range segments {
+		if ok {
+			ok = pc.deliver(dst, s)
+			if !ok {
+				pc.close()
+			}
+		}
+	}
+
+	if ok && readErr == io.EOF {
+		if tcp, isTCP := dst.(*net.TCPConn); isTCP {
+			tcp.CloseWrite()
+		}
+	} else {
+		pc.close()
+	}
+
+	pc.open.Done()
+	pc.open.Wait()
+	pc.close()
+}
+
+// deliver writes s to dst when due, returning false if the connection ended
+func (pc *proxyConn) deliver(dst net.Conn, s segment) bool {
+	timer := time.NewTimer(time.Until(s.due))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-pc.done:
+		return false
+	}
+
+	if !pc.link.wait(pc.done, 0) {
+		return false
+	}
+	if pc.link.proxy.chance(pc.link.dropRate()) {
+		return false
+	}
+	_, err := dst.Write(s.data)
+	return err == nil
+}
+
+func (pc *proxyConn) close() {
+	pc.once.Do(func() {
+		close(pc.done)
+		pc.a.Close()
+		pc.b.Close()
+		pc.link.remove(pc)
+	})
+}
@@ -0,0 +1,608 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	muxPreamble   = "DFS-MUX/1\n" // sent first by the dialing side of a multiplexed connection
+	muxHeaderSize = 9             // defines the frame header size in bytes: type, stream ID, length
+	muxWindow     = 256 * 1024    // defines the bytes a stream may have in flight unread in each direction
+	muxFrameSize  = 16 * 1024     // defines the most data bytes sent as one frame
+	muxBacklog    = 64            // defines the streams opened by the peer waiting for Accept
+)
+
+// Frame types. The length field of a data frame counts the payload that
+// follows it; that of a window frame is the credit returned to the sender.
+const (
+	frameData   byte = iota // payload for the stream
+	frameWindow             // the receiver has read this many more bytes
+	frameOpen               // the sender opened the stream
+	frameClose              // the sender will write no more to the stream
+)
+
+// A SessionClosedError is returned by a Session, and its streams, once its
+// connection has failed or been closed
+type SessionClosedError string
+
+func (e SessionClosedError) Error() string {
+	return fmt.Sprintf("transport: Multiplexed session closed: %s", string(e))
+}
+
+//==================================================================
+// Session
+//==================================================================
+
+// A Session carries any number of streams, each a net.Conn, over one
+// connection, so that either side may open streams to the other whichever
+// side dialed. Each stream has its own flow control window, so a stream
+// whose reader is slow does not hold up the others. A Session is also a
+// net.Listener, accepting the streams its peer opens.
+type Session struct {
+	conn      net.Conn
+	writeLock sync.Mutex // serializes frames onto conn
+
+	lock     sync.Mutex // guards the fields below
+	streams  map[uint32]*stream
+	nextID   uint32 // odd on the dialing side, even on the other, so IDs never collide
+	accepted chan *stream
+	control  []controlFrame // frames queued by the receive goroutine, sent by sendControl
+	queued   chan struct{}  // signals sendControl that control is not empty
+	closed   chan struct{}
+	err      error // why the session ended, once closed is closed
+}
+
+// A controlFrame is a window or close frame the receive goroutine queues
+// rather than writes, so that it never blocks on the connection. Were both
+// sides' receive goroutines writing while neither reads, the session would stall.
+type controlFrame struct {
+	typ    byte
+	id     uint32
+	length uint32
+}
+
+/*
+ Purpose: Starts a session on a connection this side dialed
+ Params: conn - the connection, over TLS if the peer requires it
+ Returns: The session
+ Throws: Any error sending the preamble
+*/
+func Client(conn net.Conn) (*Session, error) {
+	_, err := io.WriteString(conn, muxPreamble)
+	if err != nil {
+		return nil, err
+	}
+	return newSession(conn, 1), nil
+}
+
+// Server starts a session on an accepted connection for which Sniff reported one
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{conn: conn, streams: make(map[uint32]*stream), nextID: firstID,
+		accepted: make(chan *stream, muxBacklog), queued: make(chan struct{}, 1), closed: make(chan struct{})}
+	go s.receive()
+	go s.sendControl()
+	return s
+}
+
+/*
+ Purpose: Reads the start of an accepted connection to tell whether the peer
+          began a multiplexed session, stopping at the first byte that differs
+          from the preamble
+ Params: conn - the accepted connection
+ Returns: conn, with any bytes read put back unless it began a session; whether it did
+ Throws: Any error reading conn
+*/
+func Sniff(conn net.Conn) (net.Conn, bool, error) {
+	read := make([]byte, 0, len(muxPreamble))
+	b := make([]byte, 1)
+	for len(read) < len(muxPreamble) {
+		_, err := conn.Read(b)
+		if err != nil {
+			return nil, false, err
+		}
+		read = append(read, b[0])
+		if b[0] != muxPreamble[len(read)-1] {
+			return &replayConn{Conn: conn, pending: read}, false, nil
+		}
+	}
+	return conn, true, nil
+}
+
+// A replayConn returns bytes already read from its connection before reading more
+type replayConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+/*
+ Purpose: Opens a stream to the peer
+ Params:
+ Returns: The stream, which the peer receives from Accept
+ Throws: SessionClosedError, or any error sending the open frame
+*/
+func (s *Session) Open() (net.Conn, error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil, s.err
+	}
+	st := newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.lock.Unlock()
+
+	err := s.writeFrame(frameOpen, st.id, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for a stream opened by the peer
+func (s *Session) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accepted:
+		return st, nil
+	case <-s.closed:
+		return nil, s.err
+	}
+}
+
+// Close ends every stream and closes the connection
+func (s *Session) Close() error {
+	s.shutdown(SessionClosedError("closed locally"))
+	return nil
+}
+
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Done is closed once the session has ended
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+/*
+ Purpose: Reads frames until the connection fails, delivering each to its stream
+ Params:
+ Returns
+ Throws:
+*/
+func (s *Session) receive() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		_, err := io.ReadFull(s.conn, header)
+		if err != nil {
+			s.shutdown(SessionClosedError(err.Error()))
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		var payload []byte
+		if typ == frameData {
+			if length > muxFrameSize {
+				s.shutdown(SessionClosedError("oversized frame"))
+				return
+			}
+			payload = make([]byte, length)
+			_, err = io.ReadFull(s.conn, payload)
+			if err != nil {
+				s.shutdown(SessionClosedError(err.Error()))
+				return
+			}
+		}
+
+		err = s.deliver(typ, id, length, payload)
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+	}
+}
+
+/*
+ Purpose: Applies one frame from the peer
+ Params: typ, id, length - from the frame header; payload - a data frame's bytes
+ Returns
+ Throws: SessionClosedError if the peer broke the protocol
+*/
+func (s *Session) deliver(typ byte, id uint32, length uint32, payload []byte) error {
+	s.lock.Lock()
+	st := s.streams[id]
+	if typ == frameOpen {
+		if st != nil || id%2 == s.nextID%2 {
+			s.lock.Unlock()
+			return SessionClosedError(fmt.Sprintf("stream %d opened twice", id))
+		}
+		st = newStream(s, id)
+		s.streams[id] = st
+		s.lock.Unlock()
+
+		select {
+		case s.accepted <- st:
+		default:
+			// Nobody is accepting; refuse the stream
+			st.refuse()
+		}
+		return nil
+	}
+	s.lock.Unlock()
+
+	if st == nil {
+		// The stream was closed at both ends, and this frame crossed its close
+		if typ == frameData {
+			s.queueFrame(frameWindow, id, length)
+		}
+		return nil
+	}
+
+	switch typ {
+	case frameData:
+		return st.received(payload)
+	case frameWindow:
+		st.credit(int(length))
+	case frameClose:
+		st.closedByPeer()
+	default:
+		return SessionClosedError(fmt.Sprintf("unknown frame type %d", typ))
+	}
+	return nil
+}
+
+// writeFrame sends one frame, serialized with every other frame on the connection
+func (s *Session) writeFrame(typ byte, id uint32, length uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], length)
+	copy(frame[muxHeaderSize:], payload)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, err := s.conn.Write(frame)
+	if err != nil {
+		s.shutdown(SessionClosedError(err.Error()))
+		return err
+	}
+	return nil
+}
+
+// queueFrame has sendControl send a frame without a payload, without waiting for the connection
+func (s *Session) queueFrame(typ byte, id uint32, length uint32) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.control = append(s.control, controlFrame{typ: typ, id: id, length: length})
+	s.lock.Unlock()
+
+	select {
+	case s.queued <- struct{}{}:
+	default:
+		// sendControl is already due to send the queue
+	}
+}
+
+/*
+ Purpose: Sends the frames queued by queueFrame, in order, until the session ends
+ Params:
+ Returns
+ Throws:
+*/
+func (s *Session) sendControl() {
+	for {
+		select {
+		case <-s.queued:
+		case <-s.closed:
+			return
+		}
+
+		s.lock.Lock()
+		frames := s.control
+		s.control = nil
+		s.lock.Unlock()
+
+		for _, f := range frames {
+			if s.writeFrame(f.typ, f.id, f.length, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// shutdown ends the session once, failing every stream with err
+func (s *Session) shutdown(err error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*stream)
+	close(s.closed)
+	s.lock.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+// forget drops a stream closed at both ends
+func (s *Session) forget(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+//==================================================================
+// Streams
+//==================================================================
+
+// A stream is one bidirectional byte stream of a Session
+type stream struct {
+	id      uint32
+	session *Session
+
+	lock          sync.Mutex
+	changed       *sync.Cond // signalled whenever the fields below change
+	buf           []byte     // received and not yet read
+	unacked       int        // read but not yet returned to the sender as window
+	sendWindow    int        // bytes the peer can still take
+	localClosed   bool
+	remoteClosed  bool
+	err           error // set if the session ended
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(s *Session, id uint32) *stream {
+	st := &stream{id: id, session: s, sendWindow: muxWindow}
+	st.changed = sync.NewCond(&st.lock)
+	return st
+}
+
+/*
+ Purpose: Reads received bytes, waiting for some to arrive
+ Params: b - receives the bytes
+ Returns: The number of bytes read
+ Throws: io.EOF once the peer has closed the stream and everything it sent is read,
+         net.ErrClosed after Close, os.ErrDeadlineExceeded, or SessionClosedError
+*/
+func (st *stream) Read(b []byte) (int, error) {
+	st.lock.Lock()
+	for len(st.buf) == 0 {
+		switch {
+		case st.localClosed:
+			st.lock.Unlock()
+			return 0, net.ErrClosed
+		case st.err != nil:
+			st.lock.Unlock()
+			return 0, st.err
+		case st.remoteClosed:
+			st.lock.Unlock()
+			return 0, io.EOF
+		case !st.readDeadline.IsZero() && !time.Now().Before(st.readDeadline):
+			st.lock.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.changed.Wait()
+	}
+
+	n := copy(b, st.buf)
+	st.buf = st.buf[n:]
+	st.unacked += n
+	credit := 0
+	if st.unacked >= muxWindow/2 {
+		credit, st.unacked = st.unacked, 0
+	}
+	st.lock.Unlock()
+
+	if credit > 0 {
+		st.session.writeFrame(frameWindow, st.id, uint32(credit), nil)
+	}
+	return n, nil
+}
+
+/*
+ Purpose: Writes b as data frames, waiting whenever the peer's window is full
+ Params: b - the bytes
+ Returns: The number of bytes written
+ Throws: net.ErrClosed after Close, os.ErrDeadlineExceeded, or SessionClosedError
+*/
+func (st *stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.lock.Lock()
+		for st.sendWindow == 0 && !st.localClosed && st.err == nil {
+			if !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline) {
+				st.lock.Unlock()
+				return written, os.ErrDeadlineExceeded
+			}
+			st.changed.Wait()
+		}
+		if st.localClosed {
+			st.lock.Unlock()
+			return written, net.ErrClosed
+		}
+		if st.err != nil {
+			st.lock.Unlock()
+			return written, st.err
+		}
+
+		n := len(b) - written
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > muxFrameSize {
+			n = muxFrameSize
+		}
+		st.sendWindow -= n
+		st.lock.Unlock()
+
+		err := st.session.writeFrame(frameData, st.id, uint32(n), b[written:written+n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// refuse closes a stream the peer just opened, for which nobody is accepting
+func (st *stream) refuse() {
+	st.lock.Lock()
+	st.localClosed = true
+	st.changed.Broadcast()
+	st.lock.Unlock()
+
+	st.session.queueFrame(frameClose, st.id, 0)
+}
+
+// Close tells the peer no more will be written, and fails local reads and writes
+func (st *stream) Close() error {
+	st.lock.Lock()
+	if st.localClosed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	both := st.remoteClosed
+	failed := st.err != nil
+	// Bytes never to be read are returned to the sender, which may still be writing
+	credit := st.unacked + len(st.buf)
+	st.buf, st.unacked = nil, 0
+	st.changed.Broadcast()
+	st.lock.Unlock()
+
+	if failed {
+		return nil
+	}
+	if both {
+		st.session.forget(st.id)
+	}
+	if credit > 0 && !both {
+		st.session.writeFrame(frameWindow, st.id, uint32(credit), nil)
+	}
+	return st.session.writeFrame(frameClose, st.id, 0, nil)
+}
+
+func (st *stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+	st.wakeAt(t)
+	return nil
+}
+
+func (st *stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+	st.wakeAt(t)
+	return nil
+}
+
+// wakeAt wakes blocked reads and writes at t, so they notice a deadline has passed
+func (st *stream) wakeAt(t time.Time) {
+	st.lock.Lock()
+	st.changed.Broadcast()
+	st.lock.Unlock()
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		st.lock.Lock()
+		st.changed.Broadcast()
+		st.lock.Unlock()
+	})
+}
+
+/*
+ Purpose: Buffers a data frame's payload for Read
+ Params: payload - the bytes
+ Returns
+ Throws: SessionClosedError if the peer overran the window
+*/
+func (st *stream) received(payload []byte) error {
+	st.lock.Lock()
+	if st.localClosed {
+		st.lock.Unlock()
+		st.session.queueFrame(frameWindow, st.id, uint32(len(payload)))
+		return nil
+	}
+	if len(st.buf)+st.unacked+len(payload) > muxWindow {
+		st.lock.Unlock()
+		return SessionClosedError(fmt.Sprintf("stream %d overran its window", st.id))
+	}
+	st.buf = append(st.buf, payload...)
+	st.changed.Broadcast()
+	st.lock.Unlock()
+	return nil
+}
+
+// credit lets Write send n more bytes
+func (st *stream) credit(n int) {
+	st.lock.Lock()
+	st.sendWindow += n
+	st.changed.Broadcast()
+	st.lock.Unlock()
+}
+
+// closedByPeer records that the peer will write no more
+func (st *stream) closedByPeer() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	both := st.localClosed
+	st.changed.Broadcast()
+	st.lock.Unlock()
+
+	if both {
+		st.session.forget(st.id)
+	}
+}
+
+// fail ends the stream with the session's error
+func (st *stream) fail(err error) {
+	st.lock.Lock()
+	st.err = err
+	st.changed.Broadcast()
+	st.lock.Unlock()
+}
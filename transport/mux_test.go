@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const muxTimeout = 5 * time.Second // bounds each step that would hang were the session stalled
+
+// Streams that both sides refuse at once must not stall the session: the
+// receive goroutines answer them with close frames, and over an unbuffered
+// pipe neither could write those while the other is writing too
+func TestRefusedStreamsDoNotStall(t *testing.T) {
+	dialed, accepted := net.Pipe()
+	client := newSession(dialed, 1)
+	server := Server(accepted)
+	defer client.Close()
+	defer server.Close()
+
+	// Nobody accepts, so every stream past the backlog is refused
+	var wg sync.WaitGroup
+	for _, s := range []*Session{client, server} {
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			for i := 0; i < 4*muxBacklog; i++ {
+				st, err := s.Open()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				st.Close()
+			}
+		}(s)
+	}
+	wait(t, "opening streams", func() { wg.Wait() })
+
+	// Drain the backlogs, then check a new stream still carries data
+	for _, s := range []*Session{client, server} {
+		for len(s.accepted) > 0 {
+			(<-s.accepted).Close()
+		}
+	}
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var echoed []byte
+	wait(t, "echoing", func() {
+		peer, err := server.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, err = st.Write([]byte("ping"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		st.Close()
+		echoed, err = io.ReadAll(peer)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	if string(echoed) != "ping" {
+		t.Errorf("got %q, want %q", echoed, "ping")
+	}
+}
+
+// wait runs f, failing the test if it does not return within muxTimeout
+func wait(t *testing.T, what string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(muxTimeout):
+		t.Fatalf("stalled %s", what)
+	}
+}
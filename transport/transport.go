@@ -0,0 +1,28 @@
+// Package transport defines how the server and dfslib dial and accept
+// connections, so that tests can replace the real network with one that
+// injects faults between chosen nodes
+package transport
+
+import (
+	"context"
+	"net"
+)
+
+// A Network dials and listens on behalf of one node. Implementations must
+// be safe for concurrent use.
+type Network interface {
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// TCP is the real network, used unless another is configured
+type TCP struct{}
+
+func (TCP) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (TCP) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}